@@ -5,11 +5,17 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/yadmabramov/admAlerting/internal/history"
+	"github.com/yadmabramov/admAlerting/internal/s3"
 	"github.com/yadmabramov/admAlerting/internal/server"
+	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
 )
 
 func getEnv(key, defaultValue string) string {
@@ -37,6 +43,15 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
 func validateAndNormalizeServerURL(rawURL string) (string, error) {
 	u, err := url.Parse(rawURL)
 	if err != nil {
@@ -50,27 +65,93 @@ func validateAndNormalizeServerURL(rawURL string) (string, error) {
 	return u.String(), nil
 }
 
+// normalizePeerURL приводит адрес узла кластера к виду http://host:port,
+// в котором он сравнивается с другими адресами.
+func normalizePeerURL(rawURL string) (string, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	normalized, err := validateAndNormalizeServerURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(normalized, "/"), nil
+}
+
 func main() {
 	defaultConfig := server.Config{
-		Addr:          "localhost:8080",
-		StoreInterval: 5 * time.Second,
-		StoragePath:   "metrics-db.json",
-		Restore:       true,
+		Addr:              "localhost:8080",
+		StoreInterval:     5 * time.Second,
+		StoragePath:       "metrics-db.json",
+		Restore:           true,
+		SnapshotRetention: 3,
+		HistoryRetention:  time.Hour,
+		HistorySamples:    1800,
+		HistoryTiers:      history.DefaultTiers(),
+		ChangeFeedRetain:  10000,
 	}
 
 	config := server.Config{
-		Addr:          getEnv("ADDRESS", defaultConfig.Addr),
-		StoreInterval: getEnvDuration("STORE_INTERVAL", defaultConfig.StoreInterval),
-		StoragePath:   getEnv("FILE_STORAGE_PATH", defaultConfig.StoragePath),
-		Restore:       getEnvBool("RESTORE", defaultConfig.Restore),
+		Addr:              getEnv("ADDRESS", defaultConfig.Addr),
+		StoreInterval:     getEnvDuration("STORE_INTERVAL", defaultConfig.StoreInterval),
+		StoragePath:       getEnv("FILE_STORAGE_PATH", defaultConfig.StoragePath),
+		Restore:           getEnvBool("RESTORE", defaultConfig.Restore),
+		SnapshotRetention: getEnvInt("SNAPSHOT_RETENTION", defaultConfig.SnapshotRetention),
+		HistoryRetention:  getEnvDuration("HISTORY_RETENTION", defaultConfig.HistoryRetention),
+		HistorySamples:    getEnvInt("HISTORY_SAMPLES", defaultConfig.HistorySamples),
+		HistoryTiers:      defaultConfig.HistoryTiers,
+		Replication:       getEnvBool("REPLICATION", false),
+		ChangeFeed:        getEnvBool("CHANGE_FEED", false),
+		ChangeFeedRetain:  getEnvInt("CHANGE_FEED_RETAIN", defaultConfig.ChangeFeedRetain),
+		LeaderURL:         getEnv("LEADER_URL", ""),
+		AdminKey:          getEnv("ADMIN_KEY", ""),
+		ClusterSecret:     getEnv("CLUSTER_SECRET", ""),
+		SnapshotFormat:    getEnv("SNAPSHOT_FORMAT", ""),
+		S3: s3.Config{
+			Endpoint:  getEnv("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:    getEnv("S3_REGION", ""),
+			Bucket:    getEnv("S3_BUCKET", ""),
+			AccessKey: getEnv("AWS_ACCESS_KEY_ID", ""),
+			SecretKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		},
+		S3Prefix:   getEnv("S3_PREFIX", ""),
+		S3Interval: getEnvDuration("S3_INTERVAL", 0),
 	}
 
-	var flagAddr, flagStoreInt, flagStoragePath string
-	var flagRestore bool
+	var flagAddr, flagStoreInt, flagStoragePath, flagWALPath string
+	var flagRestore, flagReplication, flagChangeFeed bool
+	var flagLeaderURL, flagSnapshotFormat, flagSnapshotKeyFile string
+	var flagS3Endpoint, flagS3Region, flagS3Bucket, flagS3Prefix string
+	var flagRetention, flagHistorySamples, flagChangeFeedRetain int
+	var flagHistoryRetention, flagHistoryTiers, flagMetricTTL string
+	var flagMetricLimits, flagTypeConflicts, flagAdminKey string
+	var flagClusterPeers, flagClusterSelf, flagClusterSecret string
 	pflag.StringVarP(&flagAddr, "address", "a", "", "HTTP server endpoint address (env: ADDRESS)")
-	pflag.StringVarP(&flagStoreInt, "store-interval", "i", "", "Interval to save metrics to disk in seconds (env: STORE_INTERVAL)")
+	pflag.StringVarP(&flagStoreInt, "store-interval", "i", "", "Interval to save metrics to disk in seconds, 0 saves on every update (env: STORE_INTERVAL)")
 	pflag.StringVarP(&flagStoragePath, "file-storage-path", "f", "", "Path to file for saving metrics (env: FILE_STORAGE_PATH)")
 	pflag.BoolVarP(&flagRestore, "restore", "r", true, "Restore metrics from file (env: RESTORE)")
+	pflag.IntVar(&flagRetention, "snapshot-retention", defaultConfig.SnapshotRetention, "Number of snapshot files to keep (env: SNAPSHOT_RETENTION)")
+	pflag.StringVar(&flagSnapshotFormat, "snapshot-format", "", "Snapshot format: json or gzip, default by file extension (env: SNAPSHOT_FORMAT)")
+	pflag.StringVar(&flagSnapshotKeyFile, "snapshot-key-file", "", "File with snapshot encryption keys, current key first (env: SNAPSHOT_KEY_FILE)")
+	pflag.StringVar(&flagS3Endpoint, "s3-endpoint", "", "S3-compatible endpoint for snapshot backups (env: S3_ENDPOINT)")
+	pflag.StringVar(&flagS3Region, "s3-region", "", "S3 region (env: S3_REGION)")
+	pflag.StringVar(&flagS3Bucket, "s3-bucket", "", "S3 bucket for snapshot backups, empty disables them (env: S3_BUCKET)")
+	pflag.StringVar(&flagS3Prefix, "s3-prefix", "", "Object key prefix for snapshot backups (env: S3_PREFIX)")
+	pflag.StringVar(&flagHistoryRetention, "history-retention", "", "How long to keep metric history in seconds, 0 disables it (env: HISTORY_RETENTION)")
+	pflag.IntVar(&flagHistorySamples, "history-samples", defaultConfig.HistorySamples, "Max history samples per metric (env: HISTORY_SAMPLES)")
+	pflag.StringVar(&flagHistoryTiers, "history-tiers", "", "Downsampling tiers as resolution:retention list, e.g. 1m:24h,1h:720h (env: HISTORY_TIERS)")
+	pflag.StringVar(&flagMetricTTL, "metric-ttl", "", "Expire stale metrics by name glob, e.g. Tmp*=10m,*=0 (env: METRIC_TTL)")
+	pflag.StringVar(&flagMetricLimits, "metric-limits", "", "Limit distinct metrics by name prefix, * for the total, e.g. *=100000,Tmp=1000 (env: METRIC_LIMITS)")
+	pflag.StringVar(&flagTypeConflicts, "type-conflicts", service.ConflictAllow, "What to do when a metric name is reused under another type: allow, reject or migrate (env: TYPE_CONFLICTS)")
+	pflag.StringVarP(&flagWALPath, "wal-path", "w", "", "Path to write-ahead log, empty disables it (env: WAL_PATH)")
+	pflag.BoolVar(&flagReplication, "replication", false, "Allow followers to stream changes from this server (env: REPLICATION)")
+	pflag.BoolVar(&flagChangeFeed, "change-feed", false, "Stream metric changes at /api/v1/watch (env: CHANGE_FEED)")
+	pflag.IntVar(&flagChangeFeedRetain, "change-feed-retain", defaultConfig.ChangeFeedRetain, "Number of recent changes kept for resuming the feed (env: CHANGE_FEED_RETAIN)")
+	pflag.StringVar(&flagLeaderURL, "leader", "", "Run as a read-only follower of the leader at this URL (env: LEADER_URL)")
+	pflag.StringVar(&flagClusterPeers, "cluster-peers", "", "Comma-separated URLs of all cluster nodes including this one (env: CLUSTER_PEERS)")
+	pflag.StringVar(&flagClusterSelf, "cluster-self", "", "URL of this node as listed in cluster peers, default http://<address> (env: CLUSTER_SELF)")
+	pflag.StringVar(&flagClusterSecret, "cluster-secret", "", "Shared secret for signing requests between cluster nodes (env: CLUSTER_SECRET)")
+	pflag.StringVar(&flagAdminKey, "admin-key", "", "Admin API key for managing tenants, empty disables the admin API (env: ADMIN_KEY)")
 	pflag.BoolP("help", "h", false, "Show help message")
 	pflag.BoolP("version", "v", false, "Show version information")
 	pflag.CommandLine.SortFlags = false
@@ -80,9 +161,34 @@ func main() {
 		pflag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nEnvironment variables:\n")
 		fmt.Fprintf(os.Stderr, "  ADDRESS            HTTP server endpoint address (highest priority)\n")
-		fmt.Fprintf(os.Stderr, "  STORE_INTERVAL     Interval to save metrics to disk in seconds\n")
+		fmt.Fprintf(os.Stderr, "  STORE_INTERVAL     Interval to save metrics to disk in seconds (0 = synchronous)\n")
 		fmt.Fprintf(os.Stderr, "  FILE_STORAGE_PATH  Path to file for saving metrics\n")
 		fmt.Fprintf(os.Stderr, "  RESTORE            Restore metrics from file (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  SNAPSHOT_RETENTION Number of snapshot files to keep\n")
+		fmt.Fprintf(os.Stderr, "  SNAPSHOT_FORMAT    Snapshot format: json or gzip (default: by extension)\n")
+		fmt.Fprintf(os.Stderr, "  SNAPSHOT_KEY       Snapshot encryption keys as hex:<key> or base64:<key>, current first (key,old,...)\n")
+		fmt.Fprintf(os.Stderr, "  SNAPSHOT_KEY_FILE  File with snapshot encryption keys, one per line\n")
+		fmt.Fprintf(os.Stderr, "  S3_ENDPOINT        S3-compatible endpoint for snapshot backups\n")
+		fmt.Fprintf(os.Stderr, "  S3_REGION          S3 region (default: us-east-1)\n")
+		fmt.Fprintf(os.Stderr, "  S3_BUCKET          S3 bucket for snapshot backups\n")
+		fmt.Fprintf(os.Stderr, "  S3_PREFIX          Object key prefix for snapshot backups\n")
+		fmt.Fprintf(os.Stderr, "  S3_INTERVAL        Upload interval in seconds (default: STORE_INTERVAL)\n")
+		fmt.Fprintf(os.Stderr, "  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY  S3 credentials\n")
+		fmt.Fprintf(os.Stderr, "  HISTORY_RETENTION  How long to keep metric history in seconds\n")
+		fmt.Fprintf(os.Stderr, "  HISTORY_SAMPLES    Max history samples per metric\n")
+		fmt.Fprintf(os.Stderr, "  HISTORY_TIERS      Downsampling tiers (resolution:retention,...)\n")
+		fmt.Fprintf(os.Stderr, "  METRIC_TTL         Expire stale metrics (pattern=duration,...)\n")
+		fmt.Fprintf(os.Stderr, "  METRIC_LIMITS      Limit distinct metrics (prefix=count,...; * for the total)\n")
+		fmt.Fprintf(os.Stderr, "  TYPE_CONFLICTS     Metric name reused under another type: allow, reject or migrate\n")
+		fmt.Fprintf(os.Stderr, "  WAL_PATH           Path to write-ahead log (default: <FILE_STORAGE_PATH>.wal)\n")
+		fmt.Fprintf(os.Stderr, "  REPLICATION        Allow followers to connect (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CHANGE_FEED        Stream metric changes at /api/v1/watch (true/false)\n")
+		fmt.Fprintf(os.Stderr, "  CHANGE_FEED_RETAIN Number of recent changes kept for resuming the feed\n")
+		fmt.Fprintf(os.Stderr, "  LEADER_URL         Leader URL, makes this server a follower\n")
+		fmt.Fprintf(os.Stderr, "  CLUSTER_PEERS      URLs of all cluster nodes including this one (url,url,...)\n")
+		fmt.Fprintf(os.Stderr, "  CLUSTER_SELF       URL of this node as listed in CLUSTER_PEERS\n")
+		fmt.Fprintf(os.Stderr, "  CLUSTER_SECRET     Shared secret for signing requests between cluster nodes\n")
+		fmt.Fprintf(os.Stderr, "  ADMIN_KEY          Admin API key for managing tenants\n")
 		fmt.Fprintf(os.Stderr, "\nPriority: ENV > FLAGS > DEFAULTS\n")
 	}
 
@@ -106,6 +212,130 @@ func main() {
 	if pflag.Lookup("restore").Changed && os.Getenv("RESTORE") == "" {
 		config.Restore = flagRestore
 	}
+	if pflag.Lookup("snapshot-retention").Changed && os.Getenv("SNAPSHOT_RETENTION") == "" {
+		config.SnapshotRetention = flagRetention
+	}
+	if flagSnapshotFormat != "" && os.Getenv("SNAPSHOT_FORMAT") == "" {
+		config.SnapshotFormat = flagSnapshotFormat
+	}
+	switch config.SnapshotFormat {
+	case "", server.SnapshotJSON, server.SnapshotGzip:
+	default:
+		log.Fatalf("Invalid snapshot format %q: expected json or gzip", config.SnapshotFormat)
+	}
+	snapshotKeys, keysSet := os.LookupEnv("SNAPSHOT_KEY")
+	if !keysSet {
+		keyFile := getEnv("SNAPSHOT_KEY_FILE", flagSnapshotKeyFile)
+		if keyFile != "" {
+			data, err := os.ReadFile(keyFile)
+			if err != nil {
+				log.Fatalf("Failed to read snapshot key file: %v", err)
+			}
+			snapshotKeys, keysSet = string(data), true
+		}
+	}
+	if keysSet {
+		keys, err := server.ParseSnapshotKeys(snapshotKeys)
+		if err != nil {
+			log.Fatalf("Invalid snapshot keys: %v", err)
+		}
+		config.SnapshotKeys = keys
+	}
+	if flagS3Endpoint != "" && os.Getenv("S3_ENDPOINT") == "" {
+		config.S3.Endpoint = flagS3Endpoint
+	}
+	if flagS3Region != "" && os.Getenv("S3_REGION") == "" {
+		config.S3.Region = flagS3Region
+	}
+	if flagS3Bucket != "" && os.Getenv("S3_BUCKET") == "" {
+		config.S3.Bucket = flagS3Bucket
+	}
+	if flagS3Prefix != "" && os.Getenv("S3_PREFIX") == "" {
+		config.S3Prefix = flagS3Prefix
+	}
+	if flagHistoryRetention != "" && os.Getenv("HISTORY_RETENTION") == "" {
+		if retention, err := strconv.ParseInt(flagHistoryRetention, 10, 64); err == nil {
+			config.HistoryRetention = time.Duration(retention) * time.Second
+		}
+	}
+	if pflag.Lookup("history-samples").Changed && os.Getenv("HISTORY_SAMPLES") == "" {
+		config.HistorySamples = flagHistorySamples
+	}
+	tiers, tiersSet := os.LookupEnv("HISTORY_TIERS")
+	if !tiersSet && flagHistoryTiers != "" {
+		tiers, tiersSet = flagHistoryTiers, true
+	}
+	if tiersSet {
+		parsed, err := history.ParseTiers(tiers)
+		if err != nil {
+			log.Fatalf("Invalid history tiers: %v", err)
+		}
+		config.HistoryTiers = parsed
+	}
+	metricTTL, ttlSet := os.LookupEnv("METRIC_TTL")
+	if !ttlSet && flagMetricTTL != "" {
+		metricTTL, ttlSet = flagMetricTTL, true
+	}
+	if ttlSet {
+		policy, err := storage.ParseTTLPolicy(metricTTL)
+		if err != nil {
+			log.Fatalf("Invalid metric TTL: %v", err)
+		}
+		config.MetricTTLs = policy
+	}
+	metricLimits, limitsSet := os.LookupEnv("METRIC_LIMITS")
+	if !limitsSet && flagMetricLimits != "" {
+		metricLimits, limitsSet = flagMetricLimits, true
+	}
+	if limitsSet {
+		policy, err := storage.ParseLimitPolicy(metricLimits)
+		if err != nil {
+			log.Fatalf("Invalid metric limits: %v", err)
+		}
+		config.MetricLimits = &policy
+	}
+	typeConflicts, conflictsSet := os.LookupEnv("TYPE_CONFLICTS")
+	if !conflictsSet {
+		typeConflicts = flagTypeConflicts
+	}
+	policy, err := service.ParseConflictPolicy(typeConflicts)
+	if err != nil {
+		log.Fatalf("Invalid type conflict policy: %v", err)
+	}
+	config.TypeConflicts = policy
+	if walPath, exists := os.LookupEnv("WAL_PATH"); exists {
+		config.WALPath = walPath
+	} else if pflag.Lookup("wal-path").Changed {
+		config.WALPath = flagWALPath
+	} else {
+		config.WALPath = config.StoragePath + ".wal"
+	}
+
+	if pflag.Lookup("replication").Changed && os.Getenv("REPLICATION") == "" {
+		config.Replication = flagReplication
+	}
+	if pflag.Lookup("change-feed").Changed && os.Getenv("CHANGE_FEED") == "" {
+		config.ChangeFeed = flagChangeFeed
+	}
+	if pflag.Lookup("change-feed-retain").Changed && os.Getenv("CHANGE_FEED_RETAIN") == "" {
+		config.ChangeFeedRetain = flagChangeFeedRetain
+	}
+	if flagLeaderURL != "" && os.Getenv("LEADER_URL") == "" {
+		config.LeaderURL = flagLeaderURL
+	}
+	if flagClusterSecret != "" && os.Getenv("CLUSTER_SECRET") == "" {
+		config.ClusterSecret = flagClusterSecret
+	}
+	if flagAdminKey != "" && os.Getenv("ADMIN_KEY") == "" {
+		config.AdminKey = flagAdminKey
+	}
+	if config.LeaderURL != "" {
+		leaderURL, err := validateAndNormalizeServerURL(config.LeaderURL)
+		if err != nil {
+			log.Fatalf("Leader URL validation failed: %v", err)
+		}
+		config.LeaderURL = leaderURL
+	}
 
 	normalizedURL, err := validateAndNormalizeServerURL(config.Addr)
 	if err != nil {
@@ -113,6 +343,30 @@ func main() {
 	}
 	config.Addr = normalizedURL
 
+	clusterPeers := getEnv("CLUSTER_PEERS", flagClusterPeers)
+	clusterSelf := getEnv("CLUSTER_SELF", flagClusterSelf)
+	if clusterPeers != "" {
+		if clusterSelf == "" {
+			clusterSelf = config.Addr
+		}
+		if config.ClusterSelf, err = normalizePeerURL(clusterSelf); err != nil {
+			log.Fatalf("Cluster self URL validation failed: %v", err)
+		}
+		for _, peer := range strings.Split(clusterPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer == "" {
+				continue
+			}
+			normalized, err := normalizePeerURL(peer)
+			if err != nil {
+				log.Fatalf("Cluster peer URL validation failed: %v", err)
+			}
+			config.ClusterPeers = append(config.ClusterPeers, normalized)
+		}
+		if !slices.Contains(config.ClusterPeers, config.ClusterSelf) {
+			log.Fatalf("Cluster self URL %s is not among cluster peers", config.ClusterSelf)
+		}
+	}
+
 	srv := server.NewServer(config)
 	log.Printf("Server starting on %s", config.Addr)
 	if err := srv.ListenAndServe(); err != nil {
@@ -160,7 +160,18 @@ func (a *Agent) sendMetricJSON(mType, mName, mValue string) error {
 		return fmt.Errorf("unknown metric type: %s", mType)
 	}
 
-	jsonData, err := json.Marshal(metric)
+	var response models.Metrics
+	return a.postJSON("/update/", metric, &response)
+}
+
+func (a *Agent) sendMetricsBatchJSON(metrics []models.Metrics) error {
+	var response []models.Metrics
+	return a.postJSON("/updates/", metrics, &response)
+}
+
+// postJSON отправляет payload в сжатом gzip JSON и декодирует ответ.
+func (a *Agent) postJSON(path string, payload any, response any) error {
+	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal metric: %w", err)
 	}
@@ -174,7 +185,7 @@ func (a *Agent) sendMetricJSON(mType, mName, mValue string) error {
 		return fmt.Errorf("failed to close gzip writer: %w", err)
 	}
 
-	url := a.serverURL + "/update/"
+	url := a.serverURL + path
 	req, err := http.NewRequest("POST", url, &buf)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
@@ -194,8 +205,7 @@ func (a *Agent) sendMetricJSON(mType, mName, mValue string) error {
 		return fmt.Errorf("server returned status %d", resp.StatusCode)
 	}
 
-	var response models.Metrics
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
 		return fmt.Errorf("failed to decode response: %w", err)
 	}
 
@@ -206,13 +216,21 @@ func (a *Agent) sendMetrics() {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
+	// Все метрики отчёта отправляются одним пакетом, чтобы сервер применил их атомарно
+	batch := make([]models.Metrics, 0, len(a.metrics)+1)
 	for name, value := range a.metrics {
-		if err := a.sendMetricJSON("gauge", name, value); err != nil {
-			log.Printf("Failed to send metric %s: %v", name, err)
+		val, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			log.Printf("Failed to parse metric %s: %v", name, err)
+			continue
 		}
+		batch = append(batch, models.Metrics{ID: name, MType: "gauge", Value: &val})
 	}
 
-	if err := a.sendMetricJSON("counter", PollCount, strconv.FormatInt(a.pollCount, 10)); err != nil {
-		log.Printf("Failed to send PollCount: %v", err)
+	pollCount := a.pollCount
+	batch = append(batch, models.Metrics{ID: PollCount, MType: "counter", Delta: &pollCount})
+
+	if err := a.sendMetricsBatchJSON(batch); err != nil {
+		log.Printf("Failed to send metrics batch: %v", err)
 	}
 }
@@ -23,13 +23,21 @@ func TestAgent(t *testing.T) {
 		assert.NoError(t, err)
 		defer gz.Close()
 
-		var metric models.Metrics
-		err = json.NewDecoder(gz).Decode(&metric)
+		var payload any
+		if r.URL.Path == "/updates/" {
+			var metrics []models.Metrics
+			err = json.NewDecoder(gz).Decode(&metrics)
+			payload = metrics
+		} else {
+			var metric models.Metrics
+			err = json.NewDecoder(gz).Decode(&metric)
+			payload = metric
+		}
 		assert.NoError(t, err)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(metric)
+		json.NewEncoder(w).Encode(payload)
 	}))
 	defer ts.Close()
 
@@ -166,3 +174,38 @@ func TestSendMetricJSON(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestSendMetricsBatch(t *testing.T) {
+	var received []models.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/updates/", r.URL.Path)
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+
+		gz, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		defer gz.Close()
+
+		assert.NoError(t, json.NewDecoder(gz).Decode(&received))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(received)
+	}))
+	defer ts.Close()
+
+	a := NewAgent(Config{ServerURL: ts.URL})
+	a.collectMetrics()
+	a.sendMetrics()
+
+	assert.Len(t, received, len(a.metrics)+1)
+
+	var pollCount *models.Metrics
+	for i := range received {
+		if received[i].ID == PollCount {
+			pollCount = &received[i]
+		}
+	}
+	if assert.NotNil(t, pollCount) {
+		assert.Equal(t, "counter", pollCount.MType)
+		assert.Equal(t, int64(1), *pollCount.Delta)
+	}
+}
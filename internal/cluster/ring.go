@@ -0,0 +1,84 @@
+// Package cluster распределяет имена метрик по узлам кластера
+// согласованным хешированием: каждый узел занимает на кольце хешей
+// несколько виртуальных точек, а имя принадлежит узлу первой точки
+// по часовой стрелке от хеша имени. При добавлении или удалении узла
+// меняют владельца только имена, попавшие на его участки кольца.
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Число виртуальных точек узла; чем их больше, тем равномернее
+// распределение имён
+const virtualNodes = 128
+
+type point struct {
+	hash uint64
+	node string
+}
+
+// Ring — неизменяемое кольцо узлов, безопасное для параллельного чтения.
+type Ring struct {
+	nodes  []string
+	points []point
+}
+
+// NewRing строит кольцо из адресов узлов; повторы адресов игнорируются.
+func NewRing(nodes []string) *Ring {
+	r := &Ring{}
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Strings(r.nodes)
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r
+}
+
+// Nodes возвращает адреса узлов по возрастанию.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Owner возвращает узел, которому принадлежит key; для пустого кольца —
+// пустую строку.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// hash — FNV-1a с финальным перемешиванием splitmix64: сам FNV плохо
+// разносит близкие строки вроде node#1 и node#2.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,44 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil).Owner("Alloc"))
+
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	ring := NewRing(append(nodes, "http://a:8080"))
+	assert.Equal(t, nodes, ring.Nodes())
+
+	// Владелец не зависит от порядка узлов в списке
+	reversed := NewRing([]string{nodes[2], nodes[1], nodes[0]})
+
+	const keys = 30000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		key := "Metric" + strconv.Itoa(i)
+		owner := ring.Owner(key)
+		counts[owner]++
+		assert.Equal(t, owner, reversed.Owner(key))
+	}
+	for _, node := range nodes {
+		assert.InDelta(t, keys/len(nodes), counts[node], keys*0.1, node)
+	}
+
+	// Новый узел забирает примерно свою долю имён, остальные остаются на месте
+	grown := NewRing(append(nodes, "http://d:8080"))
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := "Metric" + strconv.Itoa(i)
+		before, after := ring.Owner(key), grown.Owner(key)
+		if before != after {
+			moved++
+			assert.Equal(t, "http://d:8080", after)
+		}
+	}
+	assert.InDelta(t, keys/4, moved, keys*0.1)
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/yadmabramov/admAlerting/internal/service"
+)
+
+type conflictsResponse struct {
+	Policy    string                 `json:"policy"`
+	Conflicts []service.TypeConflict `json:"conflicts"`
+}
+
+// HandleTypeConflicts показывает политику конфликтов типов и имена,
+// которые конфликтуют сейчас или конфликтовали при записи.
+func (h *MetricsHandler) HandleTypeConflicts(w http.ResponseWriter, r *http.Request) {
+	policy, conflicts, err := h.service.TypeConflicts(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conflictsResponse{Policy: policy, Conflicts: conflicts})
+}
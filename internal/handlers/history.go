@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/history"
+)
+
+const maxRangePoints = 11000
+
+type HistoryHandler struct {
+	history *history.History
+}
+
+func NewHistoryHandler(history *history.History) *HistoryHandler {
+	return &HistoryHandler{history: history}
+}
+
+type rangeResponse struct {
+	Type       string          `json:"type"`
+	Name       string          `json:"name"`
+	Start      time.Time       `json:"start"`
+	End        time.Time       `json:"end"`
+	Step       string          `json:"step"`
+	Resolution string          `json:"resolution"`
+	Points     []history.Point `json:"points"`
+}
+
+func (h *HistoryHandler) HandleQueryRange(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	mType := query.Get("type")
+	mName := query.Get("name")
+	if mType != "gauge" && mType != "counter" {
+		http.Error(w, "Invalid type", http.StatusBadRequest)
+		return
+	}
+	if mName == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	key, err := queryKey(r, mName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start, err := parseTime(query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	end, err := parseTime(query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := parseStep(query.Get("step"))
+	if err != nil {
+		http.Error(w, "Invalid step: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if end.Before(start) {
+		http.Error(w, "End must not be before start", http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start)/step >= maxRangePoints {
+		http.Error(w, "Too many points, increase step", http.StatusBadRequest)
+		return
+	}
+
+	series, err := h.history.Range(mType, key, start, end, step)
+	if errors.Is(err, history.ErrNotFound) {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resolution := "raw"
+	if series.Resolution > 0 {
+		resolution = series.Resolution.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rangeResponse{
+		Type:       mType,
+		Name:       mName,
+		Start:      start,
+		End:        end,
+		Step:       step.String(),
+		Resolution: resolution,
+		Points:     series.Points,
+	})
+}
+
+// parseTime принимает RFC3339 или unix-время в секундах (допускается дробная часть).
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("value is required")
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseStep принимает длительность в формате Go (10s, 1m) или число секунд.
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("value is required")
+	}
+
+	var step time.Duration
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		step = time.Duration(sec * float64(time.Second))
+	} else if step, err = time.ParseDuration(value); err != nil {
+		return 0, err
+	}
+
+	if step <= 0 {
+		return 0, fmt.Errorf("step must be positive")
+	}
+	return step, nil
+}
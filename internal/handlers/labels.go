@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+// labelsFromQuery читает метки из параметров вида label=host:a.
+func labelsFromQuery(r *http.Request) (map[string]string, error) {
+	values := r.URL.Query()["label"]
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	labels := make(map[string]string, len(values))
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid label %q: expected <name>:<value>", v)
+		}
+		labels[name] = value
+	}
+	return labels, models.ValidateLabels(labels)
+}
+
+// seriesKey проверяет метки и строит ключ хранения метрики.
+func seriesKey(name string, labels map[string]string) (string, error) {
+	if err := models.ValidateLabels(labels); err != nil {
+		return "", err
+	}
+	return models.SeriesKey(name, labels), nil
+}
+
+// queryKey строит ключ хранения из имени в пути и меток из параметров запроса.
+func queryKey(r *http.Request, name string) (string, error) {
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		return "", err
+	}
+	return models.SeriesKey(name, labels), nil
+}
+
+// filterByLabels оставляет метрики, метки которых содержат все пары фильтра.
+func filterByLabels[V any](metrics map[string]V, filter map[string]string) map[string]V {
+	filtered := make(map[string]V)
+	for key, value := range metrics {
+		if _, labels := models.ParseSeriesKey(key); models.MatchLabels(labels, filter) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+type LimitsHandler struct {
+	limits *storage.LimitedStorage
+}
+
+func NewLimitsHandler(limits *storage.LimitedStorage) *LimitsHandler {
+	return &LimitsHandler{limits: limits}
+}
+
+type limitsResponse struct {
+	Global   storage.LimitUsage   `json:"global"`
+	Prefixes []storage.LimitUsage `json:"prefixes"`
+}
+
+// HandleLimits показывает число метрик и ограничения на него.
+func (h *LimitsHandler) HandleLimits(w http.ResponseWriter, r *http.Request) {
+	global, prefixes := h.limits.Usage()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limitsResponse{Global: global, Prefixes: prefixes})
+}
@@ -1,13 +1,21 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"maps"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/yadmabramov/admAlerting/internal/history"
 	"github.com/yadmabramov/admAlerting/internal/models"
 	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
 )
 
 type MetricsHandler struct {
@@ -25,22 +33,31 @@ func (h *MetricsHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	mType := chi.URLParam(r, "type")
-	mName := chi.URLParam(r, "name")
 	mValue := chi.URLParam(r, "value")
+	mName, err := queryKey(r, chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var err error
+	ctx := r.Context()
 	switch mType {
 	case "gauge":
-		err = h.service.UpdateGauge(mName, mValue)
+		err = h.service.UpdateGauge(ctx, mName, mValue)
 	case "counter":
-		err = h.service.UpdateCounter(mName, mValue)
+		err = h.service.UpdateCounter(ctx, mName, mValue)
+	case "set":
+		err = h.service.UpdateSet(ctx, mName, []string{mValue})
+	case "histogram":
+		http.Error(w, "Histogram updates must be sent as JSON", http.StatusBadRequest)
+		return
 	default:
 		http.Error(w, "Invalid type", http.StatusBadRequest)
 		return
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
@@ -49,39 +66,257 @@ func (h *MetricsHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
 
 func (h *MetricsHandler) HandleGetMetric(w http.ResponseWriter, r *http.Request) {
 	mType := chi.URLParam(r, "type")
-	mName := chi.URLParam(r, "name")
+	mName, err := queryKey(r, chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	if r.URL.Query().Has("at") {
+		v, ok := h.valueAt(w, r, mType, mName)
+		if !ok {
+			return
+		}
+		if mType == "counter" {
+			w.Write([]byte(strconv.FormatInt(v.Counter, 10)))
+		} else {
+			w.Write([]byte(strconv.FormatFloat(v.Value, 'f', -1, 64)))
+		}
+		return
+	}
+
+	ctx := r.Context()
 	switch mType {
 	case "gauge":
-		if value, ok := h.service.GetGauge(mName); ok {
-			w.Write([]byte(strconv.FormatFloat(value, 'f', -1, 64)))
+		value, err := h.service.GetGauge(ctx, mName)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		w.Write([]byte(strconv.FormatFloat(value, 'f', -1, 64)))
 	case "counter":
-		if value, ok := h.service.GetCounter(mName); ok {
-			w.Write([]byte(strconv.FormatInt(value, 10)))
+		value, err := h.service.GetCounter(ctx, mName)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Write([]byte(strconv.FormatInt(value, 10)))
+	case "histogram":
+		value, err := h.service.GetHistogram(ctx, mName)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		writeHistogram(w, r, value)
+	case "set":
+		value, err := h.service.GetSetCardinality(ctx, mName)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Write([]byte(strconv.FormatInt(value, 10)))
 	default:
 		http.Error(w, "Invalid type", http.StatusBadRequest)
+	}
+}
+
+// valueAt отвечает на запрос значения на момент из параметра at. Время
+// найденного значения передаётся в заголовке X-Sample-Time, а разрешение
+// уровня агрегации, если значение взято из него, — в X-Sample-Resolution.
+func (h *MetricsHandler) valueAt(w http.ResponseWriter, r *http.Request, mType, key string) (history.AsOf, bool) {
+	at, err := parseTime(r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, "Invalid at: "+err.Error(), http.StatusBadRequest)
+		return history.AsOf{}, false
+	}
+
+	v, err := h.service.GetValueAt(r.Context(), mType, key, at)
+	if err != nil {
+		writeError(w, err)
+		return history.AsOf{}, false
+	}
+
+	w.Header().Set("X-Sample-Time", v.Time.Format(time.RFC3339Nano))
+	if v.Resolution > 0 {
+		w.Header().Set("X-Sample-Resolution", v.Resolution.String())
+	}
+	return v, true
+}
+
+// writeHistogram отвечает квантилями из параметров q (по одному на строку)
+// либо, если они не заданы, самой гистограммой в JSON.
+func writeHistogram(w http.ResponseWriter, r *http.Request, hist models.Histogram) {
+	qs := r.URL.Query()["q"]
+	if len(qs) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hist)
+		return
+	}
+
+	var body strings.Builder
+	for _, raw := range qs {
+		q, err := strconv.ParseFloat(raw, 64)
+		if err != nil || q < 0 || q > 1 {
+			http.Error(w, "Invalid quantile: "+raw, http.StatusBadRequest)
+			return
+		}
+		if body.Len() > 0 {
+			body.WriteByte('\n')
+		}
+		body.WriteString(strconv.FormatFloat(hist.Quantile(q), 'f', -1, 64))
+	}
+	w.Write([]byte(body.String()))
+}
+
+func (h *MetricsHandler) HandleDeleteMetric(w http.ResponseWriter, r *http.Request) {
+	key, err := queryKey(r, chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	http.Error(w, "Metric not found", http.StatusNotFound)
+	err = h.service.DeleteMetric(r.Context(), chi.URLParam(r, "type"), key)
+	writeMutationError(w, err)
+}
+
+func (h *MetricsHandler) HandleDeleteMetricJSON(w http.ResponseWriter, r *http.Request) {
+	var metric models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	key, err := seriesKey(metric.ID, metric.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.DeleteMetric(r.Context(), metric.MType, key)
+	writeMutationError(w, err)
+}
+
+func (h *MetricsHandler) HandleResetCounter(w http.ResponseWriter, r *http.Request) {
+	key, err := queryKey(r, chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.service.ResetCounter(r.Context(), chi.URLParam(r, "type"), key)
+	writeMutationError(w, err)
+}
+
+func (h *MetricsHandler) HandleResetCounterJSON(w http.ResponseWriter, r *http.Request) {
+	var metric models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	key, err := seriesKey(metric.ID, metric.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.ResetCounter(r.Context(), metric.MType, key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var zero int64
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.Metrics{ID: metric.ID, MType: metric.MType, Delta: &zero, Labels: metric.Labels})
+}
+
+// writeMutationError отвечает кодом, соответствующим ошибке удаления или сброса.
+func writeMutationError(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeError отвечает кодом, соответствующим ошибке сервиса или хранилища:
+// 404 для отсутствующей метрики или момента вне истории, 400 для некорректных данных, 429 при
+// превышении ограничения на число метрик, 504, если хранилище не уложилось в срок запроса,
+// и 500 в остальных случаях.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Metric not found", http.StatusNotFound)
+	case errors.Is(err, history.ErrOutsideRetention):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrInvalidValue), errors.Is(err, storage.ErrInvalidUpdate):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrLimitExceeded):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, service.ErrTypeConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrNotPersisted):
+		// Изменение уже применено: код отличается от 500, чтобы клиент
+		// не повторял запрос
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (h *MetricsHandler) HandleGetAllMetricsJSON(w http.ResponseWriter, r *http.Request) {
-	gauges, counters := h.service.GetAllMetrics()
+	filter, err := labelsFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	all, err := h.service.GetAll(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(filter) > 0 {
+		all.Gauges = filterByLabels(all.Gauges, filter)
+		all.Counters = filterByLabels(all.Counters, filter)
+		all.Histograms = filterByLabels(all.Histograms, filter)
+		all.Sets = filterByLabels(all.Sets, filter)
+	}
+
+	// Series перечисляет ключи словарей с именем и метками каждого ряда
+	type Series struct {
+		Key    string            `json:"key"`
+		ID     string            `json:"id"`
+		MType  string            `json:"type"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}
 	type MetricsResponse struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
+		Gauges     map[string]float64          `json:"gauges"`
+		Counters   map[string]int64            `json:"counters"`
+		Histograms map[string]models.Histogram `json:"histograms,omitempty"`
+		Sets       map[string]int64            `json:"sets,omitempty"`
+		Series     []Series                    `json:"series"`
 	}
 
 	response := MetricsResponse{
-		Gauges:   gauges,
-		Counters: counters,
+		Gauges:     all.Gauges,
+		Counters:   all.Counters,
+		Histograms: all.Histograms,
+		Sets:       all.Sets,
+		Series:     make([]Series, 0),
+	}
+	addSeries := func(mType string, keys []string) {
+		for _, key := range keys {
+			name, labels := models.ParseSeriesKey(key)
+			response.Series = append(response.Series, Series{Key: key, ID: name, MType: mType, Labels: labels})
+		}
 	}
+	addSeries("gauge", slices.Sorted(maps.Keys(all.Gauges)))
+	addSeries("counter", slices.Sorted(maps.Keys(all.Counters)))
+	addSeries("histogram", slices.Sorted(maps.Keys(all.Histograms)))
+	addSeries("set", slices.Sorted(maps.Keys(all.Sets)))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -99,8 +334,14 @@ func (h *MetricsHandler) HandleUpdateJSON(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	key, err := seriesKey(metric.ID, metric.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
 	var response models.Metrics
-	var err error
 
 	switch metric.MType {
 	case "gauge":
@@ -108,40 +349,85 @@ func (h *MetricsHandler) HandleUpdateJSON(w http.ResponseWriter, r *http.Request
 			http.Error(w, "Value is required for gauge", http.StatusBadRequest)
 			return
 		}
-		err = h.service.UpdateGauge(metric.ID, strconv.FormatFloat(*metric.Value, 'f', -1, 64))
+		err = h.service.UpdateGauge(ctx, key, strconv.FormatFloat(*metric.Value, 'f', -1, 64))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-		val, ok := h.service.GetGauge(metric.ID)
-		if !ok {
+		val, err := h.service.GetGauge(ctx, key)
+		if err != nil {
 			http.Error(w, "Failed to retrieve updated gauge value", http.StatusInternalServerError)
 			return
 		}
 		response = models.Metrics{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Value: &val,
+			ID:     metric.ID,
+			MType:  metric.MType,
+			Value:  &val,
+			Labels: metric.Labels,
 		}
 	case "counter":
 		if metric.Delta == nil {
 			http.Error(w, "Delta is required for counter", http.StatusBadRequest)
 			return
 		}
-		err = h.service.UpdateCounter(metric.ID, strconv.FormatInt(*metric.Delta, 10))
+		err = h.service.UpdateCounter(ctx, key, strconv.FormatInt(*metric.Delta, 10))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-		val, ok := h.service.GetCounter(metric.ID)
-		if !ok {
+		val, err := h.service.GetCounter(ctx, key)
+		if err != nil {
 			http.Error(w, "Failed to retrieve updated counter value", http.StatusInternalServerError)
 			return
 		}
 		response = models.Metrics{
-			ID:    metric.ID,
-			MType: metric.MType,
-			Delta: &val,
+			ID:     metric.ID,
+			MType:  metric.MType,
+			Delta:  &val,
+			Labels: metric.Labels,
+		}
+	case "histogram":
+		if metric.Histogram == nil {
+			http.Error(w, "Histogram is required for histogram", http.StatusBadRequest)
+			return
+		}
+		err = h.service.UpdateHistogram(ctx, key, *metric.Histogram)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		val, err := h.service.GetHistogram(ctx, key)
+		if err != nil {
+			http.Error(w, "Failed to retrieve updated histogram", http.StatusInternalServerError)
+			return
+		}
+		response = models.Metrics{
+			ID:        metric.ID,
+			MType:     metric.MType,
+			Histogram: &val,
+			Labels:    metric.Labels,
+		}
+	case "set":
+		if len(metric.Members) == 0 && metric.Sketch == nil {
+			http.Error(w, "Members or sketch are required for set", http.StatusBadRequest)
+			return
+		}
+		// Скетч сливается только через пакетное обновление
+		err = h.service.UpdateBatch(ctx, []models.Metrics{metric})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		val, err := h.service.GetSetCardinality(ctx, key)
+		if err != nil {
+			http.Error(w, "Failed to retrieve updated set", http.StatusInternalServerError)
+			return
+		}
+		response = models.Metrics{
+			ID:     metric.ID,
+			MType:  metric.MType,
+			Delta:  &val,
+			Labels: metric.Labels,
 		}
 	default:
 		http.Error(w, "Invalid type", http.StatusBadRequest)
@@ -152,6 +438,74 @@ func (h *MetricsHandler) HandleUpdateJSON(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(response)
 }
 
+type batchItemError struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func (h *MetricsHandler) HandleUpdatesJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var metrics []models.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(metrics) == 0 {
+		http.Error(w, "Empty batch", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if err := h.service.UpdateBatch(ctx, metrics); err != nil {
+		var batchErr *storage.BatchError
+		if errors.As(err, &batchErr) {
+			items := make([]batchItemError, 0, len(batchErr.Items))
+			for _, item := range batchErr.Items {
+				items = append(items, batchItemError{Index: item.Index, ID: item.Name, Error: item.Err.Error()})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct {
+				Errors []batchItemError `json:"errors"`
+			}{Errors: items})
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	response := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		key := models.SeriesKey(m.ID, m.Labels)
+		switch m.MType {
+		case "gauge":
+			if val, err := h.service.GetGauge(ctx, key); err == nil {
+				response = append(response, models.Metrics{ID: m.ID, MType: m.MType, Value: &val, Labels: m.Labels})
+			}
+		case "counter":
+			if val, err := h.service.GetCounter(ctx, key); err == nil {
+				response = append(response, models.Metrics{ID: m.ID, MType: m.MType, Delta: &val, Labels: m.Labels})
+			}
+		case "histogram":
+			if val, err := h.service.GetHistogram(ctx, key); err == nil {
+				response = append(response, models.Metrics{ID: m.ID, MType: m.MType, Histogram: &val, Labels: m.Labels})
+			}
+		case "set":
+			if val, err := h.service.GetSetCardinality(ctx, key); err == nil {
+				response = append(response, models.Metrics{ID: m.ID, MType: m.MType, Delta: &val, Labels: m.Labels})
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (h *MetricsHandler) HandleGetMetricJSON(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -164,31 +518,63 @@ func (h *MetricsHandler) HandleGetMetricJSON(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	var response models.Metrics
+	key, err := seriesKey(metric.ID, metric.Labels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	response := models.Metrics{
+		ID:     metric.ID,
+		MType:  metric.MType,
+		Labels: metric.Labels,
+	}
+
+	if r.URL.Query().Has("at") {
+		v, ok := h.valueAt(w, r, metric.MType, key)
+		if !ok {
+			return
+		}
+		if metric.MType == "counter" {
+			response.Delta = &v.Counter
+		} else {
+			response.Value = &v.Value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
 	switch metric.MType {
 	case "gauge":
-		if value, ok := h.service.GetGauge(metric.ID); ok {
-			response = models.Metrics{
-				ID:    metric.ID,
-				MType: metric.MType,
-				Value: &value,
-			}
-		} else {
-			http.Error(w, "Metric not found", http.StatusNotFound)
+		value, err := h.service.GetGauge(ctx, key)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		response.Value = &value
 	case "counter":
-		if value, ok := h.service.GetCounter(metric.ID); ok {
-			response = models.Metrics{
-				ID:    metric.ID,
-				MType: metric.MType,
-				Delta: &value,
-			}
-		} else {
-			http.Error(w, "Metric not found", http.StatusNotFound)
+		value, err := h.service.GetCounter(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		response.Delta = &value
+	case "histogram":
+		value, err := h.service.GetHistogram(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		response.Histogram = &value
+	case "set":
+		value, err := h.service.GetSetCardinality(ctx, key)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
+		response.Delta = &value
 	default:
 		http.Error(w, "Invalid type", http.StatusBadRequest)
 		return
@@ -7,38 +7,103 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/yadmabramov/admAlerting/internal/hll"
 	"github.com/yadmabramov/admAlerting/internal/models"
 	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
 )
 
 type MockStorage struct {
-	lastGauge   float64
-	lastCounter int64
+	lastGauge     float64
+	lastCounter   int64
+	lastHistogram models.Histogram
 }
 
-func (m *MockStorage) UpdateGauge(name string, value float64) error {
+func (m *MockStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
 	m.lastGauge = value
 	return nil
 }
 
-func (m *MockStorage) UpdateCounter(name string, value int64) error {
+func (m *MockStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
 	m.lastCounter = value
 	return nil
 }
 
-func (m *MockStorage) GetAllMetrics() (map[string]float64, map[string]int64) {
+func (m *MockStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	m.lastHistogram = h
+	return nil
+}
+
+func (m *MockStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	return nil
+}
+
+func (m *MockStorage) UpdateBatch(ctx context.Context, updates []storage.MetricUpdate) error {
+	for _, u := range updates {
+		switch u.MType {
+		case storage.TypeGauge:
+			m.lastGauge = u.Value
+		case storage.TypeCounter:
+			m.lastCounter = u.Delta
+		}
+	}
+	return nil
+}
+
+func (m *MockStorage) ReplaceAll(ctx context.Context, updates []storage.MetricUpdate) error {
+	return m.UpdateBatch(ctx, updates)
+}
+
+func (m *MockStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	return &storage.NotFoundError{MType: mType, Name: name}
+}
+
+func (m *MockStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	return &storage.NotFoundError{MType: mType, Name: name}
+}
+
+func (m *MockStorage) ResetCounter(ctx context.Context, name string) error {
+	m.lastCounter = 0
+	return nil
+}
+
+func (m *MockStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	return nil, nil, nil
+}
+
+func (m *MockStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	return m.lastGauge, nil
+}
+
+func (m *MockStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	return m.lastCounter, nil
+}
+
+func (m *MockStorage) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	if m.lastHistogram.Bounds == nil {
+		return models.Histogram{}, &storage.NotFoundError{MType: storage.TypeHistogram, Name: name}
+	}
+	return m.lastHistogram, nil
+}
+
+func (m *MockStorage) GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error) {
 	return nil, nil
 }
 
-func (m *MockStorage) GetGauge(name string) (float64, bool) {
-	return m.lastGauge, true
+func (m *MockStorage) GetSet(ctx context.Context, name string) (*hll.Sketch, error) {
+	return nil, &storage.NotFoundError{MType: storage.TypeSet, Name: name}
 }
 
-func (m *MockStorage) GetCounter(name string) (int64, bool) {
-	return m.lastCounter, true
+func (m *MockStorage) GetAllSets(ctx context.Context) (map[string]*hll.Sketch, error) {
+	return nil, nil
+}
+
+func (m *MockStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	return models.Snapshot{}, nil
 }
 
 func TestMetricsHandler(t *testing.T) {
@@ -201,6 +266,114 @@ func TestMetricsHandlerJSON(t *testing.T) {
 	})
 }
 
+func TestMetricsHandlerHistogram(t *testing.T) {
+	t.Run("Missing metric", func(t *testing.T) {
+		handler := NewMetricsHandler(service.NewMetricsService(&MockStorage{}))
+		body, _ := json.Marshal(models.Metrics{ID: "Latency", MType: "histogram"})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/value/", bytes.NewBuffer(body))
+
+		handler.HandleGetMetricJSON(w, r)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Update histogram via JSON", func(t *testing.T) {
+		handler := NewMetricsHandler(service.NewMetricsService(&MockStorage{}))
+		histogram := models.Histogram{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 2, 0}}
+		body, _ := json.Marshal(models.Metrics{ID: "Latency", MType: "histogram", Histogram: &histogram})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/update/", bytes.NewBuffer(body))
+
+		handler.HandleUpdateJSON(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response models.Metrics
+		err := json.NewDecoder(w.Body).Decode(&response)
+		assert.NoError(t, err)
+		if assert.NotNil(t, response.Histogram) {
+			assert.Equal(t, histogram.Counts, response.Histogram.Counts)
+		}
+	})
+}
+
+func TestMetricsHandlerBatch(t *testing.T) {
+	mockStorage := &MockStorage{}
+	service := service.NewMetricsService(mockStorage)
+	handler := NewMetricsHandler(service)
+
+	t.Run("Valid batch", func(t *testing.T) {
+		body, _ := json.Marshal([]models.Metrics{
+			{ID: "Alloc", MType: "gauge", Value: ptrFloat64(1.5)},
+			{ID: "PollCount", MType: "counter", Delta: ptrInt64(3)},
+		})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/updates/", bytes.NewBuffer(body))
+
+		handler.HandleUpdatesJSON(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 1.5, mockStorage.lastGauge)
+		assert.Equal(t, int64(3), mockStorage.lastCounter)
+
+		var response []models.Metrics
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Len(t, response, 2)
+	})
+
+	t.Run("Invalid items reject whole batch", func(t *testing.T) {
+		mockStorage.lastGauge = 0
+		body, _ := json.Marshal([]models.Metrics{
+			{ID: "Alloc", MType: "gauge", Value: ptrFloat64(2.5)},
+			{ID: "PollCount", MType: "counter"},
+			{ID: "Bad", MType: "unknown"},
+		})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/updates/", bytes.NewBuffer(body))
+
+		handler.HandleUpdatesJSON(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, 0.0, mockStorage.lastGauge)
+
+		var response struct {
+			Errors []struct {
+				Index int    `json:"index"`
+				ID    string `json:"id"`
+			} `json:"errors"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		assert.Len(t, response.Errors, 2)
+		assert.Equal(t, 1, response.Errors[0].Index)
+		assert.Equal(t, "Bad", response.Errors[1].ID)
+	})
+}
+
+// slowStorage отвечает только после отмены контекста запроса.
+type slowStorage struct {
+	MockStorage
+}
+
+func (s *slowStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestMetricsHandlerContext(t *testing.T) {
+	handler := NewMetricsHandler(service.NewMetricsService(&slowStorage{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	body, _ := json.Marshal(models.Metrics{ID: "Alloc", MType: "gauge"})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/value/", bytes.NewBuffer(body)).WithContext(ctx)
+
+	handler.HandleGetMetricJSON(w, r)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
+
 func ptrFloat64(f float64) *float64 {
 	return &f
 }
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+// HandleExportSnapshot отдаёт все метрики одним снимком, пригодным для
+// HandleImportSnapshot на другом сервере.
+func (h *MetricsHandler) HandleExportSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := h.service.ExportSnapshot(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// HandleImportSnapshot применяет снимок. Режим задаётся обязательным
+// параметром mode: replace заменяет содержимое хранилища (counter получает
+// значение из снимка), merge прибавляет снимок к текущим данным.
+func (h *MetricsHandler) HandleImportSnapshot(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		http.Error(w, "mode is required (replace or merge)", http.StatusBadRequest)
+		return
+	}
+
+	var snap models.Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	writeMutationError(w, h.service.ImportSnapshot(r.Context(), snap, mode))
+}
@@ -1,9 +1,13 @@
 package handlers
 
 import (
+	"html"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
 )
 
 const htmlTemplate = `<!DOCTYPE html>
@@ -14,7 +18,7 @@ const htmlTemplate = `<!DOCTYPE html>
 <body>
     <h1>Metrics</h1>
     <table>
-        <tr><th>Type</th><th>Name</th><th>Value</th></tr>
+        <tr><th>Type</th><th>Name</th><th>Labels</th><th>Value</th></tr>
         {{METRICS_ROWS}}
     </table>
     <style>
@@ -26,22 +30,62 @@ const htmlTemplate = `<!DOCTYPE html>
 </html>`
 
 func (h *MetricsHandler) HandleIndex(w http.ResponseWriter, r *http.Request) {
-	gauges, counters := h.service.GetAllMetrics()
+	filter, err := labelsFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all, err := h.service.GetAll(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(filter) > 0 {
+		all.Gauges = filterByLabels(all.Gauges, filter)
+		all.Counters = filterByLabels(all.Counters, filter)
+		all.Histograms = filterByLabels(all.Histograms, filter)
+		all.Sets = filterByLabels(all.Sets, filter)
+	}
 
 	var rows strings.Builder
 
 	// Добавляем gauge метрики
-	for name, value := range gauges {
-		rows.WriteString("<tr><td>gauge</td><td>" + name + "</td><td>" + strconv.FormatFloat(value, 'f', 2, 64) + "</td></tr>")
+	for key, value := range all.Gauges {
+		rows.WriteString("<tr><td>gauge</td>" + nameCells(key) + "<td>" + strconv.FormatFloat(value, 'f', 2, 64) + "</td></tr>")
 	}
 
 	// Добавляем counter метрики
-	for name, value := range counters {
-		rows.WriteString("<tr><td>counter</td><td>" + name + "</td><td>" + strconv.FormatInt(value, 10) + "</td></tr>")
+	for key, value := range all.Counters {
+		rows.WriteString("<tr><td>counter</td>" + nameCells(key) + "<td>" + strconv.FormatInt(value, 10) + "</td></tr>")
+	}
+
+	// Для гистограмм выводим число наблюдений и сумму
+	for key, value := range all.Histograms {
+		summary := "count=" + strconv.FormatUint(value.Count, 10) + " sum=" + strconv.FormatFloat(value.Sum, 'f', 2, 64)
+		rows.WriteString("<tr><td>histogram</td>" + nameCells(key) + "<td>" + summary + "</td></tr>")
+	}
+
+	// Для множеств — оценка числа уникальных значений
+	for key, value := range all.Sets {
+		rows.WriteString("<tr><td>set</td>" + nameCells(key) + "<td>~" + strconv.FormatInt(value, 10) + "</td></tr>")
 	}
 
 	w.Header().Set("Content-Type", "text/html")
 
-	html := strings.Replace(htmlTemplate, "{{METRICS_ROWS}}", rows.String(), 1)
-	w.Write([]byte(html))
+	page := strings.Replace(htmlTemplate, "{{METRICS_ROWS}}", rows.String(), 1)
+	w.Write([]byte(page))
+}
+
+// nameCells возвращает ячейки с именем метрики и её метками.
+func nameCells(key string) string {
+	name, labels := models.ParseSeriesKey(key)
+
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+
+	return "<td>" + html.EscapeString(name) + "</td><td>" + html.EscapeString(strings.Join(pairs, ", ")) + "</td>"
 }
@@ -0,0 +1,330 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultMaxSamples = 1000
+
+var (
+	ErrNotFound = errors.New("metric has no history")
+	// ErrOutsideRetention — история метрики есть, но не доходит до
+	// запрошенного момента
+	ErrOutsideRetention = errors.New("time is outside history retention")
+)
+
+type Config struct {
+	// Сэмплы старше Retention отбрасываются
+	Retention time.Duration
+	// Максимальное число сэмплов на метрику, по умолчанию defaultMaxSamples
+	MaxSamples int
+	// Уровни агрегации; исходные сэмплы дополнительно сворачиваются в каждый
+	Tiers []TierConfig
+}
+
+// Sample — значение метрики: Value для gauge, Counter для counter. Counter
+// хранится целым, чтобы не терять точность выше 2^53.
+type Sample struct {
+	Time    time.Time
+	Value   float64
+	Counter int64
+}
+
+// Point — точка ряда. У gauge заполняются Value, Min, Max и Avg, у
+// counter — Counter и Increase; в JSON значение counter выводится в "v".
+type Point struct {
+	Time     time.Time
+	Value    float64
+	Counter  *int64
+	Min      *float64
+	Max      *float64
+	Avg      *float64
+	Increase *int64
+}
+
+type pointJSON struct {
+	Time     time.Time `json:"t"`
+	Value    any       `json:"v"`
+	Min      *float64  `json:"min,omitempty"`
+	Max      *float64  `json:"max,omitempty"`
+	Avg      *float64  `json:"avg,omitempty"`
+	Increase *int64    `json:"increase,omitempty"`
+}
+
+func (p Point) MarshalJSON() ([]byte, error) {
+	out := pointJSON{Time: p.Time, Value: p.Value, Min: p.Min, Max: p.Max, Avg: p.Avg, Increase: p.Increase}
+	if p.Counter != nil {
+		out.Value = *p.Counter
+	}
+	return json.Marshal(out)
+}
+
+// Series — результат запроса диапазона. Resolution равна нулю, если ряд
+// построен по исходным сэмплам.
+type Series struct {
+	Resolution time.Duration
+	Points     []Point
+}
+
+// AsOf — значение метрики на заданный момент: Value для gauge, Counter для
+// counter. Resolution равна нулю, если значение взято из исходных сэмплов;
+// иначе оно взято из уровня агрегации, а Time — начало корзины, в которой
+// оно было записано.
+type AsOf struct {
+	Time       time.Time
+	Value      float64
+	Counter    int64
+	Resolution time.Duration
+}
+
+type seriesKey struct {
+	mType string
+	name  string
+}
+
+// Число частей, между которыми распределяются ряды: запись разных метрик
+// не ждёт одной блокировки
+const historyShards = 64
+
+// History хранит последние значения каждой метрики в кольцевых буферах
+// и их агрегаты по уровням. Для counter сохраняется накопленное значение.
+type History struct {
+	config Config
+	tiers  []TierConfig
+	now    func() time.Time
+
+	shards [historyShards]historyShard
+}
+
+type historyShard struct {
+	mu     sync.RWMutex
+	series map[seriesKey]*series
+}
+
+// series — история одной метрики: исходные сэмплы и корзины каждого уровня.
+type series struct {
+	samples *ring[Sample]
+	buckets []*ring[Bucket]
+	// Последнее значение counter, от которого считается прирост
+	last int64
+	seen bool
+}
+
+func New(config Config) *History {
+	h := &History{
+		config: config,
+		tiers:  append([]TierConfig(nil), config.Tiers...),
+		now:    time.Now,
+	}
+	sort.Slice(h.tiers, func(i, j int) bool { return h.tiers[i].Resolution < h.tiers[j].Resolution })
+	for i := range h.shards {
+		h.shards[i].series = make(map[seriesKey]*series)
+	}
+	return h
+}
+
+func (h *History) shardFor(key seriesKey) *historyShard {
+	f := fnv.New32a()
+	f.Write([]byte(key.name))
+	return &h.shards[f.Sum32()%historyShards]
+}
+
+// lookup возвращает ряд метрики под блокировкой её части на чтение.
+func (h *History) lookup(key seriesKey) (*series, func()) {
+	sh := h.shardFor(key)
+	sh.mu.RLock()
+	return sh.series[key], sh.mu.RUnlock
+}
+
+// RecordGauge записывает значение gauge.
+func (h *History) RecordGauge(name string, value float64) {
+	h.record("gauge", name, func(s *series, now time.Time) (Sample, int64) {
+		return Sample{Time: now, Value: value}, 0
+	})
+}
+
+// RecordCounter записывает накопленное значение counter; прирост к
+// предыдущему значению попадает в корзины уровней.
+func (h *History) RecordCounter(name string, value int64) {
+	h.record("counter", name, func(s *series, now time.Time) (Sample, int64) {
+		var increase int64
+		switch {
+		case !s.seen:
+		case value < s.last:
+			// Счётчик был сброшен
+			increase = value
+		default:
+			increase = value - s.last
+		}
+		s.last, s.seen = value, true
+		return Sample{Time: now, Counter: value}, increase
+	})
+}
+
+func (h *History) record(mType, name string, sample func(s *series, now time.Time) (Sample, int64)) {
+	key := seriesKey{mType: mType, name: name}
+	sh := h.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	s, ok := sh.series[key]
+	if !ok {
+		s = &series{samples: newRing[Sample](h.config.MaxSamples)}
+		for _, tc := range h.tiers {
+			s.buckets = append(s.buckets, newTierRing(tc))
+		}
+		sh.series[key] = s
+	}
+
+	now := h.now()
+	v, increase := sample(s, now)
+	s.samples.push(v)
+	if h.config.Retention > 0 {
+		s.samples.trimBefore(now.Add(-h.config.Retention))
+	}
+
+	for i, tc := range h.tiers {
+		recordBucket(s.buckets[i], tc, v, increase)
+	}
+}
+
+// Forget удаляет историю метрики на всех уровнях.
+func (h *History) Forget(mType, name string) {
+	key := seriesKey{mType: mType, name: name}
+	sh := h.shardFor(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.series, key)
+}
+
+// Clear удаляет историю всех метрик.
+func (h *History) Clear() {
+	for i := range h.shards {
+		sh := &h.shards[i]
+		sh.mu.Lock()
+		sh.series = make(map[seriesKey]*series)
+		sh.mu.Unlock()
+	}
+}
+
+// Range возвращает ряд, выровненный по шагу step, из самого грубого уровня,
+// разрешение которого не превышает step. Если хранение этого уровня не
+// доходит до start, берётся следующий, более грубый уровень; если start не
+// покрывает ни один уровень, возвращается ErrOutsideRetention. Для исходных
+// сэмплов в каждой точке start, start+step, ..., end берётся последнее
+// значение, записанное не позже этой точки; точки, для которых значений ещё
+// нет, пропускаются.
+func (h *History) Range(mType, name string, start, end time.Time, step time.Duration) (Series, error) {
+	key := seriesKey{mType: mType, name: name}
+	s, unlock := h.lookup(key)
+	defer unlock()
+	if s == nil {
+		return Series{}, ErrNotFound
+	}
+
+	// Уровень -1 — исходные сэмплы
+	level := -1
+	for i := len(h.tiers) - 1; i >= 0; i-- {
+		if h.tiers[i].Resolution <= step {
+			level = i
+			break
+		}
+	}
+
+	now := h.now()
+	if level < 0 {
+		if !start.Before(h.samplesSince(s)) {
+			return Series{Points: samplePoints(s.samples.items(h.oldest()), mType, start, end, step)}, nil
+		}
+		level = 0
+	}
+	for ; level < len(h.tiers); level++ {
+		tc := h.tiers[level]
+		since := now.Add(-tc.Retention)
+		if start.Before(since) {
+			continue
+		}
+		return Series{
+			Resolution: tc.Resolution,
+			Points:     bucketPoints(s.buckets[level].items(since), mType, start, end, step),
+		}, nil
+	}
+	return Series{}, fmt.Errorf("%w: %s %q history starts after %s",
+		ErrOutsideRetention, mType, name, start.Format(time.RFC3339))
+}
+
+// samplesSince возвращает момент, с которого исходные сэмплы ряда полны:
+// границу Retention или, если буфер заполнен, время самого старого сэмпла.
+func (h *History) samplesSince(s *series) time.Time {
+	since := h.oldest()
+	if s.samples.full() {
+		if first := s.samples.first(); first != nil && first.Time.After(since) {
+			since = first.Time
+		}
+	}
+	return since
+}
+
+// samplePoints выбирает для каждой точки последний сэмпл не позже неё.
+func samplePoints(samples []Sample, mType string, start, end time.Time, step time.Duration) []Point {
+	points := make([]Point, 0)
+
+	i := 0
+	var last *Sample
+	for t := start; !t.After(end); t = t.Add(step) {
+		for i < len(samples) && !samples[i].Time.After(t) {
+			last = &samples[i]
+			i++
+		}
+		if last == nil {
+			continue
+		}
+		if mType == "counter" {
+			points = append(points, Point{Time: t, Counter: ptr(last.Counter)})
+		} else {
+			points = append(points, Point{Time: t, Value: last.Value})
+		}
+	}
+
+	return points
+}
+
+// At возвращает последнее значение, записанное не позже at. Если исходные
+// сэмплы к этому моменту уже вытеснены, берётся значение из последней
+// корзины самого подробного уровня, завершившейся не позже at.
+func (h *History) At(mType, name string, at time.Time) (AsOf, error) {
+	key := seriesKey{mType: mType, name: name}
+	s, unlock := h.lookup(key)
+	defer unlock()
+	if s == nil {
+		return AsOf{}, ErrNotFound
+	}
+
+	samples := s.samples.items(h.oldest())
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(at) })
+	if i > 0 {
+		return AsOf{Time: samples[i-1].Time, Value: samples[i-1].Value, Counter: samples[i-1].Counter}, nil
+	}
+
+	now := h.now()
+	for i, tc := range h.tiers {
+		if b, ok := bucketBefore(s.buckets[i].items(now.Add(-tc.Retention)), tc.Resolution, at); ok {
+			return AsOf{Time: b.Start, Value: b.Last, Counter: b.Counter, Resolution: tc.Resolution}, nil
+		}
+	}
+	return AsOf{}, fmt.Errorf("%w: no %s %q values at or before %s",
+		ErrOutsideRetention, mType, name, at.Format(time.RFC3339))
+}
+
+func (h *History) oldest() time.Time {
+	if h.config.Retention <= 0 {
+		return time.Time{}
+	}
+	return h.now().Add(-h.config.Retention)
+}
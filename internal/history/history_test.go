@@ -0,0 +1,287 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+func newTestHistory(config Config, clock *time.Time) *History {
+	h := New(config)
+	h.now = func() time.Time { return *clock }
+	return h
+}
+
+func TestHistoryRange(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	clock := base
+	h := newTestHistory(Config{Retention: time.Hour, MaxSamples: 100}, &clock)
+
+	for i := 0; i < 5; i++ {
+		clock = base.Add(time.Duration(i) * 2 * time.Second)
+		h.RecordGauge("HeapAlloc", float64(i))
+	}
+
+	series, err := h.Range("gauge", "HeapAlloc", base.Add(-time.Second), base.Add(8*time.Second), 3*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, []Point{
+		{Time: base.Add(2 * time.Second), Value: 1},
+		{Time: base.Add(5 * time.Second), Value: 2},
+		{Time: base.Add(8 * time.Second), Value: 4},
+	}, series.Points)
+
+	_, err = h.Range("counter", "HeapAlloc", base, base, time.Second)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	clock := base
+
+	t.Run("by sample count", func(t *testing.T) {
+		h := newTestHistory(Config{MaxSamples: 3}, &clock)
+		for i := 0; i < 5; i++ {
+			clock = base.Add(time.Duration(i) * time.Second)
+			h.RecordCounter("PollCount", int64(i))
+		}
+
+		series, err := h.Range("counter", "PollCount", base.Add(2*time.Second), base.Add(4*time.Second), time.Second)
+		require.NoError(t, err)
+		require.Len(t, series.Points, 3)
+		assert.Equal(t, int64(2), *series.Points[0].Counter)
+
+		// Ранние сэмплы вытеснены, а уровней агрегации нет
+		_, err = h.Range("counter", "PollCount", base, base.Add(4*time.Second), time.Second)
+		assert.ErrorIs(t, err, ErrOutsideRetention)
+	})
+
+	t.Run("by duration", func(t *testing.T) {
+		h := newTestHistory(Config{Retention: 10 * time.Second}, &clock)
+		clock = base
+		h.RecordGauge("Alloc", 1)
+		clock = base.Add(time.Minute)
+		h.RecordGauge("Alloc", 2)
+
+		series, err := h.Range("gauge", "Alloc", clock.Add(-10*time.Second), clock, 5*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, []Point{{Time: clock, Value: 2}}, series.Points)
+
+		_, err = h.Range("gauge", "Alloc", base, clock, 30*time.Second)
+		assert.ErrorIs(t, err, ErrOutsideRetention)
+	})
+}
+
+func TestHistoryTiers(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	clock := base
+	h := newTestHistory(Config{
+		MaxSamples: 10,
+		Tiers: []TierConfig{
+			{Resolution: time.Minute, Retention: time.Hour},
+			{Resolution: 10 * time.Minute, Retention: 24 * time.Hour},
+		},
+	}, &clock)
+
+	// Два часа сэмплов раз в 30 секунд: gauge растёт, counter прибавляет по 2
+	for i := 0; i < 240; i++ {
+		clock = base.Add(time.Duration(i) * 30 * time.Second)
+		h.RecordGauge("HeapAlloc", float64(i))
+		h.RecordCounter("PollCount", int64(2*i))
+	}
+
+	t.Run("coarsest tier for step", func(t *testing.T) {
+		series, err := h.Range("gauge", "HeapAlloc", base.Add(10*time.Minute), base.Add(20*time.Minute), 10*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 10*time.Minute, series.Resolution)
+		require.Len(t, series.Points, 2)
+
+		p := series.Points[1]
+		assert.Equal(t, 20.0, *p.Min)
+		assert.Equal(t, 39.0, *p.Max)
+		assert.Equal(t, 29.5, *p.Avg)
+		assert.Equal(t, 39.0, p.Value)
+	})
+
+	t.Run("counter increase", func(t *testing.T) {
+		series, err := h.Range("counter", "PollCount", base.Add(90*time.Minute), base.Add(100*time.Minute), 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, series.Resolution)
+		require.Len(t, series.Points, 3)
+		assert.Equal(t, int64(20), *series.Points[1].Increase)
+	})
+
+	t.Run("raw samples for fine step", func(t *testing.T) {
+		series, err := h.Range("gauge", "HeapAlloc", clock.Add(-time.Minute), clock, 30*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), series.Resolution)
+		assert.Len(t, series.Points, 3)
+	})
+
+	t.Run("coarser tier covering start", func(t *testing.T) {
+		// Минутный уровень хранит только последний час
+		series, err := h.Range("gauge", "HeapAlloc", base.Add(30*time.Minute), base.Add(40*time.Minute), time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 10*time.Minute, series.Resolution)
+		require.Len(t, series.Points, 1)
+		assert.Equal(t, Point{Time: base.Add(31 * time.Minute), Value: 79, Min: ptr(60.0), Max: ptr(79.0), Avg: ptr(69.5)}, series.Points[0])
+
+		// Исходные сэмплы вытеснены, но минутный уровень ещё хранит начало
+		series, err = h.Range("gauge", "HeapAlloc", clock.Add(-30*time.Minute), clock, 30*time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, series.Resolution)
+	})
+
+	t.Run("outside retention", func(t *testing.T) {
+		_, err := h.Range("gauge", "HeapAlloc", base.Add(-24*time.Hour), clock, time.Hour)
+		assert.ErrorIs(t, err, ErrOutsideRetention)
+	})
+}
+
+func TestHistoryCounterPrecision(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	clock := base
+	h := newTestHistory(Config{
+		MaxSamples: 10,
+		Tiers:      []TierConfig{{Resolution: time.Minute, Retention: time.Hour}},
+	}, &clock)
+
+	// Выше 2^53 соседние целые не различимы во float64
+	const big = int64(1)<<53 + 1
+	h.RecordCounter("Bytes", big)
+	clock = base.Add(time.Second)
+	h.RecordCounter("Bytes", big+2)
+
+	series, err := h.Range("counter", "Bytes", base, clock, time.Second)
+	require.NoError(t, err)
+	require.Len(t, series.Points, 2)
+	assert.Equal(t, big+2, *series.Points[1].Counter)
+
+	data, err := json.Marshal(series.Points[1])
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"v":9007199254740995`)
+
+	series, err = h.Range("counter", "Bytes", base, base.Add(time.Minute), time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series.Points, 1)
+	assert.Equal(t, big+2, *series.Points[0].Counter)
+	assert.Equal(t, int64(2), *series.Points[0].Increase)
+
+	at, err := h.At("counter", "Bytes", clock)
+	require.NoError(t, err)
+	assert.Equal(t, big+2, at.Counter)
+}
+
+func TestHistoryAt(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	clock := base
+	h := newTestHistory(Config{
+		MaxSamples: 10,
+		Tiers:      []TierConfig{{Resolution: time.Minute, Retention: time.Hour}},
+	}, &clock)
+
+	// Сэмпл раз в 30 секунд в течение 20 минут
+	for i := 0; i < 40; i++ {
+		clock = base.Add(time.Duration(i) * 30 * time.Second)
+		h.RecordGauge("HeapInuse", float64(i))
+	}
+
+	t.Run("raw sample at or before", func(t *testing.T) {
+		v, err := h.At("gauge", "HeapInuse", base.Add(19*time.Minute+45*time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, AsOf{Time: base.Add(19*time.Minute + 30*time.Second), Value: 39}, v)
+
+		v, err = h.At("gauge", "HeapInuse", base.Add(19*time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, 38.0, v.Value)
+	})
+
+	t.Run("tier after raw samples are evicted", func(t *testing.T) {
+		// Корзина 03:03 ещё не завершилась к 03:03:45, берётся корзина 03:02
+		v, err := h.At("gauge", "HeapInuse", base.Add(3*time.Minute+45*time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, AsOf{Time: base.Add(2 * time.Minute), Value: 5, Resolution: time.Minute}, v)
+	})
+
+	t.Run("outside retention", func(t *testing.T) {
+		_, err := h.At("gauge", "HeapInuse", base.Add(30*time.Second))
+		assert.ErrorIs(t, err, ErrOutsideRetention)
+
+		clock = base.Add(3 * time.Hour)
+		_, err = h.At("gauge", "HeapInuse", base.Add(10*time.Minute))
+		assert.ErrorIs(t, err, ErrOutsideRetention)
+	})
+
+	_, err := h.At("counter", "HeapInuse", base)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRingGrowsLazily(t *testing.T) {
+	base := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	r := newRing[Sample](20)
+	assert.Empty(t, r.buf)
+
+	for i := 0; i < 10; i++ {
+		r.push(Sample{Time: base.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+	assert.Len(t, r.buf, 16)
+	r.trimBefore(base.Add(5 * time.Second))
+	for i := 10; i < 25; i++ {
+		r.push(Sample{Time: base.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+	assert.Len(t, r.buf, 20)
+
+	items := r.items(time.Time{})
+	require.Len(t, items, 20)
+	assert.Equal(t, 5.0, items[0].Value)
+	assert.Equal(t, 24.0, items[19].Value)
+}
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers("1m:24h, 1h:720h")
+	require.NoError(t, err)
+	assert.Equal(t, []TierConfig{
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 720 * time.Hour},
+	}, tiers)
+
+	_, err = ParseTiers("1m")
+	assert.Error(t, err)
+}
+
+func TestObserve(t *testing.T) {
+	ctx := context.Background()
+	clock := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	h := newTestHistory(Config{MaxSamples: 10}, &clock)
+	mem := storage.NewMemoryStorage()
+	mem.Observe(h.Observe)
+
+	require.NoError(t, mem.UpdateCounter(ctx, "PollCount", 2))
+	require.NoError(t, mem.UpdateBatch(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 3},
+		{MType: storage.TypeGauge, Name: "Alloc", Value: 1.5},
+	}))
+	at, err := h.At(storage.TypeCounter, "PollCount", clock)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), at.Counter)
+
+	require.NoError(t, mem.ResetCounter(ctx, "PollCount"))
+	at, err = h.At(storage.TypeCounter, "PollCount", clock)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), at.Counter)
+
+	require.NoError(t, mem.DeleteMetric(ctx, storage.TypeGauge, "Alloc"))
+	_, err = h.At(storage.TypeGauge, "Alloc", clock)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, mem.ReplaceAll(ctx, []storage.MetricUpdate{{MType: storage.TypeGauge, Name: "Load", Value: 7}}))
+	_, err = h.At(storage.TypeCounter, "PollCount", clock)
+	assert.ErrorIs(t, err, ErrNotFound)
+	at, err = h.At(storage.TypeGauge, "Load", clock)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, at.Value)
+}
@@ -0,0 +1,97 @@
+package history
+
+import (
+	"time"
+)
+
+type timed interface {
+	at() time.Time
+}
+
+func (s Sample) at() time.Time { return s.Time }
+
+func (b Bucket) at() time.Time { return b.Start }
+
+// Начальный размер буфера кольца
+const ringMinGrow = 8
+
+// ring — кольцевой буфер элементов, упорядоченных по времени. Буфер
+// растёт по мере заполнения до capacity элементов.
+type ring[T timed] struct {
+	buf      []T
+	start    int
+	size     int
+	capacity int
+}
+
+func newRing[T timed](capacity int) *ring[T] {
+	if capacity <= 0 {
+		capacity = defaultMaxSamples
+	}
+	return &ring[T]{capacity: capacity}
+}
+
+func (r *ring[T]) push(v T) {
+	if r.size == len(r.buf) && len(r.buf) < r.capacity {
+		r.grow()
+	}
+	if r.size < len(r.buf) {
+		r.buf[(r.start+r.size)%len(r.buf)] = v
+		r.size++
+		return
+	}
+	r.buf[r.start] = v
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// grow увеличивает буфер вдвое, но не больше capacity, сохраняя порядок
+// элементов.
+func (r *ring[T]) grow() {
+	buf := make([]T, min(max(2*len(r.buf), ringMinGrow), r.capacity))
+	for i := 0; i < r.size; i++ {
+		buf[i] = r.buf[(r.start+i)%len(r.buf)]
+	}
+	r.buf = buf
+	r.start = 0
+}
+
+// full сообщает, что следующий элемент вытеснит самый старый.
+func (r *ring[T]) full() bool {
+	return r.size == r.capacity
+}
+
+// first возвращает самый старый элемент.
+func (r *ring[T]) first() *T {
+	if r.size == 0 {
+		return nil
+	}
+	return &r.buf[r.start]
+}
+
+// last возвращает указатель на последний элемент для обновления на месте.
+func (r *ring[T]) last() *T {
+	if r.size == 0 {
+		return nil
+	}
+	return &r.buf[(r.start+r.size-1)%len(r.buf)]
+}
+
+func (r *ring[T]) trimBefore(t time.Time) {
+	for r.size > 0 && r.buf[r.start].at().Before(t) {
+		r.start = (r.start + 1) % len(r.buf)
+		r.size--
+	}
+}
+
+// items возвращает копию элементов не старше since.
+func (r *ring[T]) items(since time.Time) []T {
+	out := make([]T, 0, r.size)
+	for i := 0; i < r.size; i++ {
+		v := r.buf[(r.start+i)%len(r.buf)]
+		if v.at().Before(since) {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
@@ -0,0 +1,30 @@
+package history
+
+import (
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// Observe записывает в историю изменения хранилища; подключается через
+// storage.MemoryStorage.Observe. Изменения приходят под блокировками
+// шардов, поэтому значения одной метрики записываются в порядке
+// применения, а для counter — сумма, получившаяся именно после изменения.
+func (h *History) Observe(changes []storage.Change) {
+	for _, c := range changes {
+		switch c.Op {
+		case storage.OpReplace:
+			// Прежние ряды относятся к данным, которых больше нет в хранилище
+			h.Clear()
+		case storage.OpDelete:
+			h.Forget(c.Update.MType, c.Update.Name)
+		case storage.OpReset:
+			h.RecordCounter(c.Update.Name, 0)
+		case storage.OpUpdate:
+			switch c.Update.MType {
+			case storage.TypeGauge:
+				h.RecordGauge(c.Update.Name, c.Update.Value)
+			case storage.TypeCounter:
+				h.RecordCounter(c.Update.Name, c.Counter)
+			}
+		}
+	}
+}
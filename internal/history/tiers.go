@@ -0,0 +1,159 @@
+package history
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TierConfig описывает уровень агрегации: сэмплы сворачиваются в корзины
+// длиной Resolution, корзины хранятся Retention.
+type TierConfig struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+func DefaultTiers() []TierConfig {
+	return []TierConfig{
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Resolution: 10 * time.Minute, Retention: 7 * 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 30 * 24 * time.Hour},
+	}
+}
+
+// ParseTiers разбирает строку вида "1m:24h,10m:168h,1h:720h".
+func ParseTiers(value string) ([]TierConfig, error) {
+	var tiers []TierConfig
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		resolution, retention, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid tier %q: expected <resolution>:<retention>", part)
+		}
+
+		var tier TierConfig
+		var err error
+		if tier.Resolution, err = time.ParseDuration(resolution); err != nil || tier.Resolution <= 0 {
+			return nil, fmt.Errorf("invalid tier resolution %q", resolution)
+		}
+		if tier.Retention, err = time.ParseDuration(retention); err != nil || tier.Retention < tier.Resolution {
+			return nil, fmt.Errorf("invalid tier retention %q", retention)
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+// Bucket — агрегат сэмплов за интервал [Start, Start+Resolution).
+// Для gauge заполняются Min/Max/Sum/Last, для counter — последнее значение
+// Counter и прирост Increase.
+type Bucket struct {
+	Start    time.Time
+	Min      float64
+	Max      float64
+	Sum      float64
+	Count    int
+	Last     float64
+	Counter  int64
+	Increase int64
+}
+
+func (b *Bucket) add(s Sample, increase int64) {
+	if b.Count == 0 {
+		b.Min, b.Max = s.Value, s.Value
+	} else {
+		b.Min = math.Min(b.Min, s.Value)
+		b.Max = math.Max(b.Max, s.Value)
+	}
+	b.Sum += s.Value
+	b.Count++
+	b.Last = s.Value
+	b.Counter = s.Counter
+	b.Increase += increase
+}
+
+func newTierRing(tc TierConfig) *ring[Bucket] {
+	return newRing[Bucket](int(tc.Retention/tc.Resolution) + 1)
+}
+
+// recordBucket добавляет сэмпл в корзину уровня tc, в которую он попадает.
+func recordBucket(r *ring[Bucket], tc TierConfig, s Sample, increase int64) {
+	start := s.Time.Truncate(tc.Resolution)
+	if last := r.last(); last != nil && last.Start.Equal(start) {
+		last.add(s, increase)
+	} else {
+		b := Bucket{Start: start}
+		b.add(s, increase)
+		r.push(b)
+	}
+	r.trimBefore(s.Time.Add(-tc.Retention))
+}
+
+// bucketPoints сворачивает корзины в точки start, start+step, ..., end: в
+// точку t попадают корзины, начавшиеся в интервале [t-step, t). Точки без
+// корзин пропускаются.
+func bucketPoints(buckets []Bucket, mType string, start, end time.Time, step time.Duration) []Point {
+	points := make([]Point, 0)
+
+	i := 0
+	for ts := start; !ts.After(end); ts = ts.Add(step) {
+		for i < len(buckets) && buckets[i].Start.Before(ts.Add(-step)) {
+			i++
+		}
+
+		var agg Bucket
+		for j := i; j < len(buckets) && buckets[j].Start.Before(ts); j++ {
+			b := buckets[j]
+			if agg.Count == 0 {
+				agg.Min, agg.Max = b.Min, b.Max
+			}
+			agg.Min = math.Min(agg.Min, b.Min)
+			agg.Max = math.Max(agg.Max, b.Max)
+			agg.Sum += b.Sum
+			agg.Count += b.Count
+			agg.Last = b.Last
+			agg.Counter = b.Counter
+			agg.Increase += b.Increase
+		}
+		if agg.Count == 0 {
+			continue
+		}
+
+		p := Point{Time: ts}
+		if mType == "counter" {
+			p.Counter = ptr(agg.Counter)
+			p.Increase = ptr(agg.Increase)
+		} else {
+			p.Value = agg.Last
+			p.Min = ptr(agg.Min)
+			p.Max = ptr(agg.Max)
+			p.Avg = ptr(agg.Sum / float64(agg.Count))
+		}
+		points = append(points, p)
+	}
+
+	return points
+}
+
+// bucketBefore возвращает последнюю корзину, завершившуюся не позже at:
+// значения корзины, в которую попадает at, могли быть записаны уже после
+// него.
+func bucketBefore(buckets []Bucket, resolution time.Duration, at time.Time) (Bucket, bool) {
+	i := sort.Search(len(buckets), func(i int) bool {
+		return buckets[i].Start.Add(resolution).After(at)
+	})
+	if i == 0 {
+		return Bucket{}, false
+	}
+	return buckets[i-1], true
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
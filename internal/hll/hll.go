@@ -0,0 +1,122 @@
+// Package hll реализует HyperLogLog — оценку числа уникальных значений
+// без хранения самих значений.
+package hll
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// precision задаёт число регистров 2^precision; стандартная ошибка
+// оценки ≈ 1.04/sqrt(2^precision) ≈ 0.8%.
+const (
+	precision = 14
+	registers = 1 << precision
+)
+
+// Sketch — набор регистров HyperLogLog. Нулевое значение не готово
+// к использованию, создавайте через New.
+type Sketch struct {
+	registers []uint8
+}
+
+func New() *Sketch {
+	return &Sketch{registers: make([]uint8, registers)}
+}
+
+func (s *Sketch) Add(member string) {
+	hash := hashString(member)
+	idx := hash >> (64 - precision)
+	// Ранг — позиция первой единицы в оставшихся битах
+	rank := uint8(bits.LeadingZeros64(hash<<precision|1<<(precision-1)) + 1)
+	if rank > s.registers[idx] {
+		s.registers[idx] = rank
+	}
+}
+
+// Merge объединяет other с s: результат оценивает мощность объединения
+// множеств.
+func (s *Sketch) Merge(other *Sketch) {
+	for i, r := range other.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+}
+
+func (s *Sketch) Clone() *Sketch {
+	return &Sketch{registers: append([]uint8(nil), s.registers...)}
+}
+
+// Estimate возвращает оценку числа уникальных добавленных значений.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	var sum float64
+	zeros := 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	// Для малых мощностей точнее линейный подсчёт
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// MarshalText кодирует регистры в base64, чтобы скетч можно было хранить
+// в JSON снимка и журнала.
+func (s *Sketch) MarshalText() ([]byte, error) {
+	data := make([]byte, 1+len(s.registers))
+	data[0] = precision
+	copy(data[1:], s.registers)
+
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(text, data)
+	return text, nil
+}
+
+func (s *Sketch) UnmarshalText(text []byte) error {
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(data, text)
+	if err != nil {
+		return fmt.Errorf("invalid sketch: %w", err)
+	}
+	data = data[:n]
+
+	if len(data) != 1+registers || data[0] != precision {
+		return fmt.Errorf("invalid sketch: expected precision %d", precision)
+	}
+	for _, r := range data[1:] {
+		if r > 64-precision+1 {
+			return fmt.Errorf("invalid sketch: register value %d out of range", r)
+		}
+	}
+	s.registers = append(s.registers[:0], data[1:]...)
+	return nil
+}
+
+// hashString — FNV-1a с финальным перемешиванием из MurmurHash3, чтобы
+// близкие строки давали независимые старшие биты.
+func hashString(v string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(v); i++ {
+		hash ^= uint64(v[i])
+		hash *= 1099511628211
+	}
+
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb34e1a2d8c53
+	hash ^= hash >> 33
+	return hash
+}
@@ -0,0 +1,54 @@
+package hll
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimate(t *testing.T) {
+	for _, n := range []int{0, 10, 1000, 100000} {
+		s := New()
+		for i := 0; i < n; i++ {
+			s.Add("user-" + strconv.Itoa(i))
+			// Повторы не увеличивают оценку
+			s.Add("user-" + strconv.Itoa(i))
+		}
+		assert.InEpsilon(t, float64(n)+1, float64(s.Estimate())+1, 0.02, "n=%d", n)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 6000; i++ {
+		a.Add(strconv.Itoa(i))
+	}
+	for i := 4000; i < 10000; i++ {
+		b.Add(strconv.Itoa(i))
+	}
+
+	merged := a.Clone()
+	merged.Merge(b)
+	assert.InEpsilon(t, 10000, float64(merged.Estimate()), 0.02)
+	assert.InEpsilon(t, 6000, float64(a.Estimate()), 0.02)
+}
+
+func TestMarshalText(t *testing.T) {
+	s := New()
+	for i := 0; i < 500; i++ {
+		s.Add(strconv.Itoa(i))
+	}
+
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	var restored Sketch
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, s.Estimate(), restored.Estimate())
+
+	assert.Error(t, restored.UnmarshalText([]byte("AAAA")))
+	assert.Error(t, restored.UnmarshalText([]byte("not base64!")))
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var ErrHistogramBounds = errors.New("histogram bounds mismatch")
+
+// Histogram — распределение наблюдений по корзинам. Counts[i] — число
+// наблюдений в (Bounds[i-1], Bounds[i]], последний элемент Counts — корзина
+// (Bounds[len-1], +Inf). Count, если не задан, равен сумме Counts.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum,omitempty"`
+	Count  uint64    `json:"count,omitempty"`
+}
+
+// Validate проверяет, что границы конечны и строго возрастают, а корзин на
+// одну больше, чем границ.
+func (h Histogram) Validate() error {
+	if len(h.Bounds) == 0 {
+		return fmt.Errorf("histogram has no bounds")
+	}
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("histogram bound %v is not finite", b)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("histogram bounds must be strictly increasing")
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram needs %d counts for %d bounds, got %d", len(h.Bounds)+1, len(h.Bounds), len(h.Counts))
+	}
+
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if h.Count != 0 && h.Count != total {
+		return fmt.Errorf("histogram count %d does not match bucket total %d", h.Count, total)
+	}
+	return nil
+}
+
+// Normalize возвращает копию гистограммы с заполненным Count.
+func (h Histogram) Normalize() Histogram {
+	n := Histogram{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+	}
+	for _, c := range n.Counts {
+		n.Count += c
+	}
+	return n
+}
+
+// Merge складывает наблюдения двух гистограмм с одинаковыми границами.
+func (h Histogram) Merge(other Histogram) (Histogram, error) {
+	if len(h.Bounds) != len(other.Bounds) {
+		return Histogram{}, ErrHistogramBounds
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return Histogram{}, ErrHistogramBounds
+		}
+	}
+
+	merged := h.Normalize()
+	for i, c := range other.Counts {
+		merged.Counts[i] += c
+		merged.Count += c
+	}
+	merged.Sum += other.Sum
+	return merged, nil
+}
+
+// Quantile оценивает q-квантиль линейной интерполяцией внутри корзины.
+// Нижней границей первой корзины считается 0 (или сама граница, если она
+// отрицательна); для квантилей, попавших в корзину +Inf, возвращается
+// последняя конечная граница. Для пустой гистограммы результат — NaN.
+func (h Histogram) Quantile(q float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 || len(h.Bounds) == 0 || math.IsNaN(q) {
+		return math.NaN()
+	}
+	q = math.Max(0, math.Min(1, q))
+
+	rank := q * float64(total)
+	var cumulative uint64
+	for i, c := range h.Counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[len(h.Bounds)-1]
+		}
+
+		upper := h.Bounds[i]
+		lower := math.Min(0, upper)
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
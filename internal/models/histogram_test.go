@@ -0,0 +1,52 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramValidate(t *testing.T) {
+	assert.NoError(t, Histogram{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 2, 0}}.Validate())
+	assert.NoError(t, Histogram{Bounds: []float64{1}, Counts: []uint64{1, 2}, Count: 3}.Validate())
+
+	assert.Error(t, Histogram{Counts: []uint64{1}}.Validate())
+	assert.Error(t, Histogram{Bounds: []float64{1, 1}, Counts: []uint64{0, 0, 0}}.Validate())
+	assert.Error(t, Histogram{Bounds: []float64{1, math.Inf(1)}, Counts: []uint64{0, 0, 0}}.Validate())
+	assert.Error(t, Histogram{Bounds: []float64{1}, Counts: []uint64{1}}.Validate())
+	assert.Error(t, Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 5}.Validate())
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 2, 3}, Sum: 10}
+	b := Histogram{Bounds: []float64{1, 2}, Counts: []uint64{4, 0, 1}, Sum: 5}
+
+	merged, err := a.Merge(b)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5, 2, 4}, merged.Counts)
+	assert.Equal(t, uint64(11), merged.Count)
+	assert.Equal(t, 15.0, merged.Sum)
+	// Исходная гистограмма не меняется
+	assert.Equal(t, []uint64{1, 2, 3}, a.Counts)
+
+	_, err = a.Merge(Histogram{Bounds: []float64{1, 3}, Counts: []uint64{0, 0, 0}})
+	assert.ErrorIs(t, err, ErrHistogramBounds)
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := Histogram{Bounds: []float64{10, 20, 40}, Counts: []uint64{50, 30, 20, 0}}
+
+	assert.InDelta(t, 10, h.Quantile(0.5), 1e-9)
+	assert.InDelta(t, 5, h.Quantile(0.25), 1e-9)
+	assert.InDelta(t, 20, h.Quantile(0.8), 1e-9)
+	assert.InDelta(t, 30, h.Quantile(0.9), 1e-9)
+	assert.InDelta(t, 40, h.Quantile(1), 1e-9)
+
+	// Квантиль в корзине +Inf ограничен последней границей
+	h = Histogram{Bounds: []float64{1}, Counts: []uint64{1, 9}}
+	assert.Equal(t, 1.0, h.Quantile(0.99))
+
+	assert.True(t, math.IsNaN(Histogram{Bounds: []float64{1}, Counts: []uint64{0, 0}}.Quantile(0.5)))
+}
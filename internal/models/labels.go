@@ -0,0 +1,162 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SeriesKey строит ключ хранения метрики из имени и набора меток:
+// HeapAlloc{dc="eu",host="a"}. Метки сортируются по имени. Для метрики
+// без меток ключ совпадает с именем, поэтому старые данные остаются
+// совместимыми. Если имя содержит '{', в ключе оно экранируется (см.
+// escapeName), чтобы не совпасть с ключом ряда с метками.
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		if strings.IndexByte(name, '{') < 0 {
+			return name
+		}
+		return escapeName(name)
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(escapeName(name))
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// ParseSeriesKey разбирает ключ, построенный SeriesKey. Набор меток
+// начинается с первой неэкранированной '{'; если ключ не содержит
+// корректного набора меток, он целиком считается именем.
+func ParseSeriesKey(key string) (string, map[string]string) {
+	open := -1
+	for i := 0; i < len(key); i++ {
+		if key[i] == '\\' {
+			i++
+			continue
+		}
+		if key[i] == '{' {
+			open = i
+			break
+		}
+	}
+
+	if open >= 0 && strings.HasSuffix(key, "}") {
+		if labels, ok := parseLabelSet(key[open+1 : len(key)-1]); ok {
+			return unescapeName(key[:open]), labels
+		}
+	}
+	// Имя без меток экранировано, только если содержит '{'
+	if strings.Contains(key, `\{`) {
+		return unescapeName(key), nil
+	}
+	return key, nil
+}
+
+// escapeName экранирует в имени '\' и '{' обратной косой чертой.
+func escapeName(name string) string {
+	if !strings.ContainsAny(name, `\{`) {
+		return name
+	}
+	return strings.NewReplacer(`\`, `\\`, `{`, `\{`).Replace(name)
+}
+
+func unescapeName(name string) string {
+	if strings.IndexByte(name, '\\') < 0 {
+		return name
+	}
+	return strings.NewReplacer(`\\`, `\`, `\{`, `{`).Replace(name)
+}
+
+func parseLabelSet(s string) (map[string]string, bool) {
+	labels := make(map[string]string)
+	for len(s) > 0 {
+		eq := strings.Index(s, `="`)
+		if eq <= 0 {
+			return nil, false
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for i := 0; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '\\' && i+1 < len(s):
+				i++
+				value.WriteByte(s[i])
+			case c == '"':
+				s = s[i+1:]
+				closed = true
+			default:
+				value.WriteByte(c)
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return nil, false
+		}
+		labels[name] = value.String()
+
+		if len(s) > 0 {
+			if s[0] != ',' {
+				return nil, false
+			}
+			s = s[1:]
+		}
+	}
+	return labels, true
+}
+
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, `"\`) {
+		return v
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return r.Replace(v)
+}
+
+// ValidateLabels проверяет имена меток: латинские буквы, цифры и '_',
+// не начинающиеся с цифры.
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if name == "" {
+			return fmt.Errorf("empty label name")
+		}
+		for i, c := range name {
+			valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+			if !valid {
+				return fmt.Errorf("invalid label name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// MatchLabels сообщает, содержит ли labels все пары из filter.
+func MatchLabels(labels, filter map[string]string) bool {
+	for k, v := range filter {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		key    string
+	}{
+		{"no labels", "HeapAlloc", nil, "HeapAlloc"},
+		{"sorted labels", "HeapAlloc", map[string]string{"host": "a", "dc": "eu"}, `HeapAlloc{dc="eu",host="a"}`},
+		{"escaped value", "Msg", map[string]string{"text": `say "hi", \o/`}, `Msg{text="say \"hi\", \\o/"}`},
+		{"name like a label set", `Load{host="a"}`, nil, `Load\{host="a"}`},
+		{"escaped name", `Lo{a\d`, map[string]string{"host": "a"}, `Lo\{a\\d{host="a"}`},
+		{"backslash in name", `Lo\ad`, nil, `Lo\ad`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesKey(tt.metric, tt.labels)
+			assert.Equal(t, tt.key, key)
+
+			name, labels := ParseSeriesKey(key)
+			assert.Equal(t, tt.metric, name)
+			if len(tt.labels) == 0 {
+				assert.Empty(t, labels)
+			} else {
+				assert.Equal(t, tt.labels, labels)
+			}
+		})
+	}
+
+	name, labels := ParseSeriesKey("weird{name}")
+	assert.Equal(t, "weird{name}", name)
+	assert.Nil(t, labels)
+}
+
+func TestValidateLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(map[string]string{"host": "a", "_dc2": ""}))
+	assert.Error(t, ValidateLabels(map[string]string{"2dc": "a"}))
+	assert.Error(t, ValidateLabels(map[string]string{"host-name": "a"}))
+}
@@ -1,8 +1,16 @@
 package models
 
+import "github.com/yadmabramov/admAlerting/internal/hll"
+
+// Metrics — метрика в JSON API. Для set обновление передаёт Members и/или
+// готовый Sketch, а в ответе Delta содержит оценку числа уникальных значений.
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
+	ID        string            `json:"id"`
+	MType     string            `json:"type"`
+	Delta     *int64            `json:"delta,omitempty"`
+	Value     *float64          `json:"value,omitempty"`
+	Histogram *Histogram        `json:"histogram,omitempty"`
+	Members   []string          `json:"members,omitempty"`
+	Sketch    *hll.Sketch       `json:"sketch,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
 }
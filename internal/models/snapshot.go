@@ -0,0 +1,12 @@
+package models
+
+import "github.com/yadmabramov/admAlerting/internal/hll"
+
+// Snapshot — полное содержимое хранилища. Используется и для снимков на
+// диске, и для выгрузки через API.
+type Snapshot struct {
+	Gauges     map[string]float64     `json:"gauges"`
+	Counters   map[string]int64       `json:"counters"`
+	Histograms map[string]Histogram   `json:"histograms,omitempty"`
+	Sets       map[string]*hll.Sketch `json:"sets,omitempty"`
+}
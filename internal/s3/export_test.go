@@ -0,0 +1,3 @@
+package s3
+
+var Sign = sign
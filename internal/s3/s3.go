@@ -0,0 +1,275 @@
+// Package s3 — минимальный клиент S3-совместимого хранилища: запись,
+// чтение и листинг объектов с подписью AWS Signature Version 4. Бакет
+// адресуется в стиле пути (<endpoint>/<bucket>/<key>), что поддерживают
+// и AWS, и MinIO, и другие совместимые хранилища.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type Config struct {
+	// Адрес хранилища, например https://s3.eu-central-1.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	now    func() time.Time
+}
+
+func New(config Config) *Client {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &Client{
+		config: config,
+		http:   &http.Client{Timeout: time.Minute},
+		now:    time.Now,
+	}
+}
+
+// Put записывает объект целиком.
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Get читает объект; для отсутствующего объекта возвращает ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type listResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List возвращает ключи всех объектов с префиксом prefix в порядке
+// возрастания.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listResult
+		err = checkResponse(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + c.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u, err := url.Parse(c.config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = encodeQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	sign(req, body, c.config, c.now())
+	return c.http.Do(req)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, bytes.TrimSpace(msg))
+	}
+	return fmt.Errorf("s3: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+)
+
+// sign добавляет к запросу заголовки подписи AWS Signature Version 4.
+func sign(req *http.Request, body []byte, config Config, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := now.Format("20060102")
+	payloadHash := hashHex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "x-amz-date" || name == "x-amz-content-sha256" || name == "range" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		encodeQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// encodePath кодирует путь по правилам SigV4, сохраняя разделители.
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// encodeQuery строит канонический запрос: параметры отсортированы, имена
+// и значения закодированы по правилам SigV4.
+func encodeQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	type pair struct{ name, value string }
+	pairs := make([]pair, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, pair{uriEncode(name), uriEncode(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.name + "=" + p.value
+	}
+	return strings.Join(encoded, "&")
+}
+
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
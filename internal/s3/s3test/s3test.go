@@ -0,0 +1,136 @@
+// Package s3test содержит S3-совместимый сервер в памяти для тестов.
+// Поддерживаются запись, чтение и листинг (ListObjectsV2) объектов одного
+// бакета в стиле пути. Сервер проверяет ключ доступа и хеш тела запроса,
+// но не саму подпись.
+package s3test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yadmabramov/admAlerting/internal/s3"
+)
+
+const (
+	Bucket    = "metrics"
+	AccessKey = "test-access-key"
+	SecretKey = "test-secret-key"
+)
+
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// New запускает сервер; остановите его вызовом Close.
+func New() *Server {
+	s := &Server{objects: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Config возвращает настройки клиента для этого сервера.
+func (s *Server) Config() s3.Config {
+	return s3.Config{
+		Endpoint:  s.URL,
+		Bucket:    Bucket,
+		AccessKey: AccessKey,
+		SecretKey: SecretKey,
+	}
+}
+
+// Keys возвращает ключи сохранённых объектов по возрастанию.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+AccessKey+"/") {
+		http.Error(w, "InvalidAccessKeyId", http.StatusForbidden)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		s.objects[key] = body
+	case r.Method == http.MethodGet && key != "":
+		data, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, r.URL.Query().Get("prefix"))
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, prefix string) {
+	type object struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string   `xml:"Name"`
+		Prefix      string   `xml:"Prefix"`
+		IsTruncated bool     `xml:"IsTruncated"`
+		Contents    []object `xml:"Contents"`
+	}{Name: Bucket, Prefix: prefix}
+
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, object{Key: key, Size: len(data)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/s3"
+	"go.uber.org/zap"
+)
+
+// Копии снимков выгружаются в S3-совместимое хранилище как есть, в том же
+// формате и с тем же шифрованием, что и локальный файл. Ключ объекта —
+// <S3Prefix>/<время UTC>-<имя файла снимка>, поэтому самый свежий снимок —
+// последний по алфавиту. Срок хранения копий задаётся правилами бакета.
+const (
+	defaultUploadInterval = time.Minute
+	uploadKeyTimeFormat   = "20060102T150405.000Z"
+)
+
+func (s *Server) uploadInterval() time.Duration {
+	switch {
+	case s.config.S3Interval > 0:
+		return s.config.S3Interval
+	case s.config.StoreInterval > 0:
+		return s.config.StoreInterval
+	default:
+		return defaultUploadInterval
+	}
+}
+
+func (s *Server) startUploader() {
+	defer s.wg.Done()
+
+	interval := s.uploadInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if err := s.uploadSnapshot(ctx); err != nil {
+				s.logger.Error("Failed to upload snapshot", zap.Error(err))
+			}
+			cancel()
+		case <-s.stop:
+			// Последнюю копию выгружает Shutdown после финального сохранения
+			return
+		}
+	}
+}
+
+// uploadSnapshot выгружает текущий файл снимка, если он изменился с прошлой
+// выгрузки.
+func (s *Server) uploadSnapshot(ctx context.Context) error {
+	s.saveMu.Lock()
+	data, err := os.ReadFile(s.config.StoragePath)
+	s.saveMu.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	sum := sha256.Sum256(data)
+	if sum == s.lastUpload {
+		return nil
+	}
+	key := backupDir(s.config.S3Prefix) + time.Now().UTC().Format(uploadKeyTimeFormat) + "-" + filepath.Base(s.config.StoragePath)
+	if err := s.backup.Put(ctx, key, data); err != nil {
+		return err
+	}
+	s.lastUpload = sum
+	return nil
+}
+
+// backupDir возвращает префикс ключей копий: S3Prefix отделяется от имени
+// объекта "/", чтобы префикс одного сервера не совпадал с началом другого.
+func backupDir(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(prefix, "/") + "/"
+}
+
+// fetchLatestSnapshot скачивает самую свежую копию снимка в path и
+// возвращает её ключ; если копий нет, возвращается пустой ключ. Учитываются
+// только копии файла с тем же именем, что и path.
+func fetchLatestSnapshot(ctx context.Context, client *s3.Client, prefix, path string) (string, error) {
+	dir := backupDir(prefix)
+	keys, err := client.List(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	for _, key := range keys {
+		stamp, name, ok := strings.Cut(strings.TrimPrefix(key, dir), "-")
+		if !ok || name != filepath.Base(path) {
+			continue
+		}
+		if _, err := time.Parse(uploadKeyTimeFormat, stamp); err != nil {
+			continue
+		}
+		if key > latest {
+			latest = key
+		}
+	}
+	if latest == "" {
+		return "", nil
+	}
+
+	data, err := client.Get(ctx, latest)
+	if err != nil {
+		return "", err
+	}
+	return latest, writeSnapshotFile(path, data, 1)
+}
+
+// hasLocalSnapshot сообщает, есть ли на диске хотя бы один снимок.
+func hasLocalSnapshot(path string) bool {
+	for _, candidate := range snapshotCandidates(path) {
+		if _, err := os.Stat(candidate); err == nil {
+			return true
+		}
+	}
+	return false
+}
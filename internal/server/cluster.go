@@ -0,0 +1,495 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yadmabramov/admAlerting/internal/cluster"
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// В режиме кластера каждое имя метрики принадлежит одному узлу из
+// статического списка (cluster.Ring); все ряды одного имени с разными
+// метками живут на одном узле. Запросы к одной метрике, включая историю,
+// пересылаются владельцу целиком. Пакеты и импорт снимка делятся по
+// владельцам, а чтение всех метрик опрашивает все узлы и объединяет
+// ответы. Пакет, затронувший несколько узлов, атомарен только в пределах
+// каждого узла. Пересланный запрос помечается заголовком
+// X-Cluster-Forwarded с адресом отправителя и обслуживается только
+// локальными данными узла, если отправитель подтверждён (peerAuthorized).
+// Арендаторы, ограничения числа метрик и репликация действуют в пределах
+// узла.
+const (
+	clusterForwardedHeader = "X-Cluster-Forwarded"
+	clusterSignatureHeader = "X-Cluster-Signature"
+	clusterTimeout         = 10 * time.Second
+	// Допустимое расхождение часов узлов при проверке подписи
+	clusterSignatureSkew = time.Minute
+)
+
+// routeCluster направляет запросы к одной метрике её владельцу, а
+// остальные — clustered, работающему с данными всего кластера. Запросы,
+// пересланные другим узлом, обслуживает local.
+func (s *Server) routeCluster(local, clustered http.Handler) http.Handler {
+	byParam := s.forwardToOwner(local, func(r *http.Request) string {
+		return chi.URLParam(r, "name")
+	})
+	byBody := s.forwardToOwner(local, metricNameFromBody)
+
+	front := chi.NewRouter()
+	front.Post("/update/{type}/{name}/{value}", byParam)
+	front.Get("/value/{type}/{name}", byParam)
+	front.Delete("/value/{type}/{name}", byParam)
+	front.Post("/reset/{type}/{name}", byParam)
+	front.Post("/update/", byBody)
+	front.Post("/value/", byBody)
+	front.Delete("/value/", byBody)
+	front.Post("/reset/", byBody)
+	front.Get("/api/v1/query_range", s.forwardToOwner(local, func(r *http.Request) string {
+		return r.URL.Query().Get("name")
+	}))
+	front.NotFound(clustered.ServeHTTP)
+	front.MethodNotAllowed(clustered.ServeHTTP)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterForwardedHeader) != "" {
+			if !s.peerAuthorized(r) {
+				http.Error(w, "unauthorized cluster peer", http.StatusForbidden)
+				return
+			}
+			local.ServeHTTP(w, r)
+			return
+		}
+		front.ServeHTTP(w, r)
+	})
+}
+
+// peerAuthorized проверяет, что пересланный запрос пришёл от узла кольца,
+// указанного в X-Cluster-Forwarded. С общим секретом узел подтверждается
+// подписью запроса, без него — совпадением адреса, с которого пришёл
+// запрос, с адресом узла.
+func (s *Server) peerAuthorized(r *http.Request) bool {
+	sender := r.Header.Get(clusterForwardedHeader)
+	if !slices.Contains(s.ring.Nodes(), sender) {
+		return false
+	}
+	if s.config.ClusterSecret != "" {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		return err == nil && verifyPeerRequest(r, body, s.config.ClusterSecret, time.Now())
+	}
+
+	u, err := url.Parse(sender)
+	if err != nil {
+		return false
+	}
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	remoteIP := net.ParseIP(remote)
+	addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), u.Hostname())
+	if err != nil || remoteIP == nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// signPeerRequest помечает запрос к другому узлу адресом self и, если
+// задан secret, подписывает метод, адрес, отправителя, время и тело.
+func signPeerRequest(req *http.Request, body []byte, self, secret string) {
+	req.Header.Set(clusterForwardedHeader, self)
+	if secret == "" {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(clusterSignatureHeader, ts+":"+peerSignature(req, body, self, ts, secret))
+}
+
+// verifyPeerRequest проверяет подпись signPeerRequest и её время.
+func verifyPeerRequest(r *http.Request, body []byte, secret string, now time.Time) bool {
+	ts, sig, ok := strings.Cut(r.Header.Get(clusterSignatureHeader), ":")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > clusterSignatureSkew || d < -clusterSignatureSkew {
+		return false
+	}
+	want := peerSignature(r, body, r.Header.Get(clusterForwardedHeader), ts, secret)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+func peerSignature(r *http.Request, body []byte, sender, ts, secret string) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", r.Method, r.URL.RequestURI(), sender, ts, sum)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwardToOwner пересылает запрос владельцу метрики с именем name(r).
+// Запросы без имени обслуживаются локально, чтобы ошибку вернул
+// обычный обработчик.
+func (s *Server) forwardToOwner(local http.Handler, name func(*http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := name(r)
+		owner := s.ring.Owner(key)
+		if key == "" || owner == s.config.ClusterSelf {
+			local.ServeHTTP(w, r)
+			return
+		}
+		s.forward(w, r, owner)
+	}
+}
+
+// metricNameFromBody читает имя метрики из JSON тела запроса и
+// восстанавливает тело для дальнейшей обработки.
+func metricNameFromBody(r *http.Request) string {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var m models.Metrics
+	if err := json.Unmarshal(body, &m); err != nil {
+		return ""
+	}
+	return m.ID
+}
+
+// forward передаёт запрос узлу node и копирует его ответ.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, node string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, node+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	// Тело уже распаковано GzipMiddleware, а ответ сожмёт она же
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Content-Length")
+	signPeerRequest(req, body, s.config.ClusterSelf, s.config.ClusterSecret)
+
+	resp, err := s.peers.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("node %s unavailable: %v", node, err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		if name == "Content-Length" || name == "Content-Encoding" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// clusterStorage делит пакеты и замену содержимого по узлам-владельцам и
+// собирает чтение всех метрик со всех узлов. Остальные операции выполняются
+// над локальным хранилищем: запросы к одной метрике до него доходят уже на
+// узле-владельце.
+type clusterStorage struct {
+	storage.Repository
+	ring   *cluster.Ring
+	self   string
+	secret string
+	peers  *http.Client
+}
+
+func newClusterStorage(repo storage.Repository, ring *cluster.Ring, self, secret string, peers *http.Client) *clusterStorage {
+	return &clusterStorage{
+		Repository: repo,
+		ring:       ring,
+		self:       self,
+		secret:     secret,
+		peers:      peers,
+	}
+}
+
+// partition раскладывает изменения по владельцам; каждый узел кольца
+// получает свою часть, возможно пустую.
+func (s *clusterStorage) partition(updates []storage.MetricUpdate) map[string][]storage.MetricUpdate {
+	parts := make(map[string][]storage.MetricUpdate)
+	for _, node := range s.ring.Nodes() {
+		parts[node] = nil
+	}
+	for _, u := range updates {
+		owner := s.owner(u.Name)
+		parts[owner] = append(parts[owner], u)
+	}
+	return parts
+}
+
+// owner возвращает узел-владелец ряда key: ряды одного имени с разными
+// метками хранятся на одном узле.
+func (s *clusterStorage) owner(key string) string {
+	name, _ := models.ParseSeriesKey(key)
+	return s.ring.Owner(name)
+}
+
+// each выполняет fn для каждого узла параллельно и объединяет ошибки.
+func (s *clusterStorage) each(nodes []string, fn func(i int, node string) error) error {
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, node)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *clusterStorage) UpdateBatch(ctx context.Context, updates []storage.MetricUpdate) error {
+	parts := s.partition(updates)
+	nodes := make([]string, 0, len(parts))
+	for node, part := range parts {
+		if len(part) > 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return s.each(nodes, func(_ int, node string) error {
+		part := parts[node]
+		if node == s.self {
+			return s.Repository.UpdateBatch(ctx, part)
+		}
+		// Узел принимает имя и метки раздельно, как от агента
+		metrics := make([]models.Metrics, 0, len(part))
+		for _, u := range part {
+			m := storage.MetricFromUpdate(u)
+			m.ID, m.Labels = models.ParseSeriesKey(u.Name)
+			metrics = append(metrics, m)
+		}
+		return s.send(ctx, node, http.MethodPost, "/updates/", metrics, nil)
+	})
+}
+
+// ReplaceAll заменяет содержимое каждого узла его частью updates.
+func (s *clusterStorage) ReplaceAll(ctx context.Context, updates []storage.MetricUpdate) error {
+	parts := s.partition(updates)
+	// Снимки собираются до отправки, чтобы ошибка в пакете не затронула
+	// ни один узел
+	snaps := make(map[string]models.Snapshot, len(parts))
+	for node, part := range parts {
+		if node == s.self {
+			continue
+		}
+		snap, err := snapshotFromUpdates(part)
+		if err != nil {
+			return err
+		}
+		snaps[node] = snap
+	}
+	return s.each(s.ring.Nodes(), func(_ int, node string) error {
+		if node == s.self {
+			return s.Repository.ReplaceAll(ctx, parts[node])
+		}
+		return s.send(ctx, node, http.MethodPost, "/api/v1/snapshot?mode="+service.ImportReplace, snaps[node], nil)
+	})
+}
+
+func (s *clusterStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	snap, err := s.collect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return snap.Gauges, snap.Counters, nil
+}
+
+func (s *clusterStorage) GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error) {
+	snap, err := s.collect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Histograms, nil
+}
+
+func (s *clusterStorage) GetAllSets(ctx context.Context) (map[string]*hll.Sketch, error) {
+	snap, err := s.collect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Sets, nil
+}
+
+func (s *clusterStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	return s.collect(ctx)
+}
+
+// collect собирает метрики всех узлов. Недоступность любого узла —
+// ошибка: неполный ответ выглядел бы как пропажа метрик.
+func (s *clusterStorage) collect(ctx context.Context) (models.Snapshot, error) {
+	nodes := s.ring.Nodes()
+	snaps := make([]models.Snapshot, len(nodes))
+	err := s.each(nodes, func(i int, node string) error {
+		if node == s.self {
+			snap, err := s.Repository.Snapshot(ctx)
+			snaps[i] = snap
+			return err
+		}
+		return s.send(ctx, node, http.MethodGet, "/api/v1/snapshot", nil, &snaps[i])
+	})
+	if err != nil {
+		return models.Snapshot{}, err
+	}
+
+	merged := models.Snapshot{
+		Gauges:     make(map[string]float64),
+		Counters:   make(map[string]int64),
+		Histograms: make(map[string]models.Histogram),
+		Sets:       make(map[string]*hll.Sketch),
+	}
+	for _, snap := range snaps {
+		for name, v := range snap.Gauges {
+			merged.Gauges[name] = v
+		}
+		for name, v := range snap.Counters {
+			merged.Counters[name] = v
+		}
+		for name, v := range snap.Histograms {
+			merged.Histograms[name] = v
+		}
+		for name, v := range snap.Sets {
+			merged.Sets[name] = v
+		}
+	}
+	return merged, nil
+}
+
+// send выполняет запрос к узлу node с телом body в JSON и читает ответ в
+// result. Коды ошибок узла переводятся обратно в ошибки хранилища.
+func (s *clusterStorage) send(ctx context.Context, node, method, path string, body, result any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clusterTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, node+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signPeerRequest(req, data, s.self, s.secret)
+
+	resp, err := s.peers.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s unavailable: %w", node, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		msg = bytes.TrimSpace(msg)
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
+			return fmt.Errorf("%w: node %s: %s", storage.ErrInvalidUpdate, node, msg)
+		case http.StatusTooManyRequests:
+			return fmt.Errorf("%w: node %s: %s", storage.ErrLimitExceeded, node, msg)
+		case http.StatusConflict:
+			return fmt.Errorf("%w: node %s: %s", service.ErrTypeConflict, node, msg)
+		case http.StatusInsufficientStorage:
+			return fmt.Errorf("%w: node %s: %s", storage.ErrNotPersisted, node, msg)
+		default:
+			return fmt.Errorf("node %s: %s: %s", node, resp.Status, msg)
+		}
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// snapshotFromUpdates собирает снимок из пакета для ReplaceAll на другом
+// узле: значения counter складываются, гистограммы и множества
+// объединяются, как при локальной замене.
+func snapshotFromUpdates(updates []storage.MetricUpdate) (models.Snapshot, error) {
+	snap := models.Snapshot{
+		Gauges:     make(map[string]float64),
+		Counters:   make(map[string]int64),
+		Histograms: make(map[string]models.Histogram),
+		Sets:       make(map[string]*hll.Sketch),
+	}
+	for _, u := range updates {
+		switch u.MType {
+		case storage.TypeGauge:
+			snap.Gauges[u.Name] = u.Value
+		case storage.TypeCounter:
+			snap.Counters[u.Name] += u.Delta
+		case storage.TypeHistogram:
+			if u.Histogram == nil {
+				continue
+			}
+			h, ok := snap.Histograms[u.Name]
+			if !ok {
+				snap.Histograms[u.Name] = u.Histogram.Normalize()
+				continue
+			}
+			merged, err := h.Merge(*u.Histogram)
+			if err != nil {
+				return models.Snapshot{}, fmt.Errorf("%w: histogram %q: %v", storage.ErrInvalidUpdate, u.Name, err)
+			}
+			snap.Histograms[u.Name] = merged
+		case storage.TypeSet:
+			sketch, ok := snap.Sets[u.Name]
+			if !ok {
+				sketch = hll.New()
+				snap.Sets[u.Name] = sketch
+			}
+			if u.Sketch != nil {
+				sketch.Merge(u.Sketch)
+			}
+			for _, member := range u.Members {
+				sketch.Add(member)
+			}
+		}
+	}
+	return snap, nil
+}
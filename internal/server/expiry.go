@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"go.uber.org/zap"
+)
+
+const defaultEvictInterval = time.Minute
+
+func (s *Server) startEvictor() {
+	defer s.wg.Done()
+
+	interval := s.config.EvictInterval
+	if interval <= 0 {
+		interval = defaultEvictInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.evictExpired(context.Background(), time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// evictExpired удаляет устаревшие метрики через всю цепочку хранилищ,
+// чтобы удаление попало в журнал, историю и следующий снимок. Правила
+// устаревания общие для всех пространств.
+func (s *Server) evictExpired(ctx context.Context, now time.Time) int {
+	evicted := s.evictFrom(ctx, s.storage, s.repo, now)
+
+	s.tenantsMu.RLock()
+	tenants := make([]*tenant, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	s.tenantsMu.RUnlock()
+	for _, t := range tenants {
+		evicted += s.evictFrom(ctx, t.storage, t.limits, now)
+	}
+
+	if evicted > 0 {
+		s.logger.Info("Evicted stale metrics", zap.Int("count", evicted))
+	}
+	return evicted
+}
+
+// evictFrom удаляет устаревшие метрики условно: метрика, обновлённая после
+// того, как её признали устаревшей, остаётся.
+func (s *Server) evictFrom(ctx context.Context, mem *storage.MemoryStorage, repo storage.Repository, now time.Time) int {
+	evicted := 0
+	for _, key := range s.config.MetricTTLs.Expired(mem, now) {
+		before := now.Add(-s.config.MetricTTLs.TTL(key.Name))
+		err := repo.DeleteMetricIfStale(ctx, key.MType, key.Name, before)
+		if errors.Is(err, storage.ErrNotStale) {
+			continue
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			s.logger.Error("Failed to evict metric",
+				zap.String("type", key.MType),
+				zap.String("name", key.Name),
+				zap.Error(err),
+			)
+			continue
+		}
+		if err == nil {
+			evicted++
+		}
+	}
+	return evicted
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"sync"
+)
+
+// flusher объединяет конкурентные запросы на сохранение: каждый вызов Flush
+// возвращается только после того, как завершилось сохранение, начатое
+// не раньше этого вызова. Пока одно сохранение идёт, остальные вызовы ждут
+// и затем обслуживаются одним общим сохранением.
+type flusher struct {
+	flush func() error
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running bool
+	pending uint64
+	done    uint64
+	err     error
+}
+
+func newFlusher(flush func() error) *flusher {
+	f := &flusher{flush: flush}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *flusher) Flush() error {
+	f.mu.Lock()
+	f.pending++
+	ticket := f.pending
+
+	for f.running && f.done < ticket {
+		f.cond.Wait()
+	}
+	if f.done >= ticket {
+		err := f.err
+		f.mu.Unlock()
+		return err
+	}
+
+	// Сохранение покрывает все запросы, пришедшие до его начала
+	f.running = true
+	target := f.pending
+	f.mu.Unlock()
+
+	err := f.flush()
+
+	f.mu.Lock()
+	f.running = false
+	f.done = target
+	f.err = err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	return err
+}
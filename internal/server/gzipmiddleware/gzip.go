@@ -62,6 +62,14 @@ func (g *gzipResponseWriter) Write(b []byte) (int, error) {
 	return g.Writer.Write(b)
 }
 
+// Flush отправляет клиенту уже сжатые данные, не закрывая поток.
+func (g *gzipResponseWriter) Flush() {
+	if f, ok := g.Writer.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
 func (g *gzipResponseWriter) WriteHeader(statusCode int) {
 	if g.Writer != nil {
 		g.ResponseWriter.Header().Del("Content-Length")
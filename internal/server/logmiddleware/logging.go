@@ -41,6 +41,12 @@ func (w *responseWriterWrapper) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+// Unwrap даёт http.ResponseController доступ к исходному писателю,
+// например для Flush при потоковых ответах.
+func (w *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (w *responseWriterWrapper) Write(b []byte) (int, error) {
 	if w.status == 0 {
 		w.status = http.StatusOK
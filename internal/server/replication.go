@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Поток репликации — ответ GET /api/v1/replication в формате JSON lines.
+// Первая строка содержит снимок хранилища ведущего сервера, следующие —
+// изменения в формате журнала (walRecord или пакет []walRecord) в том
+// порядке, в котором они применялись. Пустые строки — heartbeat.
+const replicationPath = "/api/v1/replication"
+
+const (
+	// Число последних изменений, которые может догнать ведомый
+	replicationBuffer    = 4096
+	replicationHeartbeat = 5 * time.Second
+	// Ведомый считает соединение потерянным, если за это время не пришло
+	// ни одной строки
+	replicationTimeout  = 3 * replicationHeartbeat
+	replicationRetryMin = 100 * time.Millisecond
+	replicationRetryMax = 10 * time.Second
+	// Ограничение на строку потока, включая первую строку со снимком
+	replicationMaxLine = 256 << 20
+)
+
+// errReplicaBehind — ведомый отстал больше чем на размер журнала
+// репликации и должен переподключиться за свежим снимком.
+var errReplicaBehind = errors.New("replica fell behind the replication log")
+
+// replicationLog — последние изменения хранилища для ведомых серверов.
+// Наблюдатель хранилища в памяти нумерует изменения в момент применения,
+// поэтому изменения одной метрики идут в порядке применения, а номер,
+// прочитанный вместе со снимком, отделяет вошедшие в снимок изменения от
+// остальных. Хранится не больше size записей.
+type replicationLog struct {
+	mem *storage.MemoryStorage
+
+	mu      sync.Mutex
+	records [][]byte
+	last    uint64
+	// Закрывается при добавлении записи
+	added chan struct{}
+}
+
+func newReplicationLog(mem *storage.MemoryStorage, size int) *replicationLog {
+	l := &replicationLog{
+		mem:     mem,
+		records: make([][]byte, size),
+		added:   make(chan struct{}),
+	}
+	mem.Observe(l.record)
+	return l
+}
+
+// record кодирует запись сразу: множества изменений можно читать только
+// во время вызова наблюдателя. Запись, которую не удалось закодировать,
+// остаётся пустой и обрывает поток у всех, кто до неё дойдёт.
+func (l *replicationLog) record(changes []storage.Change) {
+	entry := walEntry(changes, "")
+	if entry == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		line = append(line, '\n')
+	} else {
+		line = nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.last++
+	l.records[(l.last-1)%uint64(len(l.records))] = line
+	close(l.added)
+	l.added = make(chan struct{})
+}
+
+// subscribe возвращает снимок хранилища и номер последнего вошедшего в
+// него изменения.
+func (l *replicationLog) subscribe(ctx context.Context) (models.Snapshot, uint64, error) {
+	var seq uint64
+	snap, err := l.mem.SnapshotWith(ctx, func() {
+		l.mu.Lock()
+		seq = l.last
+		l.mu.Unlock()
+	})
+	return snap, seq, err
+}
+
+// read добавляет к buf записи с номерами после after. Если новых записей
+// нет, возвращает канал, который закроется при их появлении.
+func (l *replicationLog) read(after uint64, buf [][]byte) ([][]byte, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if after == l.last {
+		return buf, l.added, nil
+	}
+	if l.last-after > uint64(len(l.records)) {
+		return buf, nil, errReplicaBehind
+	}
+	for seq := after + 1; seq <= l.last; seq++ {
+		line := l.records[(seq-1)%uint64(len(l.records))]
+		if line == nil {
+			return buf, nil, fmt.Errorf("replication record %d could not be encoded", seq)
+		}
+		buf = append(buf, line)
+	}
+	return buf, nil, nil
+}
+
+// handleReplication отдаёт ведомому серверу снимок и поток изменений до
+// его отключения или остановки сервера.
+func (s *Server) handleReplication(w http.ResponseWriter, r *http.Request) {
+	snap, seq, err := s.replication.subscribe(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		s.logger.Error("Replication stream requires flushing", zap.Error(err))
+		return
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	var lines [][]byte
+	for {
+		var added <-chan struct{}
+		lines, added, err = s.replication.read(seq, lines[:0])
+		if err != nil {
+			s.logger.Warn("Replication stream closed", zap.String("remote", r.RemoteAddr), zap.Error(err))
+			return
+		}
+
+		if len(lines) > 0 {
+			// Отправляем накопившиеся записи одним сбросом
+			for _, line := range lines {
+				if _, err := w.Write(line); err != nil {
+					return
+				}
+			}
+			seq += uint64(len(lines))
+		} else {
+			select {
+			case <-added:
+				continue
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-s.stop:
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// redirectToLeader перенаправляет запросы на изменение метрик ведущему
+// серверу. Код 307 сохраняет метод и тело запроса.
+func redirectToLeader(leader string) func(http.Handler) http.Handler {
+	leader = strings.TrimSuffix(leader, "/")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		})
+	}
+}
+
+// startFollower поддерживает копию хранилища ведущего сервера, переподключаясь
+// с экспоненциальной задержкой при обрыве потока.
+func (s *Server) startFollower() {
+	defer s.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	delay := replicationRetryMin
+	for {
+		synced, err := s.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if synced {
+			delay = replicationRetryMin
+		}
+		s.logger.Warn("Replication stream lost",
+			zap.String("leader", s.config.LeaderURL),
+			zap.Error(err),
+			zap.Duration("retry", delay),
+		)
+
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return
+		}
+		delay = min(delay*2, replicationRetryMax)
+	}
+}
+
+// follow читает один поток репликации. synced сообщает, успел ли ведомый
+// получить снимок.
+func (s *Server) follow(ctx context.Context) (synced bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	url := strings.TrimSuffix(s.config.LeaderURL, "/") + replicationPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	// Соединение считается потерянным, если ведущий замолчал дольше таймаута
+	watchdog := time.AfterFunc(replicationTimeout, cancel)
+	defer watchdog.Stop()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := readReplicationLine(reader)
+		if err != nil {
+			return synced, err
+		}
+		watchdog.Reset(replicationTimeout)
+		if len(line) == 0 {
+			continue
+		}
+
+		if !synced {
+			var snap models.Snapshot
+			if err := json.Unmarshal(line, &snap); err != nil {
+				return false, fmt.Errorf("decode snapshot: %w", err)
+			}
+			if err := applySnapshot(ctx, snap, s.repo); err != nil {
+				return false, fmt.Errorf("apply snapshot: %w", err)
+			}
+			synced = true
+			s.logger.Info("Replica synced with leader", zap.String("leader", s.config.LeaderURL))
+			continue
+		}
+
+		if _, err := applyWALEntry(ctx, line, s.repo); err != nil {
+			return synced, err
+		}
+	}
+}
+
+func readReplicationLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > replicationMaxLine {
+			return nil, fmt.Errorf("replication record exceeds %d bytes", replicationMaxLine)
+		}
+		if !isPrefix {
+			return bytes.TrimSpace(line), nil
+		}
+	}
+}
@@ -2,15 +2,18 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/yadmabramov/admAlerting/internal/cluster"
 	"github.com/yadmabramov/admAlerting/internal/handlers"
+	"github.com/yadmabramov/admAlerting/internal/history"
+	"github.com/yadmabramov/admAlerting/internal/s3"
 	"github.com/yadmabramov/admAlerting/internal/server/gzipmiddleware"
 	"github.com/yadmabramov/admAlerting/internal/server/logmiddleware"
 	"github.com/yadmabramov/admAlerting/internal/service"
@@ -23,15 +26,84 @@ type Config struct {
 	StoreInterval time.Duration
 	StoragePath   string
 	Restore       bool
+	WALPath       string
+	// Количество хранимых снимков, включая текущий
+	SnapshotRetention int
+	// Формат снимка: SnapshotJSON или SnapshotGzip; если не задан,
+	// выбирается по расширению StoragePath
+	SnapshotFormat string
+	// Ключи AES для шифрования снимков: первым шифруются новые снимки,
+	// остальными можно только прочитать старые. Без ключей снимки не
+	// шифруются.
+	SnapshotKeys [][]byte
+	// Выгрузка копий снимков в S3-совместимое хранилище; выключена, если
+	// бакет не задан. По умолчанию период выгрузки равен StoreInterval,
+	// а при синхронном сохранении — минуте.
+	S3         s3.Config
+	S3Prefix   string
+	S3Interval time.Duration
+	// Глубина истории значений; при нулевых значениях история не ведётся
+	HistoryRetention time.Duration
+	HistorySamples   int
+	HistoryTiers     []history.TierConfig
+	// Правила устаревания метрик и период их проверки
+	MetricTTLs    storage.TTLPolicy
+	EvictInterval time.Duration
+	// Replication разрешает ведомым серверам подключаться к потоку
+	// изменений. Сервер с непустым LeaderURL работает ведомым: получает
+	// данные от ведущего и перенаправляет ему запросы на запись.
+	Replication bool
+	LeaderURL   string
+	// Ограничения на число разных метрик; действуют только на ведущем,
+	// ведомый принимает всё, что прислал ведущий
+	MetricLimits *storage.LimitPolicy
+	// Политика для имени, записываемого под другим типом: service.ConflictAllow
+	// (по умолчанию), ConflictReject или ConflictMigrate
+	TypeConflicts string
+	// ChangeFeed включает ленту изменений GET /api/v1/watch; последние
+	// ChangeFeedRetain событий хранятся для продолжения с номера события
+	ChangeFeed       bool
+	ChangeFeedRetain int
+	// Адреса всех узлов кластера, включая этот, и адрес этого узла в
+	// том же виде; без списка узлов сервер работает один
+	ClusterPeers []string
+	ClusterSelf  string
+	// Общий секрет узлов кластера для подписи пересылаемых запросов; без
+	// него узел принимает пересланные запросы только с адресов узлов
+	ClusterSecret string
+	// Ключ администратора для управления арендаторами; без него API
+	// арендаторов выключено
+	AdminKey string
 }
 
 type Server struct {
 	*http.Server
 	config  Config
-	storage storage.Repository
+	storage *storage.MemoryStorage
+	repo    storage.Repository
+	wal     *walStorage
 	logger  *zap.Logger
 	stop    chan struct{}
 	wg      sync.WaitGroup
+	saveMu  sync.Mutex
+
+	// Источник потока репликации; nil, если репликация выключена
+	replication *replicationLog
+	// Лента изменений; nil, если выключена
+	feed *storage.Feed
+
+	// Арендаторы по идентификатору
+	tenantsMu sync.RWMutex
+	tenants   map[string]*tenant
+
+	// Кольцо узлов кластера и клиент для запросов к ним; nil вне кластера
+	ring  *cluster.Ring
+	peers *http.Client
+
+	// Клиент хранилища копий снимков; nil, если выгрузка выключена
+	backup     *s3.Client
+	uploadMu   sync.Mutex
+	lastUpload [sha256.Size]byte
 }
 
 func NewServer(config Config) *Server {
@@ -40,41 +112,222 @@ func NewServer(config Config) *Server {
 		panic(err)
 	}
 
-	storage := storage.NewMemoryStorage()
+	ctx := context.Background()
+	var backup *s3.Client
+	if config.S3.Bucket != "" {
+		backup = s3.New(config.S3)
+	}
+	if config.Restore && backup != nil && !hasLocalSnapshot(config.StoragePath) {
+		key, err := fetchLatestSnapshot(ctx, backup, config.S3Prefix, config.StoragePath)
+		if err != nil {
+			logger.Error("Failed to fetch snapshot from object storage", zap.Error(err))
+		} else if key != "" {
+			logger.Info("Snapshot fetched from object storage", zap.String("key", key))
+		}
+	}
+
+	memStorage := storage.NewMemoryStorage()
+	tenants := make(map[string]*tenant)
+	var walSeq uint64
+	restore := func(ctx context.Context, snap snapshotFile) error {
+		restored, err := restoreTenants(ctx, snap.Tenants)
+		if err != nil {
+			return err
+		}
+		if err := applySnapshot(ctx, snap.Snapshot, memStorage); err != nil {
+			return err
+		}
+		tenants = restored
+		walSeq = snap.WALSeq
+		return nil
+	}
+	var reencrypt, fallback bool
 	if config.Restore {
-		if err := loadMetricsFromFile(config.StoragePath, storage); err != nil {
+		reencrypt, fallback, err = loadMetricsFromFile(ctx, config.StoragePath, config.SnapshotKeys, restore, logger)
+		if errors.Is(err, errSnapshotKey) {
+			// Продолжать с пустым хранилищем нельзя: первое же сохранение
+			// вытеснит снимок, который ещё можно расшифровать верным ключом
+			logger.Panic("Cannot decrypt snapshot, check snapshot keys", zap.Error(err))
+		}
+		if err != nil {
 			logger.Error("Failed to load metrics from file", zap.Error(err))
 		}
 	}
 
-	service := service.NewMetricsService(storage)
-	handler := handlers.NewMetricsHandler(service)
-
-	r := chi.NewRouter()
-	r.Use(logmiddleware.LoggerMiddleware(logger))
-	r.Use(gzipmiddleware.GzipMiddleware)
-
-	r.Get("/", handler.HandleIndex)
-	r.Post("/update/{type}/{name}/{value}", handler.HandleUpdate)
-	r.Get("/value/{type}/{name}", handler.HandleGetMetric)
-	r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		handler.HandleGetAllMetricsJSON(w, r)
-	})
-	r.Post("/update/", handler.HandleUpdateJSON)
-	r.Post("/value/", handler.HandleGetMetricJSON)
-
-	srv := &http.Server{
-		Addr:    config.Addr,
-		Handler: r,
+	// Журнал нужен только при периодическом сохранении
+	useWAL := config.WALPath != "" && config.StoreInterval > 0
+	if useWAL {
+		if config.Restore {
+			applied, last, err := replayWAL(ctx, config.WALPath, walSeq, fallback, config.SnapshotKeys, func(id string) storage.Repository {
+				if id == "" {
+					return memStorage
+				}
+				if t, ok := tenants[id]; ok {
+					return t.storage
+				}
+				return nil
+			})
+			if err != nil {
+				// Журнал сохраняется в стороне: следующий снимок удалил бы его
+				kept, moveErr := setAsideWAL(config.WALPath, time.Now())
+				if errors.Is(err, errWALGap) {
+					logger.Error("WAL does not continue the restored snapshot, changes since it are lost; WAL is not replayed",
+						zap.Error(err), zap.Int("records", applied), zap.Strings("kept", kept), zap.NamedError("keepError", moveErr))
+				} else {
+					logger.Error("Failed to replay WAL, records after the damaged one are not restored",
+						zap.Error(err), zap.Int("records", applied), zap.Strings("kept", kept), zap.NamedError("keepError", moveErr))
+				}
+			} else if applied > 0 {
+				logger.Info("WAL replayed", zap.Int("records", applied))
+			}
+			walSeq = last
+		} else if err := removeWAL(config.WALPath); err != nil {
+			logger.Error("Failed to remove WAL", zap.Error(err))
+		}
 	}
 
 	server := &Server{
-		Server:  srv,
 		config:  config,
-		storage: storage,
+		storage: memStorage,
 		logger:  logger,
 		stop:    make(chan struct{}),
+		backup:  backup,
+		tenants: tenants,
+	}
+
+	if config.Replication {
+		server.replication = newReplicationLog(memStorage, replicationBuffer)
+	}
+
+	var repo storage.Repository = memStorage
+	if config.StoreInterval == 0 {
+		repo = newSyncStorage(memStorage, func() error {
+			// Сохранение общее для группы запросов, поэтому не зависит от их контекстов
+			return server.saveMetrics(context.Background())
+		})
+	} else if useWAL {
+		var key []byte
+		if len(config.SnapshotKeys) > 0 {
+			key = config.SnapshotKeys[0]
+		}
+		w, err := openWAL(config.WALPath, walSeq, key)
+		if err != nil {
+			logger.Error("Failed to open WAL", zap.Error(err))
+		} else {
+			server.wal = newWALStorage(memStorage, memStorage, w)
+			repo = server.wal
+		}
+	}
+
+	// Отклонённое создание метрики не должно попасть ни в журнал, ни в историю
+	var limits *storage.LimitedStorage
+	if config.MetricLimits != nil && config.LeaderURL == "" {
+		limits, err = storage.NewLimitedStorage(ctx, repo, *config.MetricLimits)
+		if err != nil {
+			logger.Panic("Failed to count metrics", zap.Error(err))
+		}
+		repo = limits
+	}
+
+	if config.ChangeFeed {
+		server.feed = storage.NewFeed(config.ChangeFeedRetain)
+		memStorage.Observe(server.feed.Observe)
+	}
+
+	var metricsHistory *history.History
+	if config.HistoryRetention > 0 || config.HistorySamples > 0 {
+		metricsHistory = history.New(history.Config{
+			Retention:  config.HistoryRetention,
+			MaxSamples: config.HistorySamples,
+			Tiers:      config.HistoryTiers,
+		})
+		memStorage.Observe(metricsHistory.Observe)
+	}
+
+	server.repo = repo
+
+	// Локальные и кластерные обработчики пишут в одно пространство метрик
+	// и проверяют конфликты типов под общими блокировками имён
+	conflicts := service.NewConflictGuard(config.TypeConflicts)
+	routes := func(repo storage.Repository, owns func(name string) bool) chi.Router {
+		metricsService := service.NewMetricsService(repo)
+		metricsService.SetHistory(metricsHistory)
+		metricsService.SetConflictGuard(conflicts)
+		metricsService.SetConflictScope(owns)
+		r := server.metricsRouter(handlers.NewMetricsHandler(metricsService), limits)
+
+		if server.replication != nil {
+			r.Get(replicationPath, server.handleReplication)
+		}
+
+		if server.feed != nil {
+			r.Get(watchPath, server.handleWatch)
+		}
+
+		if metricsHistory != nil {
+			historyHandler := handlers.NewHistoryHandler(metricsHistory)
+			r.Get("/api/v1/query_range", historyHandler.HandleQueryRange)
+		}
+		return r
+	}
+
+	var r http.Handler = routes(repo, nil)
+	if len(config.ClusterPeers) > 0 {
+		server.ring = cluster.NewRing(config.ClusterPeers)
+		if !slices.Contains(server.ring.Nodes(), config.ClusterSelf) {
+			logger.Panic("Cluster self address is not among peers", zap.String("self", config.ClusterSelf))
+		}
+		server.peers = &http.Client{Timeout: clusterTimeout}
+		clustered := newClusterStorage(repo, server.ring, config.ClusterSelf, config.ClusterSecret, server.peers)
+		r = server.routeCluster(r, routes(clustered, func(name string) bool {
+			return clustered.owner(name) == config.ClusterSelf
+		}))
+	}
+
+	for _, t := range tenants {
+		if err := server.attachTenant(ctx, t); err != nil {
+			logger.Panic("Failed to restore tenant", zap.String("tenant", t.id), zap.Error(err))
+		}
+	}
+
+	root := chi.NewRouter()
+	root.Use(logmiddleware.LoggerMiddleware(logger))
+	root.Use(gzipmiddleware.GzipMiddleware)
+	if config.AdminKey != "" {
+		root.Route("/api/v1/admin", func(r chi.Router) {
+			if config.LeaderURL != "" {
+				r.Use(redirectToLeader(config.LeaderURL))
+			}
+			r.Use(server.requireAdmin)
+			r.Get("/tenants", server.handleListTenants)
+			r.Post("/tenants", server.handleCreateTenant)
+			r.Post("/tenants/{id}/rotate", server.handleRotateTenantKey)
+		})
+	}
+	root.Mount("/", server.routeTenant(r))
+
+	server.Server = &http.Server{
+		Addr:    config.Addr,
+		Handler: root,
+	}
+
+	// Снимок, зашифрованный старым ключом или не зашифрованный вовсе,
+	// сразу перезаписывается с текущим ключом
+	if reencrypt {
+		if err := server.saveMetrics(ctx); err != nil {
+			logger.Error("Failed to re-encrypt snapshot", zap.Error(err))
+		} else {
+			logger.Info("Snapshot re-encrypted with the current key")
+		}
+	}
+	if len(config.SnapshotKeys) > 0 {
+		// Старые копии снимка не должны оставаться открытыми или под
+		// выведенным из употребления ключом
+		if n, err := reencryptOlderSnapshots(config.StoragePath, config.SnapshotKeys); err != nil {
+			logger.Error("Failed to re-encrypt older snapshots", zap.Error(err))
+		} else if n > 0 {
+			logger.Info("Older snapshots re-encrypted with the current key", zap.Int("snapshots", n))
+		}
 	}
 
 	if config.StoreInterval > 0 {
@@ -82,9 +335,60 @@ func NewServer(config Config) *Server {
 		go server.startSaver()
 	}
 
+	// Ведомый получает удаления устаревших метрик от ведущего
+	if len(config.MetricTTLs) > 0 && config.LeaderURL == "" {
+		server.wg.Add(1)
+		go server.startEvictor()
+	}
+
+	if config.LeaderURL != "" {
+		server.wg.Add(1)
+		go server.startFollower()
+	}
+
+	if backup != nil {
+		server.wg.Add(1)
+		go server.startUploader()
+	}
+
 	return server
 }
 
+// metricsRouter возвращает маршруты API метрик одного пространства;
+// limits может быть nil.
+func (s *Server) metricsRouter(handler *handlers.MetricsHandler, limits *storage.LimitedStorage) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", handler.HandleIndex)
+	r.Get("/value/{type}/{name}", handler.HandleGetMetric)
+	r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		handler.HandleGetAllMetricsJSON(w, r)
+	})
+	r.Post("/value/", handler.HandleGetMetricJSON)
+	r.Get("/api/v1/snapshot", handler.HandleExportSnapshot)
+	r.Get("/api/v1/conflicts", handler.HandleTypeConflicts)
+
+	r.Group(func(r chi.Router) {
+		if s.config.LeaderURL != "" {
+			r.Use(redirectToLeader(s.config.LeaderURL))
+		}
+		r.Post("/update/{type}/{name}/{value}", handler.HandleUpdate)
+		r.Post("/update/", handler.HandleUpdateJSON)
+		r.Post("/updates/", handler.HandleUpdatesJSON)
+		r.Delete("/value/{type}/{name}", handler.HandleDeleteMetric)
+		r.Delete("/value/", handler.HandleDeleteMetricJSON)
+		r.Post("/reset/{type}/{name}", handler.HandleResetCounter)
+		r.Post("/reset/", handler.HandleResetCounterJSON)
+		r.Post("/api/v1/snapshot", handler.HandleImportSnapshot)
+	})
+
+	if limits != nil {
+		limitsHandler := handlers.NewLimitsHandler(limits)
+		r.Get("/api/v1/limits", limitsHandler.HandleLimits)
+	}
+	return r
+}
+
 func (s *Server) startSaver() {
 	defer s.wg.Done()
 
@@ -94,11 +398,11 @@ func (s *Server) startSaver() {
 	for {
 		select {
 		case <-ticker.C:
-			if err := s.saveMetrics(); err != nil {
+			if err := s.saveMetrics(context.Background()); err != nil {
 				s.logger.Error("Failed to save metrics", zap.Error(err))
 			}
 		case <-s.stop:
-			if err := s.saveMetrics(); err != nil {
+			if err := s.saveMetrics(context.Background()); err != nil {
 				s.logger.Error("Failed to save metrics on shutdown", zap.Error(err))
 			}
 			return
@@ -106,65 +410,54 @@ func (s *Server) startSaver() {
 	}
 }
 
-func (s *Server) saveMetrics() error {
-	gauges, counters := s.storage.GetAllMetrics()
-
-	data := struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
-	}{
-		Gauges:   gauges,
-		Counters: counters,
-	}
-
-	// Создаем директорию, если она не существует
-	if err := os.MkdirAll(filepath.Dir(s.config.StoragePath), 0755); err != nil {
-		return err
-	}
+func (s *Server) saveMetrics(ctx context.Context) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
 
-	file, err := os.Create(s.config.StoragePath)
+	snap, err := s.snapshotMetrics(ctx)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(data)
-}
-
-func loadMetricsFromFile(path string, storage storage.Repository) error {
-	file, err := os.Open(path)
+	data, err := encodeSnapshot(snap, snapshotFormat(s.config))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
-	defer file.Close()
-
-	var data struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
+	if len(s.config.SnapshotKeys) > 0 {
+		if data, err = encryptSnapshot(data, s.config.SnapshotKeys[0]); err != nil {
+			return err
+		}
 	}
 
-	if err := json.NewDecoder(file).Decode(&data); err != nil {
+	if err := writeSnapshotFile(s.config.StoragePath, data, s.config.SnapshotRetention); err != nil {
 		return err
 	}
 
-	for name, value := range data.Gauges {
-		if err := storage.UpdateGauge(name, value); err != nil {
-			return err
-		}
+	if s.wal != nil {
+		return s.wal.commit()
 	}
+	return nil
+}
 
-	for name, value := range data.Counters {
-		if err := storage.UpdateCounter(name, value); err != nil {
+// snapshotMetrics собирает содержимое всех пространств; при включённом
+// журнале сбор согласован с запечатыванием сегмента.
+func (s *Server) snapshotMetrics(ctx context.Context) (snapshotFile, error) {
+	var snap snapshotFile
+	collect := func() error {
+		var err error
+		if snap.Snapshot, err = s.storage.Snapshot(ctx); err != nil {
 			return err
 		}
+		snap.Tenants, err = s.collectTenants(ctx)
+		return err
 	}
 
-	return nil
+	if s.wal != nil {
+		var err error
+		snap.WALSeq, err = s.wal.checkpoint(collect)
+		return snap, err
+	}
+	return snap, collect()
 }
 
 func (s *Server) ListenAndServe() error {
@@ -186,12 +479,26 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	s.wg.Wait()
 
 	if s.config.StoreInterval > 0 {
-		if err := s.saveMetrics(); err != nil {
+		if err := s.saveMetrics(context.Background()); err != nil {
 			s.logger.Error("Failed to save metrics on shutdown", zap.Error(err))
 		}
 	}
 
-	if err := s.Server.Shutdown(ctx); err != nil {
+	if s.backup != nil {
+		if err := s.uploadSnapshot(ctx); err != nil {
+			s.logger.Error("Failed to upload snapshot on shutdown", zap.Error(err))
+		}
+	}
+
+	err := s.Server.Shutdown(ctx)
+
+	if s.wal != nil {
+		if err := s.wal.close(); err != nil {
+			s.logger.Error("Failed to close WAL", zap.Error(err))
+		}
+	}
+
+	if err != nil {
 		return err
 	}
 
@@ -0,0 +1,1669 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yadmabramov/admAlerting/internal/cluster"
+	"github.com/yadmabramov/admAlerting/internal/history"
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/s3"
+	"github.com/yadmabramov/admAlerting/internal/s3/s3test"
+	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"github.com/yadmabramov/admAlerting/internal/storage/storagetest"
+	"go.uber.org/zap"
+)
+
+func TestSyncPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	srv := NewServer(Config{StoragePath: path})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/3", nil)
+	srv.Handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	snap, err := decodeSnapshot(raw)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), snap.Counters["PollCount"])
+
+	// Снимок не записать: изменение применено, и клиент узнаёт об этом по коду
+	blocker := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	srv = NewServer(Config{StoragePath: filepath.Join(blocker, "metrics.json")})
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/3", nil))
+	assert.Equal(t, http.StatusInsufficientStorage, w.Code)
+	assert.Contains(t, w.Body.String(), "applied but not persisted")
+	value, err := srv.storage.GetCounter(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+}
+
+func TestFlusherCoalesces(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	f := newFlusher(func() error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f.Flush()
+	}()
+
+	// Ждём, пока первое сохранение начнётся, и накапливаем очередь
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, f.Flush())
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	update := func(srv *Server, url string) {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	first := NewServer(config)
+	update(first, "/update/counter/PollCount/2")
+	update(first, "/update/gauge/Alloc/1.5")
+	require.NoError(t, first.saveMetrics(ctx))
+	update(first, "/update/counter/PollCount/3")
+	update(first, "/update/gauge/Alloc/2.5")
+
+	w := httptest.NewRecorder()
+	body := `[{"id":"PollCount","type":"counter","delta":10},{"id":"HeapAlloc","type":"gauge","value":7}]`
+	first.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Сервер «падает» без сохранения снимка
+	second := NewServer(config)
+
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), value)
+
+	gauge, err := second.storage.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, gauge)
+
+	gauge, err = second.storage.GetGauge(ctx, "HeapAlloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 7.0, gauge)
+}
+
+func TestWALKeepsApplyOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	first := NewServer(config)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				require.NoError(t, first.repo.UpdateGauge(ctx, "Load", float64(i*100+j)))
+			}
+		}()
+	}
+	wg.Wait()
+	want, err := first.storage.GetGauge(ctx, "Load")
+	require.NoError(t, err)
+
+	// Журнал воспроизводит значение, применённое последним
+	second := NewServer(config)
+	got, err := second.storage.GetGauge(ctx, "Load")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestWALSkipsRecordsInSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	first := NewServer(config)
+	require.NoError(t, first.repo.UpdateCounter(ctx, "PollCount", 2))
+	// Сбой после записи снимка, но до удаления запечатанного сегмента
+	snap, err := first.snapshotMetrics(ctx)
+	require.NoError(t, err)
+	data, err := encodeSnapshot(snap, SnapshotJSON)
+	require.NoError(t, err)
+	require.NoError(t, writeSnapshotFile(config.StoragePath, data, 1))
+	require.FileExists(t, config.WALPath+".prev")
+	require.NoError(t, first.repo.UpdateCounter(ctx, "PollCount", 3))
+
+	raw, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "ADMSNAP 2 "))
+	assert.Contains(t, strings.SplitN(string(raw), "\n", 2)[0], " wal=1")
+
+	second := NewServer(config)
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+
+	// Нумерация продолжается после воспроизведённых строк
+	require.NoError(t, second.repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, second.saveMetrics(ctx))
+	raw, err = os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	assert.Contains(t, strings.SplitN(string(raw), "\n", 2)[0], " wal=3")
+}
+
+func TestWALDamage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	// Оборванная последняя строка — след сбоя во время записи
+	require.NoError(t, os.WriteFile(config.WALPath, []byte(
+		`{"id":"A","type":"counter","delta":1}`+"\n"+`{"id":"A","type":"coun`), 0644))
+	srv := NewServer(config)
+	value, err := srv.storage.GetCounter(ctx, "A")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	require.NoError(t, srv.repo.UpdateCounter(ctx, "A", 2))
+	require.NoError(t, srv.wal.close())
+
+	srv = NewServer(config)
+	value, err = srv.storage.GetCounter(ctx, "A")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+	require.NoError(t, srv.wal.close())
+
+	// Повреждённая запись в середине журнала — не оборванный хвост
+	require.NoError(t, os.WriteFile(config.WALPath, []byte(
+		`{"id":"A","type":"counter","delta":1}`+"\n"+`{"id":"A",`+"\n"+`{"id":"A","type":"counter","delta":5}`+"\n"), 0644))
+	_, _, err = replayWAL(ctx, config.WALPath, 0, false, nil, func(string) storage.Repository { return storage.NewMemoryStorage() })
+	assert.ErrorContains(t, err, "line 2")
+
+	srv = NewServer(config)
+	value, err = srv.storage.GetCounter(ctx, "A")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	// Журнал сохранён для ручного восстановления
+	kept, err := filepath.Glob(config.WALPath + ".broken-*")
+	require.NoError(t, err)
+	assert.Len(t, kept, 1)
+}
+
+// flakyWriter дописывает половину данных и один раз возвращает ошибку
+type flakyWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	if f.failed {
+		return f.w.Write(p)
+	}
+	f.failed = true
+	n, _ := f.w.Write(p[:len(p)/2])
+	return n, errors.New("disk error")
+}
+
+func TestWALRecoversAfterWriteError(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	record := func(delta int64) walRecord {
+		return walRecord{Metrics: models.Metrics{ID: "A", MType: storage.TypeCounter, Delta: &delta}}
+	}
+
+	w, err := openWAL(path, 0, nil)
+	require.NoError(t, err)
+	w.Write(record(1))
+	require.NoError(t, w.Sync())
+
+	// Сбой записи: половина строки попадает в файл, ошибка сообщается один раз
+	w.buf = bufio.NewWriter(&flakyWriter{w: w.file})
+	w.Write(record(10))
+	assert.Error(t, w.Sync())
+
+	w.Write(record(2))
+	require.NoError(t, w.Sync())
+	assert.Equal(t, uint64(2), w.Seq())
+	require.NoError(t, w.Close())
+
+	repo := storage.NewMemoryStorage()
+	applied, last, err := replayWAL(ctx, path, 0, true, nil, func(string) storage.Repository { return repo })
+	require.NoError(t, err)
+	assert.Equal(t, 2, applied)
+	assert.Equal(t, uint64(2), last)
+	value, err := repo.GetCounter(ctx, "A")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+}
+
+// Наблюдатели (история, журнал) работают в настройке по умолчанию, поэтому
+// запись измеряется вместе с ними
+func BenchmarkServerUpdates(b *testing.B) {
+	run := func(b *testing.B, config Config) {
+		ctx := context.Background()
+		srv := NewServer(config)
+		names := make([]string, 1024)
+		for i := range names {
+			names[i] = "metric" + strconv.Itoa(i)
+		}
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				name := names[i%len(names)]
+				if i%2 == 0 {
+					srv.repo.UpdateGauge(ctx, name, float64(i))
+				} else {
+					srv.repo.UpdateCounter(ctx, name, 1)
+				}
+				i++
+			}
+		})
+		b.StopTimer()
+		if srv.wal != nil {
+			require.NoError(b, srv.wal.close())
+		}
+	}
+
+	b.Run("memory", func(b *testing.B) {
+		run(b, Config{StoreInterval: time.Hour})
+	})
+	b.Run("history and WAL", func(b *testing.B) {
+		dir := b.TempDir()
+		run(b, Config{
+			StoreInterval:    time.Hour,
+			StoragePath:      filepath.Join(dir, "metrics.json"),
+			WALPath:          filepath.Join(dir, "metrics.wal"),
+			HistoryRetention: time.Hour,
+			HistoryTiers: []history.TierConfig{
+				{Resolution: time.Minute, Retention: 24 * time.Hour},
+			},
+		})
+	})
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	for i := 1; i <= 4; i++ {
+		data, err := encodeSnapshot(snapshotFile{Snapshot: models.Snapshot{Counters: map[string]int64{"PollCount": int64(i)}}}, SnapshotJSON)
+		require.NoError(t, err)
+		require.NoError(t, writeSnapshotFile(path, data, 3))
+	}
+
+	assert.Equal(t, []string{path, path + ".1", path + ".2"}, snapshotCandidates(path))
+
+	// Повреждаем самый свежий снимок
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	raw[len(raw)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+
+	srv := NewServer(Config{StoreInterval: time.Hour, StoragePath: path, SnapshotRetention: 3, Restore: true})
+	value, err := srv.storage.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+}
+
+func TestSnapshotFallbackWALGap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval:     time.Hour,
+		StoragePath:       filepath.Join(dir, "metrics.json"),
+		WALPath:           filepath.Join(dir, "metrics.wal"),
+		SnapshotRetention: 2,
+		Restore:           true,
+	}
+
+	first := NewServer(config)
+	require.NoError(t, first.repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, first.saveMetrics(ctx))
+	require.NoError(t, first.repo.UpdateCounter(ctx, "PollCount", 2))
+	require.NoError(t, first.saveMetrics(ctx))
+	require.NoError(t, first.repo.UpdateCounter(ctx, "PollCount", 4))
+	require.NoError(t, first.wal.close())
+
+	raw, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	raw[len(raw)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(config.StoragePath, raw, 0644))
+
+	// Журнал начинается после повреждённого снимка: приращение 2 потеряно,
+	// и применять журнал к более старому снимку нельзя
+	second := NewServer(config)
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	kept, err := filepath.Glob(config.WALPath + ".broken-*")
+	require.NoError(t, err)
+	assert.Len(t, kept, 1)
+
+	// Строки без номеров после отката к старому снимку не применяются
+	_, _, err = replayWAL(ctx, kept[0], 0, true, nil, func(string) storage.Repository { return storage.NewMemoryStorage() })
+	assert.ErrorIs(t, err, errWALGap)
+	require.NoError(t, os.WriteFile(config.WALPath, []byte(`{"id":"PollCount","type":"counter","delta":1}`+"\n"), 0644))
+	_, _, err = replayWAL(ctx, config.WALPath, 1, true, nil, func(string) storage.Repository { return storage.NewMemoryStorage() })
+	assert.ErrorIs(t, err, errWALGap)
+	_, _, err = replayWAL(ctx, config.WALPath, 1, false, nil, func(string) storage.Repository { return storage.NewMemoryStorage() })
+	assert.NoError(t, err)
+}
+
+func TestLegacySnapshot(t *testing.T) {
+	snap, err := decodeSnapshot([]byte(`{"gauges":{"Alloc":1.5},"counters":{"PollCount":7}}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, snap.Gauges["Alloc"])
+	assert.Equal(t, int64(7), snap.Counters["PollCount"])
+
+	// Заголовок версии 1 без номера строки журнала
+	body := `{"counters":{"PollCount":8}}`
+	sum := sha256.Sum256([]byte(body))
+	snap, err = decodeSnapshot([]byte("ADMSNAP 1 sha256=" + hex.EncodeToString(sum[:]) + "\n" + body))
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), snap.Counters["PollCount"])
+	assert.Zero(t, snap.WALSeq)
+}
+
+func TestSnapshotGzip(t *testing.T) {
+	ctx := context.Background()
+	snap := snapshotFile{Snapshot: models.Snapshot{Gauges: map[string]float64{}, Counters: map[string]int64{}}}
+	for i := 0; i < 1000; i++ {
+		snap.Gauges[fmt.Sprintf("Gauge%d", i)] = float64(i) / 3
+		snap.Counters[fmt.Sprintf("Counter%d", i)] = int64(i)
+	}
+
+	plain, err := encodeSnapshot(snap, SnapshotJSON)
+	require.NoError(t, err)
+	compressed, err := encodeSnapshot(snap, SnapshotGzip)
+	require.NoError(t, err)
+	assert.Equal(t, gzipMagic, compressed[:2])
+	assert.Less(t, len(compressed)*4, len(plain))
+
+	decoded, err := decodeSnapshot(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, snap, decoded)
+
+	// Повреждение сжатого снимка обнаруживается при чтении
+	compressed[len(compressed)/2] ^= 0xff
+	_, err = decodeSnapshot(compressed)
+	assert.Error(t, err)
+
+	// Формат выбирается по расширению, а при восстановлении — по содержимому
+	path := filepath.Join(t.TempDir(), "metrics.json.gz")
+	first := NewServer(Config{StoreInterval: time.Hour, StoragePath: path})
+	require.NoError(t, first.storage.UpdateCounter(ctx, "PollCount", 7))
+	require.NoError(t, first.saveMetrics(ctx))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, gzipMagic, raw[:2])
+
+	second := NewServer(Config{StoreInterval: time.Hour, StoragePath: path, SnapshotFormat: SnapshotJSON, Restore: true})
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), value)
+}
+
+func TestSnapshotEncryption(t *testing.T) {
+	ctx := context.Background()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	config := func(keys ...[]byte) Config {
+		return Config{StoreInterval: time.Hour, StoragePath: path, SnapshotRetention: 1, SnapshotKeys: keys, Restore: true}
+	}
+
+	first := NewServer(config(oldKey))
+	require.NoError(t, first.storage.UpdateCounter(ctx, "PollCount", 7))
+	require.NoError(t, first.saveMetrics(ctx))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(raw, []byte(encryptedMagic)))
+	assert.NotContains(t, string(raw), "PollCount")
+
+	// Ротация: старый ключ читает снимок, который сразу перешифровывается новым
+	second := NewServer(config(newKey, oldKey))
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), value)
+	raw, err = os.ReadFile(path)
+	require.NoError(t, err)
+	_, keyIndex, err := decryptSnapshot(raw, [][]byte{newKey})
+	require.NoError(t, err)
+	assert.Equal(t, 0, keyIndex)
+
+	// Без подходящего ключа сервер не запускается с пустым хранилищем
+	assert.Panics(t, func() { NewServer(config(oldKey)) })
+	assert.Panics(t, func() { NewServer(config()) })
+
+	keys, err := ParseSnapshotKeys("hex:" + hex.EncodeToString(newKey) + ",base64:" + base64.StdEncoding.EncodeToString(oldKey))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{newKey, oldKey}, keys)
+	_, err = ParseSnapshotKeys("hex:abcd")
+	assert.Error(t, err)
+
+	// Строка допустима и как hex, и как base64: кодировка указывается явно
+	ambiguous := "00112233445566778899aabbccddeeff"
+	_, err = ParseSnapshotKeys(ambiguous)
+	assert.Error(t, err)
+	keys, err = ParseSnapshotKeys("hex:" + ambiguous)
+	require.NoError(t, err)
+	assert.Len(t, keys[0], 16)
+	keys, err = ParseSnapshotKeys("base64:" + ambiguous)
+	require.NoError(t, err)
+	assert.Len(t, keys[0], 24)
+}
+
+func TestEncryptionCoversWALAndOlderSnapshots(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{3}, 32)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.json")
+	config := func(keys ...[]byte) Config {
+		return Config{
+			StoreInterval:     time.Hour,
+			StoragePath:       path,
+			WALPath:           filepath.Join(dir, "metrics.wal"),
+			SnapshotRetention: 3,
+			SnapshotKeys:      keys,
+			Restore:           true,
+		}
+	}
+
+	plain := NewServer(config())
+	require.NoError(t, plain.repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, plain.saveMetrics(ctx))
+	require.NoError(t, plain.saveMetrics(ctx))
+	require.NoError(t, plain.repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, plain.wal.close())
+
+	// С ключом открытыми не остаются ни старые копии снимка, ни журнал
+	srv := NewServer(config(key))
+	value, err := srv.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+	snapshots := snapshotCandidates(path)
+	require.Len(t, snapshots, 3)
+	for _, p := range snapshots {
+		raw, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(raw, []byte(encryptedMagic)), p)
+		assert.NotContains(t, string(raw), "PollCount", p)
+	}
+
+	require.NoError(t, srv.repo.UpdateCounter(ctx, "PollCount", 3))
+	require.NoError(t, srv.wal.close())
+	raw, err := os.ReadFile(config().WALPath)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(raw, []byte(walEncryptedPrefix)))
+	assert.NotContains(t, string(raw), "PollCount")
+
+	_, _, err = replayWAL(ctx, config().WALPath, 0, false, nil, func(string) storage.Repository { return storage.NewMemoryStorage() })
+	assert.ErrorIs(t, err, errSnapshotKey)
+
+	srv = NewServer(config(key))
+	value, err = srv.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+	require.NoError(t, srv.wal.close())
+}
+
+func TestSnapshotS3Backup(t *testing.T) {
+	ctx := context.Background()
+	bucket := s3test.New()
+	defer bucket.Close()
+
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(t.TempDir(), "metrics.json.gz"),
+		Restore:       true,
+		S3:            bucket.Config(),
+		S3Prefix:      "node1",
+	}
+	first := NewServer(config)
+	require.NoError(t, first.storage.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, first.saveMetrics(ctx))
+	require.NoError(t, first.uploadSnapshot(ctx))
+	// Неизменившийся снимок повторно не выгружается
+	require.NoError(t, first.uploadSnapshot(ctx))
+	require.Len(t, bucket.Keys(), 1)
+
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, first.storage.UpdateCounter(ctx, "PollCount", 4))
+	require.NoError(t, first.saveMetrics(ctx))
+	require.NoError(t, first.uploadSnapshot(ctx))
+	keys := bucket.Keys()
+	require.Len(t, keys, 2)
+	assert.True(t, strings.HasPrefix(keys[1], "node1/"))
+	assert.True(t, strings.HasSuffix(keys[1], "-metrics.json.gz"))
+	local, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	uploaded, _ := bucket.Object(keys[1])
+	assert.Equal(t, local, uploaded)
+
+	// Более свежие копии другого сервера и другого файла с тем же началом
+	// ключа не восстанавливаются
+	other := s3.New(bucket.Config())
+	require.NoError(t, other.Put(ctx, "node10/29990101T000000.000Z-metrics.json.gz", []byte("other")))
+	require.NoError(t, other.Put(ctx, "node1/29990101T000000.000Z-metrics.json.gz.old", []byte("other")))
+	require.NoError(t, other.Put(ctx, "node1/29990101T000000.000Z-other-metrics.json.gz", []byte("other")))
+
+	// Без локального снимка восстанавливается самая свежая копия
+	config.StoragePath = filepath.Join(t.TempDir(), "metrics.json.gz")
+	second := NewServer(config)
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+	assert.FileExists(t, config.StoragePath)
+}
+
+func TestQueryRange(t *testing.T) {
+	srv := NewServer(Config{StoreInterval: time.Hour, StoragePath: filepath.Join(t.TempDir(), "metrics.json"), HistoryRetention: time.Hour})
+
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/update/gauge/HeapAlloc/42", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	now := time.Now().Unix()
+	url := fmt.Sprintf("/api/v1/query_range?type=gauge&name=HeapAlloc&start=%d&end=%d&step=1s", now-1, now+1)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Points []struct {
+			Value float64 `json:"v"`
+		} `json:"points"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.NotEmpty(t, resp.Points)
+	assert.Equal(t, 42.0, resp.Points[len(resp.Points)-1].Value)
+}
+
+func TestValueAt(t *testing.T) {
+	srv := NewServer(Config{StoreInterval: time.Hour, StoragePath: filepath.Join(t.TempDir(), "metrics.json"), HistoryRetention: time.Hour})
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/HeapInuse/42", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/PollCount/5", "").Code)
+	between := time.Now().Format(time.RFC3339Nano)
+	time.Sleep(time.Millisecond)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/HeapInuse/7", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/PollCount/5", "").Code)
+
+	w := do(http.MethodGet, "/value/gauge/HeapInuse?at="+between, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "42", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("X-Sample-Time"))
+
+	w = do(http.MethodPost, "/value/?at="+between, `{"id":"PollCount","type":"counter"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":5}`, w.Body.String())
+	assert.Equal(t, "10", do(http.MethodGet, "/value/counter/PollCount", "").Body.String())
+
+	w = do(http.MethodGet, "/value/gauge/HeapInuse?at=2020-01-01T00:00:00Z", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "outside history retention")
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Missing?at="+between, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/value/gauge/HeapInuse?at=yesterday", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/value/histogram/Latency?at="+between, "").Code)
+}
+
+func TestDeleteAndReset(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	do := func(srv *Server, method, url, body string) int {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w.Code
+	}
+
+	first := NewServer(config)
+	require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/update/gauge/Typo/1", ""))
+	require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/update/gauge/Alloc/2", ""))
+	require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/update/counter/PollCount/5", ""))
+	require.NoError(t, first.saveMetrics(ctx))
+
+	assert.Equal(t, http.StatusOK, do(first, http.MethodDelete, "/value/gauge/Typo", ""))
+	assert.Equal(t, http.StatusNotFound, do(first, http.MethodDelete, "/value/gauge/Typo", ""))
+	assert.Equal(t, http.StatusNotFound, do(first, http.MethodGet, "/value/gauge/Typo", ""))
+	assert.Equal(t, http.StatusOK, do(first, http.MethodDelete, "/value/", `{"id":"Alloc","type":"gauge"}`))
+	assert.Equal(t, http.StatusBadRequest, do(first, http.MethodPost, "/reset/gauge/Alloc", ""))
+	assert.Equal(t, http.StatusOK, do(first, http.MethodPost, "/reset/counter/PollCount", ""))
+
+	// Удаление и сброс восстанавливаются из журнала поверх старого снимка
+	second := NewServer(config)
+	_, err := second.storage.GetGauge(ctx, "Typo")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = second.storage.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	value, err := second.storage.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+
+	// И попадают в следующий снимок
+	require.NoError(t, second.saveMetrics(ctx))
+	raw, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	snap, err := decodeSnapshot(raw)
+	require.NoError(t, err)
+	assert.NotContains(t, snap.Gauges, "Typo")
+	assert.Equal(t, int64(0), snap.Counters["PollCount"])
+}
+
+func TestEvictExpired(t *testing.T) {
+	ctx := context.Background()
+	policy, err := storage.ParseTTLPolicy("Tmp*=10m,*=0")
+	require.NoError(t, err)
+
+	srv := NewServer(Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(t.TempDir(), "metrics.json"),
+		MetricTTLs:    policy,
+	})
+	require.NoError(t, srv.repo.UpdateGauge(ctx, "TmpLoad", 1))
+	require.NoError(t, srv.repo.UpdateCounter(ctx, "TmpHits", 1))
+	require.NoError(t, srv.repo.UpdateGauge(ctx, "Alloc", 1))
+
+	assert.Equal(t, 0, srv.evictExpired(ctx, time.Now().Add(5*time.Minute)))
+	assert.Equal(t, 2, srv.evictExpired(ctx, time.Now().Add(11*time.Minute)))
+
+	gauges, counters, err := srv.storage.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+	assert.Empty(t, counters)
+}
+
+func TestMetricLimits(t *testing.T) {
+	policy, err := storage.ParseLimitPolicy("*=3,Tmp=1")
+	require.NoError(t, err)
+	srv := NewServer(Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(t.TempDir(), "metrics.json"),
+		MetricLimits:  &policy,
+	})
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/TmpA/1", "").Code)
+	w := do(http.MethodPost, "/update/gauge/TmpB/1", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `prefix "Tmp"`)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/TmpA/2", "").Code)
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/Hits/1", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(http.MethodPost, "/updates/",
+		`[{"id":"Hits","type":"counter","delta":1},{"id":"Heap","type":"gauge","value":1}]`).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/Hits/1", "").Code)
+
+	w = do(http.MethodGet, "/api/v1/limits", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"global":{"used":3,"limit":3},"prefixes":[{"prefix":"Tmp","used":1,"limit":1}]}`,
+		w.Body.String())
+
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/value/gauge/Alloc", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Heap/1", "").Code)
+}
+
+func TestWatch(t *testing.T) {
+	srv := NewServer(Config{
+		StoreInterval:    time.Hour,
+		StoragePath:      filepath.Join(t.TempDir(), "metrics.json"),
+		ChangeFeed:       true,
+		ChangeFeedRetain: 2,
+	})
+	httpSrv := httptest.NewServer(srv.Handler)
+
+	post := func(url, body string) {
+		resp, err := http.Post(httpSrv.URL+url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	watch := func(query string) (*http.Response, *json.Decoder) {
+		resp, err := http.Get(httpSrv.URL + "/api/v1/watch" + query)
+		require.NoError(t, err)
+		return resp, json.NewDecoder(resp.Body)
+	}
+
+	resp, events := watch("")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	post("/update/gauge/Alloc/1.5", "")
+	post("/updates/", `[{"id":"Hits","type":"counter","delta":2},{"id":"Hits","type":"counter","delta":3}]`)
+
+	var got []storage.Event
+	for i := 0; i < 3; i++ {
+		var e storage.Event
+		require.NoError(t, events.Decode(&e))
+		got = append(got, e)
+	}
+	resp.Body.Close()
+	assert.Equal(t, uint64(1), got[0].Seq)
+	assert.Equal(t, storage.TypeGauge, got[0].MType)
+	assert.Equal(t, 1.5, *got[0].Value)
+	assert.Equal(t, int64(2), *got[1].Counter)
+	assert.Equal(t, int64(5), *got[2].Counter)
+	assert.Equal(t, int64(3), *got[2].Delta)
+
+	// Продолжение с номера события той же эпохи
+	epoch := got[0].Epoch
+	require.NotEmpty(t, epoch)
+	resp, events = watch("?epoch=" + epoch + "&from=3&slow=drop")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var e storage.Event
+	require.NoError(t, events.Decode(&e))
+	assert.Equal(t, uint64(3), e.Seq)
+	resp.Body.Close()
+
+	resp, _ = watch("?epoch=" + epoch + "&from=1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	// Номер без эпохи или из другой эпохи (до перезапуска) не продолжает ленту
+	resp, _ = watch("?from=3")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, _ = watch("?epoch=other&from=3")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, _ = watch("?slow=never")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	httpSrv.Close()
+}
+
+func TestTypeConflicts(t *testing.T) {
+	newServer := func(policy string) func(method, url, body string) *httptest.ResponseRecorder {
+		srv := NewServer(Config{
+			StoreInterval: time.Hour,
+			StoragePath:   filepath.Join(t.TempDir(), "metrics.json"),
+			TypeConflicts: policy,
+		})
+		return func(method, url, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+			return w
+		}
+	}
+
+	// allow хранит оба типа и показывает их в списке конфликтов
+	do := newServer("")
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/Alloc/1", "").Code)
+	w := do(http.MethodGet, "/api/v1/conflicts", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"policy":"allow","conflicts":[{"name":"Alloc","types":["gauge","counter"]}]}`, w.Body.String())
+
+	do = newServer("reject")
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	w = do(http.MethodPost, "/update/counter/Alloc/1", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "already used by gauge")
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/updates/",
+		`[{"id":"Heap","type":"gauge","value":1},{"id":"Alloc","type":"counter","delta":1}]`).Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/updates/",
+		`[{"id":"Hits","type":"gauge","value":1},{"id":"Hits","type":"counter","delta":1}]`).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Heap", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/2", "").Code)
+	w = do(http.MethodGet, "/api/v1/conflicts", "")
+	assert.JSONEq(t, `{"policy":"reject","conflicts":[{"name":"Alloc","rejected":2},{"name":"Hits","rejected":1}]}`,
+		w.Body.String())
+
+	// Импорт снимка подчиняется той же политике: merge сравнивается с
+	// текущим содержимым, replace — только сам с собой
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/api/v1/snapshot?mode=merge", `{"counters":{"Alloc":1}}`).Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/api/v1/snapshot?mode=replace",
+		`{"gauges":{"Heap":1},"counters":{"Heap":1}}`).Code)
+	assert.Equal(t, "2", do(http.MethodGet, "/value/gauge/Alloc", "").Body.String())
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/api/v1/snapshot?mode=replace", `{"counters":{"Alloc":1}}`).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Alloc", "").Code)
+
+	// Учёт конфликтов ограничен последними 1024 именами
+	do = newServer("reject")
+	for i := 0; i < 1100; i++ {
+		name := "N" + strconv.Itoa(i)
+		require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/"+name+"/1", "").Code)
+		require.Equal(t, http.StatusConflict, do(http.MethodPost, "/update/counter/"+name+"/1", "").Code)
+	}
+	var listed struct {
+		Conflicts []struct{ Name string }
+	}
+	require.NoError(t, json.Unmarshal(do(http.MethodGet, "/api/v1/conflicts", "").Body.Bytes(), &listed))
+	assert.Len(t, listed.Conflicts, 1024)
+	assert.NotContains(t, listed.Conflicts, struct{ Name string }{"N0"})
+	assert.Contains(t, listed.Conflicts, struct{ Name string }{"N1099"})
+
+	// migrate переносит имя к новому типу
+	do = newServer("migrate")
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/counter/Alloc/5", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Alloc", "").Code)
+	assert.Equal(t, "5", do(http.MethodGet, "/value/counter/Alloc", "").Body.String())
+	w = do(http.MethodGet, "/api/v1/conflicts", "")
+	assert.JSONEq(t, `{"policy":"migrate","conflicts":[{"name":"Alloc","migrated":1}]}`, w.Body.String())
+
+	// Изменение, применённое без сохранения, тоже переносит имя
+	blocker := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	unpersisted := NewServer(Config{
+		StoragePath:   filepath.Join(blocker, "metrics.json"),
+		TypeConflicts: "migrate",
+	})
+	do = func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		unpersisted.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+	require.Equal(t, http.StatusInsufficientStorage, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	require.Equal(t, http.StatusInsufficientStorage, do(http.MethodPost, "/update/counter/Alloc/5", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/value/gauge/Alloc", "").Code)
+	assert.Equal(t, "5", do(http.MethodGet, "/value/counter/Alloc", "").Body.String())
+
+	// В кластере локальные и кластерные обработчики используют общий учёт
+	// конфликтов: /update/ обслуживается локально, /updates/ — через кластер
+	srv := NewServer(Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(t.TempDir(), "metrics.json"),
+		TypeConflicts: "reject",
+		ClusterPeers:  []string{"http://node1"},
+		ClusterSelf:   "http://node1",
+	})
+	do = func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Alloc/1", "").Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/update/counter/Alloc/1", "").Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPost, "/updates/", `[{"id":"Alloc","type":"counter","delta":1}]`).Code)
+	w = do(http.MethodGet, "/api/v1/conflicts", "")
+	assert.JSONEq(t, `{"policy":"reject","conflicts":[{"name":"Alloc","rejected":2}]}`, w.Body.String())
+}
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+		AdminKey:      "admin-secret",
+	}
+	srv := NewServer(config)
+
+	do := func(srv *Server, method, url, key, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		srv.Handler.ServeHTTP(w, r)
+		return w
+	}
+	create := func(body string) string {
+		w := do(srv, http.MethodPost, "/api/v1/admin/tenants", "admin-secret", body)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var resp tenantKey
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Key
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(srv, http.MethodPost, "/api/v1/admin/tenants", "", `{"id":"acme"}`).Code)
+	acme := create(`{"id":"acme","quota":"*=2"}`)
+	beta := create(`{"id":"beta"}`)
+	assert.Equal(t, http.StatusConflict, do(srv, http.MethodPost, "/api/v1/admin/tenants", "admin-secret", `{"id":"acme"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do(srv, http.MethodPost, "/api/v1/admin/tenants", "admin-secret", `{"id":"../x"}`).Code)
+
+	// Одинаковые имена в разных пространствах не пересекаются
+	require.Equal(t, http.StatusOK, do(srv, http.MethodPost, "/update/gauge/HeapAlloc/1", "", "").Code)
+	require.Equal(t, http.StatusOK, do(srv, http.MethodPost, "/update/gauge/HeapAlloc/2", acme, "").Code)
+	require.Equal(t, http.StatusOK, do(srv, http.MethodPost, "/update/gauge/HeapAlloc/3", beta, "").Code)
+	assert.Equal(t, "1", do(srv, http.MethodGet, "/value/gauge/HeapAlloc", "", "").Body.String())
+	assert.Equal(t, "2", do(srv, http.MethodGet, "/value/gauge/HeapAlloc", acme, "").Body.String())
+	assert.Equal(t, "3", do(srv, http.MethodGet, "/value/gauge/HeapAlloc", beta, "").Body.String())
+	assert.Equal(t, http.StatusUnauthorized, do(srv, http.MethodGet, "/value/gauge/HeapAlloc", "wrong", "").Code)
+
+	// Квота арендатора
+	require.Equal(t, http.StatusOK, do(srv, http.MethodPost, "/update/counter/Hits/1", acme, "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, do(srv, http.MethodPost, "/update/gauge/Extra/1", acme, "").Code)
+	assert.JSONEq(t, `{"global":{"used":2,"limit":2},"prefixes":[]}`,
+		do(srv, http.MethodGet, "/api/v1/limits", acme, "").Body.String())
+
+	// Страница арендатора в браузере
+	w := do(srv, http.MethodGet, "/?tenant=acme", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+	r := httptest.NewRequest(http.MethodGet, "/?tenant=acme", nil)
+	r.SetBasicAuth("acme", acme)
+	w = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Hits")
+
+	// Старый ключ действует до следующей ротации или до явного отзыва
+	w = do(srv, http.MethodPost, "/api/v1/admin/tenants/acme/rotate", "admin-secret", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var rotated tenantKey
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	assert.Equal(t, http.StatusOK, do(srv, http.MethodGet, "/value/gauge/HeapAlloc", acme, "").Code)
+	assert.Equal(t, http.StatusOK, do(srv, http.MethodGet, "/value/gauge/HeapAlloc", rotated.Key, "").Code)
+	w = do(srv, http.MethodPost, "/api/v1/admin/tenants/acme/rotate?revoke=true", "admin-secret", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+	assert.Equal(t, http.StatusUnauthorized, do(srv, http.MethodGet, "/value/gauge/HeapAlloc", acme, "").Code)
+	acme = rotated.Key
+	assert.Equal(t, http.StatusNotFound, do(srv, http.MethodPost, "/api/v1/admin/tenants/none/rotate", "admin-secret", "").Code)
+
+	// Пока новый ключ не сохранён, другая ротация получает 409
+	srv.tenantsMu.Lock()
+	srv.tenants["acme"].rotating = true
+	srv.tenantsMu.Unlock()
+	assert.Equal(t, http.StatusConflict, do(srv, http.MethodPost, "/api/v1/admin/tenants/acme/rotate?revoke=true", "admin-secret", "").Code)
+	assert.Equal(t, http.StatusOK, do(srv, http.MethodGet, "/value/gauge/HeapAlloc", acme, "").Code)
+	srv.tenantsMu.Lock()
+	srv.tenants["acme"].rotating = false
+	srv.tenantsMu.Unlock()
+
+	// Из одновременных ротаций с отзывом действует ключ ровно одной
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 8)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = do(srv, http.MethodPost, "/api/v1/admin/tenants/acme/rotate?revoke=true", "admin-secret", "")
+		}()
+	}
+	wg.Wait()
+	valid := 0
+	for _, w := range responses {
+		if w.Code == http.StatusConflict {
+			continue
+		}
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+		if do(srv, http.MethodGet, "/value/gauge/HeapAlloc", rotated.Key, "").Code == http.StatusOK {
+			acme = rotated.Key
+			valid++
+		}
+	}
+	assert.Equal(t, 1, valid)
+
+	w = do(srv, http.MethodGet, "/api/v1/admin/tenants", "admin-secret", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var infos []tenantInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	require.Len(t, infos, 2)
+	assert.Equal(t, tenantInfo{ID: "acme", Keys: 1, Quota: "*=2", Usage: storage.LimitUsage{Used: 2, Limit: 2}}, infos[0])
+
+	// Изменения после последнего снимка восстанавливаются из журнала
+	require.Equal(t, http.StatusOK, do(srv, http.MethodPost, "/update/gauge/HeapAlloc/5", beta, "").Code)
+	srv.wal.close()
+
+	restarted := NewServer(config)
+	assert.Equal(t, "2", do(restarted, http.MethodGet, "/value/gauge/HeapAlloc", acme, "").Body.String())
+	assert.Equal(t, "5", do(restarted, http.MethodGet, "/value/gauge/HeapAlloc", beta, "").Body.String())
+	assert.Equal(t, "1", do(restarted, http.MethodGet, "/value/gauge/HeapAlloc", "", "").Body.String())
+	assert.Equal(t, http.StatusTooManyRequests, do(restarted, http.MethodPost, "/update/gauge/Extra/1", acme, "").Code)
+}
+
+func TestLabels(t *testing.T) {
+	srv := NewServer(Config{StoragePath: filepath.Join(t.TempDir(), "metrics.json")})
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Load/1?label=host:a", "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/",
+		`{"id":"Load","type":"gauge","value":2,"labels":{"host":"b"}}`).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/update/gauge/Load/3", "").Code)
+
+	// Одинаковые имена с разными метками — разные ряды
+	w := do(http.MethodGet, "/value/gauge/Load?label=host:a", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Body.String())
+
+	w = do(http.MethodPost, "/value/", `{"id":"Load","type":"gauge","labels":{"host":"b"}}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"Load","type":"gauge","value":2,"labels":{"host":"b"}}`, w.Body.String())
+
+	w = do(http.MethodGet, "/value/gauge/Load", "")
+	assert.Equal(t, "3", w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/update/gauge/Load/1?label=bad", "").Code)
+
+	// Имя с символами набора меток — отдельный ряд без меток
+	require.Equal(t, http.StatusOK, do(http.MethodPost, `/update/gauge/Load{host="a"}/9`, "").Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/updates/", `[{"id":"Load,x","type":"gauge","value":8}]`).Code)
+	w = do(http.MethodGet, "/value/gauge/Load?label=host:a", "")
+	assert.Equal(t, "1", w.Body.String())
+	w = do(http.MethodPost, "/value/", `{"id":"Load{host=\"a\"}","type":"gauge"}`)
+	assert.JSONEq(t, `{"id":"Load{host=\"a\"}","type":"gauge","value":9}`, w.Body.String())
+
+	w = do(http.MethodGet, "/metrics?label=host:a", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var metrics struct {
+		Gauges map[string]float64 `json:"gauges"`
+		Series []struct {
+			Key    string            `json:"key"`
+			ID     string            `json:"id"`
+			MType  string            `json:"type"`
+			Labels map[string]string `json:"labels"`
+		} `json:"series"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	assert.Equal(t, map[string]float64{`Load{host="a"}`: 1}, metrics.Gauges)
+	require.Len(t, metrics.Series, 1)
+	assert.Equal(t, `Load{host="a"}`, metrics.Series[0].Key)
+	assert.Equal(t, "Load", metrics.Series[0].ID)
+	assert.Equal(t, "gauge", metrics.Series[0].MType)
+	assert.Equal(t, map[string]string{"host": "a"}, metrics.Series[0].Labels)
+
+	w = do(http.MethodGet, "/metrics", "")
+	metrics.Series = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &metrics))
+	var names []string
+	for _, series := range metrics.Series {
+		if series.Labels == nil {
+			names = append(names, series.ID)
+		}
+	}
+	assert.ElementsMatch(t, []string{"Load", `Load{host="a"}`, "Load,x"}, names)
+}
+
+func TestHistogram(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	do := func(srv *Server, method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	first := NewServer(config)
+	body := `{"id":"Latency","type":"histogram","histogram":{"bounds":[10,20,40],"counts":[25,15,10,0]}}`
+	require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/update/", body).Code)
+	require.NoError(t, first.saveMetrics(ctx))
+	// Второе обновление попадает только в журнал
+	require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/updates/", "["+body+"]").Code)
+
+	w := do(first, http.MethodPost, "/update/", `{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0]}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	second := NewServer(config)
+	w = do(second, http.MethodGet, "/value/histogram/Latency?q=0.5&q=0.9", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10\n30", w.Body.String())
+
+	w = do(second, http.MethodGet, "/value/histogram/Latency", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"bounds":[10,20,40],"counts":[50,30,20,0],"count":100}`, w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, do(second, http.MethodGet, "/value/histogram/Latency?q=2", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(second, http.MethodGet, "/value/histogram/Missing?q=0.5", "").Code)
+
+	require.NoError(t, second.saveMetrics(ctx))
+	raw, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	snap, err := decodeSnapshot(raw)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), snap.Histograms["Latency"].Count)
+}
+
+func TestSet(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	do := func(srv *Server, method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	first := NewServer(config)
+	for _, user := range []string{"alice", "bob", "alice"} {
+		require.Equal(t, http.StatusOK, do(first, http.MethodPost, "/update/set/Users/"+user, "").Code)
+	}
+	require.NoError(t, first.saveMetrics(ctx))
+	w := do(first, http.MethodPost, "/update/", `{"id":"Users","type":"set","members":["carol","bob"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"Users","type":"set","delta":3}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, do(first, http.MethodPost, "/update/", `{"id":"Users","type":"set"}`).Code)
+
+	second := NewServer(config)
+	w = do(second, http.MethodGet, "/value/set/Users", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Body.String())
+
+	// Скетч, собранный на стороне клиента, сливается с сохранённым
+	sketch, err := second.storage.GetSet(ctx, "Users")
+	require.NoError(t, err)
+	sketch.Add("dave")
+	payload, err := json.Marshal([]map[string]any{{"id": "Users", "type": "set", "sketch": sketch}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, do(second, http.MethodPost, "/updates/", string(payload)).Code)
+	assert.Equal(t, "4", do(second, http.MethodGet, "/value/set/Users", "").Body.String())
+
+	require.NoError(t, second.saveMetrics(ctx))
+	raw, err := os.ReadFile(config.StoragePath)
+	require.NoError(t, err)
+	snap, err := decodeSnapshot(raw)
+	require.NoError(t, err)
+	require.Contains(t, snap.Sets, "Users")
+	assert.Equal(t, uint64(4), snap.Sets["Users"].Estimate())
+}
+
+func TestSnapshotImportExport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	config := Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "metrics.json"),
+		WALPath:       filepath.Join(dir, "metrics.wal"),
+		Restore:       true,
+	}
+
+	do := func(srv *Server, method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	source := NewServer(Config{StoreInterval: time.Hour})
+	require.Equal(t, http.StatusOK, do(source, http.MethodPost, "/update/counter/PollCount/3", "").Code)
+	require.Equal(t, http.StatusOK, do(source, http.MethodPost, "/update/gauge/Alloc/1.5", "").Code)
+	require.Equal(t, http.StatusOK, do(source, http.MethodPost, "/update/set/Users/alice", "").Code)
+	w := do(source, http.MethodGet, "/api/v1/snapshot", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	exported := w.Body.String()
+
+	target := NewServer(config)
+	require.Equal(t, http.StatusOK, do(target, http.MethodPost, "/update/counter/PollCount/10", "").Code)
+	require.Equal(t, http.StatusOK, do(target, http.MethodPost, "/update/gauge/Stale/1", "").Code)
+
+	assert.Equal(t, http.StatusBadRequest, do(target, http.MethodPost, "/api/v1/snapshot", exported).Code)
+	assert.Equal(t, http.StatusBadRequest, do(target, http.MethodPost, "/api/v1/snapshot?mode=append", exported).Code)
+	assert.Equal(t, http.StatusBadRequest, do(target, http.MethodPost, "/api/v1/snapshot?mode=merge", "{").Code)
+
+	// merge прибавляет counter к текущему значению
+	require.Equal(t, http.StatusOK, do(target, http.MethodPost, "/api/v1/snapshot?mode=merge", exported).Code)
+	assert.Equal(t, "13", do(target, http.MethodGet, "/value/counter/PollCount", "").Body.String())
+	assert.Equal(t, "1", do(target, http.MethodGet, "/value/gauge/Stale", "").Body.String())
+
+	// replace устанавливает counter и удаляет отсутствующие в снимке метрики
+	require.Equal(t, http.StatusOK, do(target, http.MethodPost, "/api/v1/snapshot?mode=replace", exported).Code)
+	assert.Equal(t, "3", do(target, http.MethodGet, "/value/counter/PollCount", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, do(target, http.MethodGet, "/value/gauge/Stale", "").Code)
+	assert.Equal(t, "1", do(target, http.MethodGet, "/value/set/Users", "").Body.String())
+
+	// Замена попадает в журнал и переживает падение сервера
+	restarted := NewServer(config)
+	value, err := restarted.storage.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+	_, err = restarted.storage.GetGauge(ctx, "Stale")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestRestoreReplacesCounters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	data, err := encodeSnapshot(snapshotFile{Snapshot: models.Snapshot{Counters: map[string]int64{"PollCount": 5}}}, SnapshotJSON)
+	require.NoError(t, err)
+	require.NoError(t, writeSnapshotFile(path, data, 0))
+
+	repo := storage.NewMemoryStorage()
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 100))
+	_, _, err = loadMetricsFromFile(ctx, path, nil, func(ctx context.Context, snap snapshotFile) error {
+		return applySnapshot(ctx, snap.Snapshot, repo)
+	}, zap.NewNop())
+	require.NoError(t, err)
+
+	value, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	do := func(handler http.Handler, method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	leader := NewServer(Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "leader.json"),
+		Replication:   true,
+	})
+	leaderHTTP := httptest.NewServer(leader.Handler)
+	require.Equal(t, http.StatusOK, do(leader.Handler, http.MethodPost, "/update/counter/PollCount/3", "").Code)
+	require.Equal(t, http.StatusOK, do(leader.Handler, http.MethodPost, "/update/gauge/Stale/1", "").Code)
+
+	follower := NewServer(Config{
+		StoreInterval: time.Hour,
+		StoragePath:   filepath.Join(dir, "follower.json"),
+		LeaderURL:     leaderHTTP.URL,
+	})
+	followerHTTP := httptest.NewServer(follower.Handler)
+
+	converged := func() bool {
+		want, err := leader.storage.Snapshot(ctx)
+		require.NoError(t, err)
+		got, err := follower.storage.Snapshot(ctx)
+		require.NoError(t, err)
+		return assert.ObjectsAreEqual(want, got)
+	}
+	require.Eventually(t, converged, 5*time.Second, 10*time.Millisecond)
+
+	// Изменения на ведущем доходят до ведомого потоком
+	require.Equal(t, http.StatusOK, do(leader.Handler, http.MethodPost, "/update/counter/PollCount/2", "").Code)
+	require.Equal(t, http.StatusOK, do(leader.Handler, http.MethodPost, "/updates/",
+		`[{"id":"Alloc","type":"gauge","value":1.5},{"id":"Users","type":"set","members":["alice"]}]`).Code)
+	require.Equal(t, http.StatusOK, do(leader.Handler, http.MethodDelete, "/value/gauge/Stale", "").Code)
+	require.Eventually(t, converged, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "5", do(follower.Handler, http.MethodGet, "/value/counter/PollCount", "").Body.String())
+	assert.Equal(t, http.StatusNotFound, do(follower.Handler, http.MethodGet, "/value/gauge/Stale", "").Code)
+
+	// Запись на ведомый перенаправляется ведущему
+	w := do(follower.Handler, http.MethodPost, "/update/counter/PollCount/1?label=host:a", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, leaderHTTP.URL+"/update/counter/PollCount/1?label=host:a", w.Header().Get("Location"))
+
+	resp, err := http.Post(followerHTTP.URL+"/updates/", "application/json",
+		strings.NewReader(`[{"id":"PollCount","type":"counter","delta":10}]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, converged, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "15", do(follower.Handler, http.MethodGet, "/value/counter/PollCount", "").Body.String())
+
+	followerHTTP.Close()
+	require.NoError(t, follower.Shutdown(ctx))
+	require.NoError(t, leader.Shutdown(ctx))
+	leaderHTTP.Close()
+}
+
+func TestReplicationLog(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewMemoryStorage()
+	log := newReplicationLog(mem, 2)
+	require.NoError(t, mem.UpdateCounter(ctx, "PollCount", 1))
+
+	snap, seq, err := log.subscribe(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"PollCount": 1}, snap.Counters)
+	assert.Equal(t, uint64(1), seq)
+
+	lines, added, err := log.read(seq, nil)
+	require.NoError(t, err)
+	assert.Empty(t, lines)
+
+	// Пакет — одна запись
+	require.NoError(t, mem.UpdateBatch(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 1},
+		{MType: storage.TypeGauge, Name: "Alloc", Value: 1},
+	}))
+	<-added
+	lines, _, err = log.read(seq, nil)
+	require.NoError(t, err)
+	require.Len(t, lines, 1)
+	var batch []walRecord
+	require.NoError(t, json.Unmarshal(lines[0], &batch))
+	assert.Len(t, batch, 2)
+
+	// Ведомый, отставший больше чем на размер журнала, отключается, а
+	// изменения на ведущем всё равно применяются
+	for i := 0; i < 2; i++ {
+		require.NoError(t, mem.UpdateCounter(ctx, "PollCount", 1))
+	}
+	_, _, err = log.read(seq, nil)
+	assert.ErrorIs(t, err, errReplicaBehind)
+	lines, _, err = log.read(seq+1, nil)
+	require.NoError(t, err)
+	assert.Len(t, lines, 2)
+
+	value, err := mem.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), value)
+}
+
+func TestCluster(t *testing.T) {
+	const nodes = 3
+	listeners := make([]net.Listener, nodes)
+	peers := make([]string, nodes)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = l
+		peers[i] = "http://" + l.Addr().String()
+	}
+
+	servers := make([]*Server, nodes)
+	for i := range servers {
+		servers[i] = NewServer(Config{
+			StoreInterval:  time.Hour,
+			StoragePath:    filepath.Join(t.TempDir(), "metrics.json"),
+			HistorySamples: 10,
+			ClusterPeers:   peers,
+			ClusterSelf:    peers[i],
+			ClusterSecret:  "secret",
+		})
+		ts := httptest.NewUnstartedServer(servers[i].Handler)
+		ts.Listener.Close()
+		ts.Listener = listeners[i]
+		ts.Start()
+		t.Cleanup(ts.Close)
+	}
+	ring := servers[0].ring
+
+	do := func(node int, method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, peers[node]+path, strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+	owner := func(name string) *Server {
+		return servers[slices.Index(peers, ring.Owner(name))]
+	}
+
+	// Обновления через любой узел попадают к владельцу имени
+	const metrics = 30
+	for i := 0; i < metrics; i++ {
+		code, _ := do(i%nodes, http.MethodPost, fmt.Sprintf("/update/gauge/G%d/%d", i, i), "")
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, _ := do(0, http.MethodPost, "/update/", `{"id":"Hits","type":"counter","delta":2}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(1, http.MethodPost, "/updates/",
+		`[{"id":"Hits","type":"counter","delta":3},{"id":"G0","type":"gauge","value":100},{"id":"Load","type":"gauge","value":1,"labels":{"host":"a"}}]`)
+	require.Equal(t, http.StatusOK, code)
+
+	ctx := context.Background()
+	for i := 0; i < metrics; i++ {
+		name := fmt.Sprintf("G%d", i)
+		for _, srv := range servers {
+			_, err := srv.storage.GetGauge(ctx, name)
+			if srv == owner(name) {
+				assert.NoError(t, err, name)
+			} else {
+				assert.ErrorIs(t, err, storage.ErrNotFound, name)
+			}
+		}
+	}
+	hits, err := owner("Hits").storage.GetCounter(ctx, "Hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), hits)
+
+	// Чтение одной метрики и её истории с любого узла
+	for node := 0; node < nodes; node++ {
+		code, body := do(node, http.MethodGet, "/value/gauge/G0", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "100", body)
+		code, body = do(node, http.MethodGet, "/value/gauge/Load?label=host:a", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "1", body)
+		code, body = do(node, http.MethodPost, "/value/", `{"id":"Hits","type":"counter"}`)
+		assert.Equal(t, http.StatusOK, code)
+		assert.JSONEq(t, `{"id":"Hits","type":"counter","delta":5}`, body)
+		now := time.Now().Unix()
+		code, body = do(node, http.MethodGet, fmt.Sprintf("/api/v1/query_range?type=gauge&name=G1&start=%d&end=%d&step=1s", now-1, now+1), "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `"v":1}`)
+	}
+
+	// Чтение всех метрик объединяет данные узлов
+	code, body := do(2, http.MethodGet, "/api/v1/snapshot", "")
+	require.Equal(t, http.StatusOK, code)
+	var snap models.Snapshot
+	require.NoError(t, json.Unmarshal([]byte(body), &snap))
+	assert.Len(t, snap.Gauges, metrics+1)
+	assert.Equal(t, map[string]int64{"Hits": 5}, snap.Counters)
+	code, body = do(1, http.MethodGet, "/", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "G29")
+
+	code, _ = do(0, http.MethodDelete, "/value/gauge/G0", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(1, http.MethodGet, "/value/gauge/G0", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Замена содержимого затрагивает все узлы
+	code, _ = do(2, http.MethodPost, "/api/v1/snapshot?mode=replace", `{"gauges":{"G1":1,"G2":2},"counters":{"Hits":1}}`)
+	require.Equal(t, http.StatusOK, code)
+	code, body = do(0, http.MethodGet, "/api/v1/snapshot", "")
+	require.Equal(t, http.StatusOK, code)
+	snap = models.Snapshot{}
+	require.NoError(t, json.Unmarshal([]byte(body), &snap))
+	assert.Equal(t, map[string]float64{"G1": 1, "G2": 2}, snap.Gauges)
+	assert.Equal(t, map[string]int64{"Hits": 1}, snap.Counters)
+	for _, srv := range servers {
+		gauges, _, err := srv.storage.GetAllMetrics(ctx)
+		require.NoError(t, err)
+		for name := range gauges {
+			assert.Equal(t, owner(name), srv, name)
+		}
+	}
+}
+
+func TestClusterPeerAuth(t *testing.T) {
+	peers := []string{"http://127.0.0.1:1", "http://node.invalid"}
+	newServer := func(secret string) *Server {
+		return NewServer(Config{
+			StoreInterval: time.Hour,
+			ClusterPeers:  peers,
+			ClusterSelf:   peers[0],
+			ClusterSecret: secret,
+		})
+	}
+	forwarded := func(srv *Server, remote, sender, body string, sign func(*http.Request)) int {
+		r := httptest.NewRequest(http.MethodPost, "/update/", strings.NewReader(body))
+		r.RemoteAddr = remote
+		r.Header.Set(clusterForwardedHeader, sender)
+		if sign != nil {
+			sign(r)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	body := `{"id":"Hits","type":"counter","delta":1}`
+
+	// Без секрета отправитель должен быть узлом кольца и прийти с его адреса
+	srv := newServer("")
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "127.0.0.1:5000", "http://evil", body, nil))
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "192.0.2.1:5000", peers[0], body, nil))
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "192.0.2.1:5000", peers[1], body, nil))
+	assert.Equal(t, http.StatusOK, forwarded(srv, "127.0.0.1:5000", peers[0], body, nil))
+
+	// С секретом запрос должен быть подписан им
+	srv = newServer("secret")
+	sign := func(secret, signed string) func(*http.Request) {
+		return func(r *http.Request) {
+			signPeerRequest(r, []byte(signed), r.Header.Get(clusterForwardedHeader), secret)
+		}
+	}
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "127.0.0.1:5000", peers[1], body, nil))
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "192.0.2.1:5000", peers[1], body, sign("other", body)))
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "192.0.2.1:5000", peers[1], body,
+		sign("secret", `{"id":"Hits","type":"counter","delta":100}`)))
+	assert.Equal(t, http.StatusForbidden, forwarded(srv, "192.0.2.1:5000", peers[1], body, func(r *http.Request) {
+		sign("secret", body)(r)
+		ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		r.Header.Set(clusterSignatureHeader, ts+":"+peerSignature(r, []byte(body), peers[1], ts, "secret"))
+	}))
+	assert.Equal(t, http.StatusOK, forwarded(srv, "192.0.2.1:5000", peers[1], body, sign("secret", body)))
+	hits, err := srv.storage.GetCounter(context.Background(), "Hits")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), hits)
+}
+
+func TestClusterStorageSend(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		http.Error(w, http.StatusText(code), code)
+	}))
+	defer ts.Close()
+	self := "http://127.0.0.1:1"
+	s := newClusterStorage(storage.NewMemoryStorage(), cluster.NewRing([]string{self, ts.URL}), self, "", ts.Client())
+
+	// Ошибки узла-владельца возвращаются как ошибки хранилища и сервиса
+	ctx := context.Background()
+	for code, want := range map[int]error{
+		http.StatusBadRequest:          storage.ErrInvalidUpdate,
+		http.StatusTooManyRequests:     storage.ErrLimitExceeded,
+		http.StatusConflict:            service.ErrTypeConflict,
+		http.StatusInsufficientStorage: storage.ErrNotPersisted,
+	} {
+		assert.ErrorIs(t, s.send(ctx, ts.URL, http.MethodPost, "/"+strconv.Itoa(code), nil, nil), want, code)
+	}
+
+	// Повторы гистограмм и множеств в пакете объединяются
+	h := models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1, Sum: 0.5}
+	snap, err := snapshotFromUpdates([]storage.MetricUpdate{
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &h},
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &h},
+		{MType: storage.TypeSet, Name: "Users", Members: []string{"alice"}},
+		{MType: storage.TypeSet, Name: "Users", Members: []string{"bob"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), snap.Histograms["Latency"].Count)
+	assert.Equal(t, uint64(2), snap.Sets["Users"].Estimate())
+
+	other := models.Histogram{Bounds: []float64{2}, Counts: []uint64{1, 0}, Count: 1}
+	_, err = snapshotFromUpdates([]storage.MetricUpdate{
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &h},
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &other},
+	})
+	assert.ErrorIs(t, err, storage.ErrInvalidUpdate)
+}
+
+func TestStorageDecoratorsConformance(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Repository {
+			return newSyncStorage(storage.NewMemoryStorage(), func() error { return nil })
+		})
+	})
+
+	t.Run("wal", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Repository {
+			w, err := openWAL(filepath.Join(t.TempDir(), "metrics.wal"), 0, nil)
+			require.NoError(t, err)
+			mem := storage.NewMemoryStorage()
+			repo := newWALStorage(mem, mem, w)
+			t.Cleanup(func() { repo.close() })
+			return repo
+		})
+	})
+}
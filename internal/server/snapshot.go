@@ -0,0 +1,332 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Формат файла снимка:
+//
+//	ADMSNAP <version> sha256=<hex> wal=<seq>\n
+//	<тело в JSON>
+//
+// wal — номер последней строки журнала, вошедшей в снимок; в версии 1 его
+// нет. Файлы без заголовка считаются снимками старого формата (чистый JSON).
+// В формате gzip файл целиком, вместе с заголовком, сжат gzip, а тело
+// записано без отступов. Формат при чтении определяется по первым байтам.
+const (
+	snapshotMagic   = "ADMSNAP"
+	snapshotVersion = 2
+)
+
+// Форматы файла снимка.
+const (
+	SnapshotJSON = "json"
+	SnapshotGzip = "gzip"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// snapshotFile — тело файла снимка: метрики пространства по умолчанию
+// и разделы арендаторов.
+type snapshotFile struct {
+	models.Snapshot
+	Tenants []tenantSnapshot `json:"tenants,omitempty"`
+	// Номер последней строки журнала, учтённой в снимке; хранится в заголовке
+	WALSeq uint64 `json:"-"`
+}
+
+// tenantSnapshot — раздел арендатора. Ключи API хранятся в виде хешей
+// SHA-256.
+type tenantSnapshot struct {
+	ID      string          `json:"id"`
+	Keys    []string        `json:"keys"`
+	Quota   string          `json:"quota,omitempty"`
+	Metrics models.Snapshot `json:"metrics"`
+}
+
+var errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// snapshotFormat возвращает заданный формат снимка, а если он не задан —
+// gzip для путей с расширением .gz и JSON для остальных.
+func snapshotFormat(config Config) string {
+	if config.SnapshotFormat != "" {
+		return config.SnapshotFormat
+	}
+	if strings.HasSuffix(config.StoragePath, ".gz") {
+		return SnapshotGzip
+	}
+	return SnapshotJSON
+}
+
+func encodeSnapshot(snap snapshotFile, format string) ([]byte, error) {
+	var body []byte
+	var err error
+	switch format {
+	case SnapshotJSON:
+		body, err = json.MarshalIndent(snap, "", "  ")
+	case SnapshotGzip:
+		body, err = json.Marshal(snap)
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %d sha256=%s wal=%d\n", snapshotMagic, snapshotVersion, hex.EncodeToString(sum[:]), snap.WALSeq)
+	buf.Write(body)
+	if format == SnapshotJSON {
+		return buf.Bytes(), nil
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func decodeSnapshot(raw []byte) (snapshotFile, error) {
+	var snap snapshotFile
+
+	if bytes.HasPrefix(raw, gzipMagic) {
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return snap, fmt.Errorf("invalid gzip snapshot: %w", err)
+		}
+		defer gz.Close()
+		if raw, err = io.ReadAll(gz); err != nil {
+			return snap, fmt.Errorf("invalid gzip snapshot: %w", err)
+		}
+	}
+
+	body := raw
+	if bytes.HasPrefix(raw, []byte(snapshotMagic+" ")) {
+		end := bytes.IndexByte(raw, '\n')
+		if end < 0 {
+			return snap, errors.New("truncated snapshot header")
+		}
+
+		var version int
+		var checksum string
+		var walSeq uint64
+		header := string(raw[:end])
+		if _, err := fmt.Sscanf(header, snapshotMagic+" %d", &version); err != nil {
+			return snap, fmt.Errorf("invalid snapshot header: %w", err)
+		}
+		var err error
+		switch version {
+		case 1:
+			_, err = fmt.Sscanf(header, snapshotMagic+" 1 sha256=%s", &checksum)
+		case snapshotVersion:
+			_, err = fmt.Sscanf(header, snapshotMagic+" 2 sha256=%s wal=%d", &checksum, &walSeq)
+		default:
+			return snap, fmt.Errorf("unsupported snapshot version %d", version)
+		}
+		if err != nil {
+			return snap, fmt.Errorf("invalid snapshot header: %w", err)
+		}
+
+		body = raw[end+1:]
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != checksum {
+			return snap, errSnapshotChecksum
+		}
+		snap.WALSeq = walSeq
+	}
+
+	if err := json.Unmarshal(body, &snap); err != nil {
+		return snap, err
+	}
+	return snap, nil
+}
+
+// writeSnapshotFile атомарно заменяет снимок: данные пишутся во временный
+// файл, синхронизируются и переименовываются. Предыдущие снимки сдвигаются
+// в <path>.1 ... <path>.<keep-1>.
+func writeSnapshotFile(path string, data []byte, keep int) error {
+	return replaceFile(path, data, func() error {
+		return rotateSnapshots(path, keep)
+	})
+}
+
+// replaceFile атомарно заменяет содержимое файла; beforeRename
+// вызывается, когда новое содержимое уже на диске.
+func replaceFile(path string, data []byte, beforeRename func() error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if beforeRename != nil {
+		if err := beforeRename(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// reencryptOlderSnapshots шифрует текущим ключом (keys[0]) старые снимки
+// <path>.N, не зашифрованные или зашифрованные другим ключом. Снимки, для
+// которых нет ключа или которые не расшифровываются, не трогаются.
+func reencryptOlderSnapshots(path string, keys [][]byte) (int, error) {
+	reencrypted := 0
+	for _, candidate := range snapshotCandidates(path)[1:] {
+		raw, err := os.ReadFile(candidate)
+		if err != nil {
+			return reencrypted, err
+		}
+		plain, keyIndex, err := decryptSnapshot(raw, keys)
+		if err != nil || keyIndex == 0 {
+			continue
+		}
+		data, err := encryptSnapshot(plain, keys[0])
+		if err != nil {
+			return reencrypted, err
+		}
+		if err := replaceFile(candidate, data, nil); err != nil {
+			return reencrypted, err
+		}
+		reencrypted++
+	}
+	return reencrypted, nil
+}
+
+func rotateSnapshots(path string, keep int) error {
+	if keep <= 1 {
+		return nil
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, keep-1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := keep - 2; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapshotCandidates возвращает существующие снимки от нового к старому.
+func snapshotCandidates(path string) []string {
+	candidates := []string{path}
+
+	matches, _ := filepath.Glob(path + ".*")
+	type older struct {
+		path string
+		n    int
+	}
+	var olders []older
+	for _, m := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(m, path+"."))
+		if err != nil || n < 1 {
+			continue
+		}
+		olders = append(olders, older{path: m, n: n})
+	}
+	sort.Slice(olders, func(i, j int) bool { return olders[i].n < olders[j].n })
+
+	for _, o := range olders {
+		candidates = append(candidates, o.path)
+	}
+	return candidates
+}
+
+// loadMetricsFromFile восстанавливает метрики из самого свежего корректного
+// снимка. Повреждённые снимки пропускаются, а снимок, для которого нет
+// ключа, прерывает восстановление ошибкой errSnapshotKey. Прочитанный
+// снимок передаётся в restore. stale сообщает, что восстановленный снимок
+// зашифрован не текущим ключом (keys[0]), fallback — что самый свежий
+// снимок повреждён и восстановлен более старый либо никакой.
+func loadMetricsFromFile(ctx context.Context, path string, keys [][]byte, restore func(context.Context, snapshotFile) error, logger *zap.Logger) (stale, fallback bool, err error) {
+	var lastErr error
+	for _, candidate := range snapshotCandidates(path) {
+		raw, err := os.ReadFile(candidate)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn("Failed to read snapshot", zap.String("path", candidate), zap.Error(err))
+				lastErr = err
+			}
+			continue
+		}
+
+		plain, keyIndex, err := decryptSnapshot(raw, keys)
+		if errors.Is(err, errSnapshotKey) {
+			return false, false, fmt.Errorf("%s: %w", candidate, err)
+		}
+		var snap snapshotFile
+		if err == nil {
+			snap, err = decodeSnapshot(plain)
+		}
+		if err != nil {
+			logger.Warn("Skipping invalid snapshot", zap.String("path", candidate), zap.Error(err))
+			lastErr = err
+			continue
+		}
+
+		if err := restore(ctx, snap); err != nil {
+			return false, false, err
+		}
+		logger.Info("Metrics restored from snapshot", zap.String("path", candidate))
+		return len(keys) > 0 && keyIndex != 0, lastErr != nil, nil
+	}
+
+	if lastErr != nil {
+		return false, true, fmt.Errorf("no valid snapshot found: %w", lastErr)
+	}
+	return false, false, nil
+}
+
+// applySnapshot заменяет содержимое хранилища снимком.
+func applySnapshot(ctx context.Context, snap models.Snapshot, repo storage.Repository) error {
+	return repo.ReplaceAll(ctx, storage.SnapshotUpdates(snap))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Зашифрованный снимок — файл любого формата, целиком зашифрованный
+// AES-GCM:
+//
+//	ADMENC <version:1> <key id:8> <nonce:12> <ciphertext>
+//
+// Идентификатор ключа — первые 8 байт SHA-256 от ключа; по нему при чтении
+// выбирается ключ из списка. Заголовок до nonce входит в AAD.
+const (
+	encryptedMagic   = "ADMENC"
+	encryptedVersion = 1
+	keyIDSize        = 8
+)
+
+// Зашифрованная строка журнала — запись, зашифрованная как снимок, в
+// base64 после префикса walEncryptedPrefix. Незашифрованные строки
+// начинаются с '{' или '['.
+const walEncryptedPrefix = "enc:"
+
+// errSnapshotKey означает, что снимок нельзя расшифровать ни одним из
+// настроенных ключей. В отличие от повреждения снимка, это ошибка
+// конфигурации, и откатываться на более старые снимки при ней нельзя.
+var errSnapshotKey = errors.New("snapshot key mismatch")
+
+// ParseSnapshotKeys разбирает список ключей AES (16, 24 или 32 байта),
+// разделённых запятыми или переводами строк. Кодировка каждого ключа
+// задаётся явно: "hex:<ключ>" или "base64:<ключ>", потому что одна и та же
+// строка может оказаться допустимой в обеих. Первый ключ — текущий,
+// остальные используются только для чтения старых снимков.
+func ParseSnapshotKeys(value string) ([][]byte, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+	})
+
+	keys := make([][]byte, 0, len(fields))
+	for i, field := range fields {
+		encoding, encoded, _ := strings.Cut(field, ":")
+		var key []byte
+		var err error
+		switch encoding {
+		case "hex":
+			key, err = hex.DecodeString(encoded)
+		case "base64":
+			key, err = base64.StdEncoding.DecodeString(encoded)
+		default:
+			return nil, fmt.Errorf("key %d: expected hex:<key> or base64:<key>", i+1)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %d: invalid %s: %w", i+1, encoding, err)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key %d: AES key must be 16, 24 or 32 bytes, got %d", i+1, len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDSize]
+}
+
+// sealer шифрует данные одним ключом; шифр создаётся один раз, чтобы
+// не пересоздавать его для каждой строки журнала.
+type sealer struct {
+	header []byte
+	gcm    cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptedMagic), encryptedVersion)
+	header = append(header, keyID(key)...)
+	return &sealer{header: header, gcm: gcm}, nil
+}
+
+func (s *sealer) seal(data []byte) ([]byte, error) {
+	out := make([]byte, len(s.header)+s.gcm.NonceSize(), len(s.header)+s.gcm.NonceSize()+len(data)+s.gcm.Overhead())
+	copy(out, s.header)
+	nonce := out[len(s.header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.gcm.Seal(out, nonce, data, s.header), nil
+}
+
+func encryptSnapshot(data, key []byte) ([]byte, error) {
+	s, err := newSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(data)
+}
+
+// decryptSnapshot расшифровывает снимок подходящим ключом и возвращает
+// индекс этого ключа. Незашифрованный снимок возвращается как есть с
+// индексом -1.
+func decryptSnapshot(raw []byte, keys [][]byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(raw, []byte(encryptedMagic)) {
+		return raw, -1, nil
+	}
+
+	headerSize := len(encryptedMagic) + 1 + keyIDSize
+	if len(raw) < headerSize {
+		return nil, 0, errors.New("truncated encrypted snapshot")
+	}
+	if version := raw[len(encryptedMagic)]; version != encryptedVersion {
+		return nil, 0, fmt.Errorf("unsupported encrypted snapshot version %d", version)
+	}
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("%w: snapshot is encrypted, but no key is configured", errSnapshotKey)
+	}
+
+	header, id := raw[:headerSize], raw[headerSize-keyIDSize:headerSize]
+	for i, key := range keys {
+		if !bytes.Equal(keyID(key), id) {
+			continue
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		rest := raw[headerSize:]
+		if len(rest) < gcm.NonceSize() {
+			return nil, 0, errors.New("truncated encrypted snapshot")
+		}
+		// Ключ совпал по идентификатору, значит, ошибка — повреждение файла
+		data, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+		if err != nil {
+			return nil, 0, fmt.Errorf("decrypt snapshot: %w", err)
+		}
+		return data, i, nil
+	}
+	return nil, 0, fmt.Errorf("%w: snapshot was encrypted with key %x, which is not configured", errSnapshotKey, id)
+}
+
+func encryptWALLine(data []byte, s *sealer) ([]byte, error) {
+	sealed, err := s.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, len(walEncryptedPrefix)+base64.StdEncoding.EncodedLen(len(sealed)))
+	copy(line, walEncryptedPrefix)
+	base64.StdEncoding.Encode(line[len(walEncryptedPrefix):], sealed)
+	return line, nil
+}
+
+// decryptWALLine возвращает запись строки журнала. Незашифрованная строка
+// возвращается как есть; повреждённая — ошибка errBadWALEntry.
+func decryptWALLine(raw []byte, keys [][]byte) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if !bytes.HasPrefix(raw, []byte(walEncryptedPrefix)) {
+		return raw, nil
+	}
+
+	encoded := raw[len(walEncryptedPrefix):]
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+	n, err := base64.StdEncoding.Decode(sealed, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadWALEntry, err)
+	}
+	data, keyIndex, err := decryptSnapshot(sealed[:n], keys)
+	if errors.Is(err, errSnapshotKey) {
+		return nil, err
+	}
+	if err == nil && keyIndex < 0 {
+		err = errors.New("missing encryption header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadWALEntry, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// syncStorage сохраняет метрики на диск после каждой успешной записи.
+// Используется при STORE_INTERVAL=0. Если сохранить не удалось, изменение
+// остаётся в памяти, а запись возвращает storage.ErrNotPersisted.
+type syncStorage struct {
+	storage.Repository
+	flusher *flusher
+}
+
+func newSyncStorage(repo storage.Repository, flush func() error) *syncStorage {
+	return &syncStorage{
+		Repository: repo,
+		flusher:    newFlusher(flush),
+	}
+}
+
+func (s *syncStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if err := s.Repository.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	if err := s.Repository.UpdateCounter(ctx, name, value); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	if err := s.Repository.UpdateHistogram(ctx, name, h); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	if err := s.Repository.UpdateSet(ctx, name, members); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) UpdateBatch(ctx context.Context, updates []storage.MetricUpdate) error {
+	if err := s.Repository.UpdateBatch(ctx, updates); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) ReplaceAll(ctx context.Context, updates []storage.MetricUpdate) error {
+	if err := s.Repository.ReplaceAll(ctx, updates); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	if err := s.Repository.DeleteMetric(ctx, mType, name); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	if err := s.Repository.DeleteMetricIfStale(ctx, mType, name, before); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) ResetCounter(ctx context.Context, name string) error {
+	if err := s.Repository.ResetCounter(ctx, name); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+func (s *syncStorage) persist() error {
+	if err := s.flusher.Flush(); err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrNotPersisted, err)
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/yadmabramov/admAlerting/internal/handlers"
+	"github.com/yadmabramov/admAlerting/internal/service"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Арендатор — команда со своим пространством метрик. Запрос с ключом API
+// арендатора (заголовок X-API-Key, Authorization: Bearer или пароль Basic
+// авторизации) обслуживается его хранилищем, запрос без ключа — хранилищем
+// по умолчанию. Хранилище арендатора ведётся в том же журнале и снимке,
+// что и хранилище по умолчанию, но не реплицируется и не хранит историю:
+// ведомый перенаправляет запросы арендаторов ведущему.
+const (
+	apiKeyHeader   = "X-API-Key"
+	tenantKeyBytes = 32
+	// Страница арендатора в браузере: /?tenant=<id> запрашивает ключ
+	// через Basic авторизацию
+	tenantQueryParam = "tenant"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+var errTenantExists = errors.New("tenant already exists")
+
+type tenant struct {
+	id string
+	// Хеши ключей API, текущий первым
+	keys []string
+	// Новый ключ выдан, но ещё не сохранён; другая ротация в это время
+	// отклоняется, иначе откат одной из них затёр бы ключ другой
+	rotating bool
+	quota    storage.LimitPolicy
+	storage  *storage.MemoryStorage
+	limits   *storage.LimitedStorage
+	router   http.Handler
+}
+
+// attachTenant строит цепочку хранилищ и маршруты арендатора, чьё
+// хранилище уже заполнено.
+func (s *Server) attachTenant(ctx context.Context, t *tenant) error {
+	var repo storage.Repository = t.storage
+	if s.config.StoreInterval == 0 {
+		repo = newSyncStorage(repo, func() error {
+			return s.saveMetrics(context.Background())
+		})
+	} else if s.wal != nil {
+		repo = s.wal.forTenant(t.storage, t.id)
+	}
+
+	limits, err := storage.NewLimitedStorage(ctx, repo, t.quota)
+	if err != nil {
+		return err
+	}
+	t.limits = limits
+	metricsService := service.NewMetricsService(limits)
+	metricsService.SetConflictPolicy(s.config.TypeConflicts)
+	t.router = s.metricsRouter(handlers.NewMetricsHandler(metricsService), limits)
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKey() (string, error) {
+	key := make([]byte, tenantKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// apiKey извлекает ключ API из запроса.
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+func (s *Server) tenantByKey(key string) *tenant {
+	hash := hashAPIKey(key)
+
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+
+	for _, t := range s.tenants {
+		for _, k := range t.keys {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(hash)) == 1 {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// routeTenant передаёт запрос с ключом API маршрутам арендатора, а запрос
+// без ключа — fallback.
+func (s *Server) routeTenant(fallback http.Handler) http.Handler {
+	var leader http.Handler
+	if s.config.LeaderURL != "" {
+		leader = redirectToLeader(s.config.LeaderURL)(nil)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKey(r)
+		if key == "" {
+			if r.URL.Path == "/" && r.URL.Query().Has(tenantQueryParam) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+				http.Error(w, "API key required", http.StatusUnauthorized)
+				return
+			}
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		if leader != nil {
+			leader.ServeHTTP(w, r)
+			return
+		}
+		t := s.tenantByKey(key)
+		if t == nil {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		t.router.ServeHTTP(w, r)
+	})
+}
+
+// collectTenants возвращает разделы снимка всех арендаторов.
+func (s *Server) collectTenants(ctx context.Context) ([]tenantSnapshot, error) {
+	s.tenantsMu.RLock()
+	defer s.tenantsMu.RUnlock()
+
+	sections := make([]tenantSnapshot, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		snap, err := t.storage.Snapshot(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.id, err)
+		}
+		sections = append(sections, tenantSnapshot{
+			ID:      t.id,
+			Keys:    append([]string(nil), t.keys...),
+			Quota:   t.quota.String(),
+			Metrics: snap,
+		})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].ID < sections[j].ID })
+	return sections, nil
+}
+
+// restoreTenants создаёт арендаторов из разделов снимка; их цепочки хранилищ
+// строит attachTenant после открытия журнала.
+func restoreTenants(ctx context.Context, sections []tenantSnapshot) (map[string]*tenant, error) {
+	tenants := make(map[string]*tenant, len(sections))
+	for _, section := range sections {
+		quota, err := storage.ParseLimitPolicy(section.Quota)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", section.ID, err)
+		}
+		t := &tenant{
+			id:      section.ID,
+			keys:    section.Keys,
+			quota:   quota,
+			storage: storage.NewMemoryStorage(),
+		}
+		if err := applySnapshot(ctx, section.Metrics, t.storage); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", section.ID, err)
+		}
+		tenants[t.id] = t
+	}
+	return tenants, nil
+}
+
+// requireAdmin пропускает только запросы с ключом администратора.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(apiKey(r)), []byte(s.config.AdminKey)) != 1 {
+			http.Error(w, "Invalid admin key", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type tenantInfo struct {
+	ID       string               `json:"id"`
+	Keys     int                  `json:"keys"`
+	Quota    string               `json:"quota,omitempty"`
+	Usage    storage.LimitUsage   `json:"usage"`
+	Prefixes []storage.LimitUsage `json:"prefixes,omitempty"`
+}
+
+type tenantKey struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	s.tenantsMu.RLock()
+	infos := make([]tenantInfo, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		usage, prefixes := t.limits.Usage()
+		infos = append(infos, tenantInfo{
+			ID:       t.id,
+			Keys:     len(t.keys),
+			Quota:    t.quota.String(),
+			Usage:    usage,
+			Prefixes: prefixes,
+		})
+	}
+	s.tenantsMu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleCreateTenant создаёт арендатора и возвращает его ключ API. Ключ
+// показывается только один раз: сервер хранит лишь его хеш. Без явной
+// квоты действуют общие ограничения сервера.
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID    string  `json:"id"`
+		Quota *string `json:"quota"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !tenantIDPattern.MatchString(req.ID) {
+		http.Error(w, "Invalid tenant id", http.StatusBadRequest)
+		return
+	}
+
+	var quota storage.LimitPolicy
+	if req.Quota != nil {
+		var err error
+		if quota, err = storage.ParseLimitPolicy(*req.Quota); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if s.config.MetricLimits != nil {
+		quota = *s.config.MetricLimits
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	t := &tenant{
+		id:      req.ID,
+		keys:    []string{hashAPIKey(key)},
+		quota:   quota,
+		storage: storage.NewMemoryStorage(),
+	}
+	if err := s.attachTenant(ctx, t); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.addTenant(ctx, t); err != nil {
+		if errors.Is(err, errTenantExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("Tenant created", zap.String("tenant", t.id))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tenantKey{ID: t.id, Key: key})
+}
+
+// addTenant регистрирует арендатора и сразу сохраняет снимок, чтобы
+// арендатор и его ключ пережили перезапуск.
+func (s *Server) addTenant(ctx context.Context, t *tenant) error {
+	s.tenantsMu.Lock()
+	if _, ok := s.tenants[t.id]; ok {
+		s.tenantsMu.Unlock()
+		return errTenantExists
+	}
+	s.tenants[t.id] = t
+	s.tenantsMu.Unlock()
+
+	if err := s.saveMetrics(ctx); err != nil {
+		s.tenantsMu.Lock()
+		delete(s.tenants, t.id)
+		s.tenantsMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// handleRotateTenantKey выдаёт арендатору новый ключ. Предыдущий ключ
+// действует до следующей ротации, чтобы клиенты успели перейти на новый;
+// с параметром revoke=true он отзывается сразу. Пока новый ключ не сохранён,
+// повторная ротация того же арендатора получает 409.
+func (s *Server) handleRotateTenantKey(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	revoke := r.URL.Query().Get("revoke") == "true"
+
+	key, err := newAPIKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.tenantsMu.Lock()
+	t, ok := s.tenants[id]
+	if !ok {
+		s.tenantsMu.Unlock()
+		http.Error(w, "Tenant not found", http.StatusNotFound)
+		return
+	}
+	if t.rotating {
+		s.tenantsMu.Unlock()
+		http.Error(w, "Tenant key rotation is already in progress", http.StatusConflict)
+		return
+	}
+	previous := t.keys
+	t.keys = []string{hashAPIKey(key)}
+	if !revoke && len(previous) > 0 {
+		t.keys = append(t.keys, previous[0])
+	}
+	t.rotating = true
+	s.tenantsMu.Unlock()
+
+	err = s.saveMetrics(r.Context())
+	s.tenantsMu.Lock()
+	t.rotating = false
+	if err != nil {
+		t.keys = previous
+	}
+	s.tenantsMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info("Tenant key rotated", zap.String("tenant", id), zap.Bool("revoked", revoke))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tenantKey{ID: id, Key: key})
+}
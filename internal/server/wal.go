@@ -0,0 +1,598 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// wal — журнал упреждающей записи: каждая строка содержит установку gauge,
+// приращение counter или гистограммы, значения множества, удаление или
+// сброс метрики либо массив изменений (пакет). Пакет, первая запись
+// которого replace, заменяет всё содержимое хранилища. Записи
+// синхронизируются с диском группами через flusher. При сохранении снимка
+// текущий сегмент запечатывается в <path>.prev и удаляется после успешной
+// записи снимка. Строки нумеруются по возрастанию; снимок хранит номер
+// последней учтённой в нём строки, и при восстановлении строки с номером
+// не больше него пропускаются. Если задан ключ, каждая строка шифруется
+// им (см. encryptWALLine).
+const (
+	walOpDelete  = "delete"
+	walOpReset   = "reset"
+	walOpReplace = "replace"
+)
+
+// walRecord — запись журнала. Пустой Op означает изменение значения,
+// пустой Tenant — пространство по умолчанию. Номер строки Seq хранится в
+// первой записи пакета; у строк журналов старого формата его нет.
+type walRecord struct {
+	Seq    uint64 `json:"seq,omitempty"`
+	Op     string `json:"op,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+	models.Metrics
+}
+
+type wal struct {
+	path   string
+	sealer *sealer
+
+	// fileMu защищает смену файла и fsync, mu — буфер и нумерацию: запись
+	// в буфер не ждёт синхронизации с диском
+	fileMu sync.Mutex
+	mu     sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	// Номер последней добавленной строки
+	seq uint64
+	// Размер файла до строк в буфере, число байт в буфере и номер последней
+	// строки в файле: после ошибки записи файл обрезается до offset, а
+	// нумерация продолжается с durable
+	offset  int64
+	pending int64
+	durable uint64
+	// Файл не удалось обрезать после ошибки записи
+	torn bool
+	// Ошибка добавления записи, о которой сообщит ближайшая синхронизация
+	err     error
+	flusher *flusher
+}
+
+// openWAL открывает журнал для записи; строки нумеруются начиная с seq+1
+// и шифруются ключом key, если он задан.
+func openWAL(path string, seq uint64, key []byte) (*wal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := trimTornTail(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &wal{
+		path:    path,
+		file:    file,
+		buf:     bufio.NewWriter(file),
+		seq:     seq,
+		offset:  info.Size(),
+		durable: seq,
+	}
+	if key != nil {
+		if w.sealer, err = newSealer(key); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	w.flusher = newFlusher(w.sync)
+	return w, nil
+}
+
+func (w *wal) sealedPath() string {
+	return w.path + ".prev"
+}
+
+// Write добавляет запись (walRecord или []walRecord) в буфер
+// журнала без синхронизации с диском, присваивая ей следующий номер.
+// Ошибку записи вернёт Sync.
+func (w *wal) Write(record any) {
+	// Запись кодируется без номера до блокировки: под ней остаётся только
+	// вставка номера, шифрование и копирование в буфер
+	data, err := json.Marshal(record)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq := w.seq + 1
+	if err == nil {
+		data = withWALSeq(data, seq)
+		if w.sealer != nil {
+			data, err = encryptWALLine(data, w.sealer)
+		}
+	}
+	if err == nil && w.torn {
+		err = w.truncate()
+	}
+	if err == nil {
+		data = append(data, '\n')
+		if _, err = w.buf.Write(data); err != nil {
+			w.discard()
+		}
+	}
+	if err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return
+	}
+	w.seq = seq
+	w.pending += int64(len(data))
+}
+
+// flush дописывает буфер в файл. При ошибке недописанные строки
+// отбрасываются (discard), и журнал остаётся пригодным для записи.
+func (w *wal) flush() error {
+	if w.torn {
+		if err := w.truncate(); err != nil {
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.discard()
+		return err
+	}
+	w.offset += w.pending
+	w.pending = 0
+	w.durable = w.seq
+	return nil
+}
+
+// discard отбрасывает строки, не дописанные в файл после ошибки записи:
+// сбрасывает буфер вместе с его ошибкой, обрезает файл до последней
+// целой строки и возвращает нумерацию к ней.
+func (w *wal) discard() {
+	w.buf.Reset(w.file)
+	w.pending = 0
+	w.seq = w.durable
+	w.torn = true
+	w.truncate()
+}
+
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(w.offset); err != nil {
+		return err
+	}
+	w.torn = false
+	return nil
+}
+
+// withWALSeq вставляет номер строки в первую запись закодированной строки
+// (объекта или массива объектов), записанной без номера.
+func withWALSeq(data []byte, seq uint64) []byte {
+	i := bytes.IndexByte(data, '{')
+	if i < 0 {
+		return data
+	}
+	field := `"seq":` + strconv.FormatUint(seq, 10)
+	if data[i+1] != '}' {
+		field += ","
+	}
+	out := make([]byte, 0, len(data)+len(field))
+	out = append(out, data[:i+1]...)
+	out = append(out, field...)
+	return append(out, data[i+1:]...)
+}
+
+// Seq возвращает номер последней добавленной строки.
+func (w *wal) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// Sync дожидается, пока все ранее записанные записи окажутся на диске.
+func (w *wal) Sync() error {
+	return w.flusher.Flush()
+}
+
+func (w *wal) sync() error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+
+	w.mu.Lock()
+	err := w.flush()
+	if w.err != nil {
+		if err == nil {
+			err = w.err
+		}
+		w.err = nil
+	}
+	w.mu.Unlock()
+
+	if syncErr := w.file.Sync(); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// Rotate запечатывает текущий сегмент. Если предыдущий запечатанный сегмент
+// ещё не удалён (прошлое сохранение снимка не удалось), текущий сегмент
+// дописывается к нему.
+func (w *wal) Rotate() error {
+	w.fileMu.Lock()
+	defer w.fileMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	sealed := w.sealedPath()
+	if _, err := os.Stat(sealed); err == nil {
+		return w.appendToSealed(sealed)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, sealed); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.buf.Reset(file)
+	w.offset = 0
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w *wal) appendToSealed(sealed string) error {
+	if err := trimTornTail(sealed); err != nil {
+		return err
+	}
+	src, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(sealed, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.offset = 0
+	return nil
+}
+
+// trimTornTail отрезает оборванную последнюю строку сегмента, чтобы
+// следующая запись не склеилась с ней.
+func trimTornTail(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for pos := end; pos > 0; {
+		n := int64(len(buf))
+		if n > pos {
+			n = pos
+		}
+		pos -= n
+		if _, err := file.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = pos + int64(i) + 1
+			break
+		}
+		if pos == 0 {
+			end = 0
+		}
+	}
+	if end == info.Size() {
+		return nil
+	}
+	if err := file.Truncate(end); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// DropSealed удаляет запечатанный сегмент после успешного сохранения снимка.
+func (w *wal) DropSealed() error {
+	if err := os.Remove(w.sealedPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *wal) Close() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// replayWAL применяет записи журнала поверх уже восстановленного снимка,
+// пропуская строки с номером не больше after, и возвращает число
+// применённых изменений и номер последней строки. resolve возвращает
+// хранилище арендатора по идентификатору из записи; записи неизвестных
+// арендаторов пропускаются. Оборванная последняя строка (сбой во время
+// записи) игнорируется; повреждённая запись, за которой следуют другие, —
+// ошибка. Пропуск в нумерации строк — ошибка errWALGap: журнал не
+// продолжает восстановленный снимок. С strict ошибкой считаются и строки
+// без номера, которые нельзя проверить на пропуски.
+func replayWAL(ctx context.Context, path string, after uint64, strict bool, keys [][]byte, resolve func(tenant string) storage.Repository) (int, uint64, error) {
+	replay := &walReplay{resolve: resolve, keys: keys, last: after, strict: strict}
+	applied := 0
+	for _, p := range []string{path + ".prev", path} {
+		n, err := replay.file(ctx, p)
+		applied += n
+		if err != nil {
+			return applied, replay.last, fmt.Errorf("replay %s: %w", p, err)
+		}
+	}
+	return applied, replay.last, nil
+}
+
+var errWALGap = errors.New("WAL does not continue the restored snapshot")
+
+type walReplay struct {
+	resolve func(tenant string) storage.Repository
+	// Ключи для зашифрованных строк
+	keys [][]byte
+	// Номер последней применённой строки
+	last   uint64
+	strict bool
+}
+
+// file применяет строки сегмента с номером больше последнего применённого.
+// Строки уже применённых номеров встречаются, если сбой прервал
+// дописывание сегмента к запечатанному.
+func (r *walReplay) file(ctx context.Context, path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	applied := 0
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return applied, err
+		}
+		// Строка без перевода строки в конце файла записана не полностью
+		torn := err == io.EOF
+		if len(bytes.TrimSpace(raw)) == 0 {
+			if torn {
+				return applied, nil
+			}
+			continue
+		}
+
+		n, applyErr := r.line(ctx, raw)
+		if errors.Is(applyErr, errBadWALEntry) && torn {
+			return applied, nil
+		}
+		if applyErr != nil {
+			return applied, fmt.Errorf("line %d: %w", line, applyErr)
+		}
+		applied += n
+		if torn {
+			return applied, nil
+		}
+	}
+}
+
+// line применяет строку журнала к хранилищу её арендатора.
+func (r *walReplay) line(ctx context.Context, raw []byte) (int, error) {
+	raw, err := decryptWALLine(raw, r.keys)
+	if err != nil {
+		return 0, err
+	}
+	if !json.Valid(raw) {
+		return 0, fmt.Errorf("%w: invalid JSON", errBadWALEntry)
+	}
+	head, err := walEntryHead(raw)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case head.Seq == 0:
+		if r.strict {
+			return 0, fmt.Errorf("%w: record has no sequence number", errWALGap)
+		}
+	case head.Seq <= r.last:
+		return 0, nil
+	case head.Seq > r.last+1:
+		return 0, fmt.Errorf("%w: expected record %d, found %d", errWALGap, r.last+1, head.Seq)
+	default:
+		r.last = head.Seq
+	}
+	repo := r.resolve(head.Tenant)
+	if repo == nil {
+		return 0, nil
+	}
+	return applyWALEntry(ctx, raw, repo)
+}
+
+var errBadWALEntry = errors.New("malformed WAL entry")
+
+type walEntryHeader struct {
+	Seq    uint64 `json:"seq"`
+	Tenant string `json:"tenant"`
+}
+
+// walEntryHead возвращает номер строки журнала и арендатора, к которому
+// она относится.
+func walEntryHead(raw []byte) (walEntryHeader, error) {
+	var head walEntryHeader
+	if len(raw) > 0 && raw[0] == '[' {
+		var records []json.RawMessage
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return head, fmt.Errorf("%w: %v", errBadWALEntry, err)
+		}
+		if len(records) == 0 {
+			return head, nil
+		}
+		raw = records[0]
+	}
+	if err := json.Unmarshal(raw, &head); err != nil {
+		return head, fmt.Errorf("%w: %v", errBadWALEntry, err)
+	}
+	return head, nil
+}
+
+// applyWALEntry применяет одну строку журнала — запись или пакет — и
+// возвращает число применённых изменений.
+func applyWALEntry(ctx context.Context, raw []byte, repo storage.Repository) (int, error) {
+	if len(raw) > 0 && raw[0] == '[' {
+		var records []walRecord
+		if err := json.Unmarshal(raw, &records); err != nil {
+			return 0, fmt.Errorf("%w: %v", errBadWALEntry, err)
+		}
+		return applyWALBatch(ctx, records, repo)
+	}
+
+	var record walRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return 0, fmt.Errorf("%w: %v", errBadWALEntry, err)
+	}
+	if err := applyWALRecord(ctx, record, repo); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func applyWALBatch(ctx context.Context, records []walRecord, repo storage.Repository) (int, error) {
+	replace := len(records) > 0 && records[0].Op == walOpReplace
+	if replace {
+		records = records[1:]
+	}
+
+	updates := make([]storage.MetricUpdate, 0, len(records))
+	for _, r := range records {
+		u, err := storage.UpdateFromMetric(r.Metrics)
+		if err != nil {
+			return 0, err
+		}
+		updates = append(updates, u)
+	}
+	apply := repo.UpdateBatch
+	if replace {
+		apply = repo.ReplaceAll
+	}
+	if err := apply(ctx, updates); err != nil {
+		return 0, err
+	}
+	return len(updates), nil
+}
+
+func applyWALRecord(ctx context.Context, r walRecord, repo storage.Repository) error {
+	var err error
+	switch r.Op {
+	case walOpDelete:
+		err = repo.DeleteMetric(ctx, r.MType, r.ID)
+	case walOpReset:
+		err = repo.ResetCounter(ctx, r.ID)
+	default:
+		_, err = applyWALBatch(ctx, []walRecord{r}, repo)
+	}
+	// Метрика могла отсутствовать в снимке, с которого начато восстановление
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func removeWAL(path string) error {
+	for _, p := range []string{path + ".prev", path} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setAsideWAL переименовывает сегменты журнала, который не удалось
+// воспроизвести, чтобы следующее сохранение снимка их не удалило.
+func setAsideWAL(path string, now time.Time) ([]string, error) {
+	var kept []string
+	suffix := ".broken-" + now.UTC().Format("20060102T150405")
+	for _, p := range []string{path + ".prev", path} {
+		if err := os.Rename(p, p+suffix); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return kept, err
+		}
+		kept = append(kept, p+suffix)
+	}
+	return kept, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
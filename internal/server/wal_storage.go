@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// walStorage дожидается записи каждого изменения в журнал до ответа
+// клиенту. Записи журнала добавляет наблюдатель хранилища в памяти под
+// блокировкой шарда изменения, поэтому изменения одной метрики попадают в
+// журнал в порядке применения. Блокировка mu гарантирует, что снимок и
+// запечатывание журнала происходят атомарно относительно изменений.
+// Хранилища арендаторов пишут в тот же журнал под той же блокировкой,
+// помечая записи идентификатором арендатора.
+type walStorage struct {
+	storage.Repository
+	wal    *wal
+	tenant string
+	mu     *sync.RWMutex
+}
+
+// newWALStorage журналирует изменения mem, которые вносятся через repo.
+func newWALStorage(repo storage.Repository, mem *storage.MemoryStorage, wal *wal) *walStorage {
+	s := &walStorage{
+		Repository: repo,
+		wal:        wal,
+		mu:         new(sync.RWMutex),
+	}
+	mem.Observe(s.record)
+	return s
+}
+
+// forTenant возвращает журналирующее хранилище арендатора tenant.
+func (s *walStorage) forTenant(mem *storage.MemoryStorage, tenant string) *walStorage {
+	t := &walStorage{
+		Repository: mem,
+		wal:        s.wal,
+		tenant:     tenant,
+		mu:         s.mu,
+	}
+	mem.Observe(t.record)
+	return t
+}
+
+// record пишет изменения в журнал одной записью.
+func (s *walStorage) record(changes []storage.Change) {
+	if entry := walEntry(changes, s.tenant); entry != nil {
+		s.wal.Write(entry)
+	}
+}
+
+// walEntry преобразует изменения в запись журнала. Пакет становится одной
+// записью []walRecord, чтобы при восстановлении он применился целиком
+// либо не применился вовсе; пакет, первая запись которого replace,
+// заменяет всё содержимое хранилища.
+func walEntry(changes []storage.Change, tenant string) any {
+	records := make([]walRecord, 0, len(changes))
+	for _, c := range changes {
+		r := walRecord{Tenant: tenant}
+		switch c.Op {
+		case storage.OpUpdate:
+			r.Metrics = storage.MetricFromUpdate(c.Update)
+		case storage.OpDelete:
+			r.Op = walOpDelete
+			r.Metrics = models.Metrics{ID: c.Update.Name, MType: c.Update.MType}
+		case storage.OpReset:
+			r.Op = walOpReset
+			r.Metrics = models.Metrics{ID: c.Update.Name, MType: storage.TypeCounter}
+		case storage.OpReplace:
+			r.Op = walOpReplace
+		}
+		records = append(records, r)
+	}
+
+	switch {
+	case len(records) == 1 && records[0].Op != walOpReplace:
+		return records[0]
+	case len(records) > 0:
+		return records
+	}
+	return nil
+}
+
+func (s *walStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return s.apply(func() error {
+		return s.Repository.UpdateGauge(ctx, name, value)
+	})
+}
+
+func (s *walStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return s.apply(func() error {
+		return s.Repository.UpdateCounter(ctx, name, value)
+	})
+}
+
+func (s *walStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	return s.apply(func() error {
+		return s.Repository.UpdateHistogram(ctx, name, h)
+	})
+}
+
+func (s *walStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	return s.apply(func() error {
+		return s.Repository.UpdateSet(ctx, name, members)
+	})
+}
+
+func (s *walStorage) UpdateBatch(ctx context.Context, updates []storage.MetricUpdate) error {
+	return s.apply(func() error {
+		return s.Repository.UpdateBatch(ctx, updates)
+	})
+}
+
+func (s *walStorage) ReplaceAll(ctx context.Context, updates []storage.MetricUpdate) error {
+	return s.apply(func() error {
+		return s.Repository.ReplaceAll(ctx, updates)
+	})
+}
+
+func (s *walStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	return s.apply(func() error {
+		return s.Repository.DeleteMetric(ctx, mType, name)
+	})
+}
+
+func (s *walStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	return s.apply(func() error {
+		return s.Repository.DeleteMetricIfStale(ctx, mType, name, before)
+	})
+}
+
+func (s *walStorage) ResetCounter(ctx context.Context, name string) error {
+	return s.apply(func() error {
+		return s.Repository.ResetCounter(ctx, name)
+	})
+}
+
+// apply выполняет изменение вне запечатывания журнала и дожидается
+// синхронизации журнала.
+func (s *walStorage) apply(change func() error) error {
+	s.mu.RLock()
+	err := change()
+	s.mu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("%w: %v", storage.ErrNotPersisted, err)
+	}
+	return nil
+}
+
+// checkpoint выполняет collect, пока записи в журнал остановлены, и
+// запечатывает соответствующий собранному срезу сегмент журнала. Возвращает
+// номер последней строки журнала, учтённой в срезе.
+func (s *walStorage) checkpoint(collect func() error) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := collect(); err != nil {
+		return 0, err
+	}
+	seq := s.wal.Seq()
+	return seq, s.wal.Rotate()
+}
+
+// commit удаляет запечатанный сегмент после успешной записи снимка.
+func (s *walStorage) commit() error {
+	return s.wal.DropSealed()
+}
+
+func (s *walStorage) close() error {
+	return s.wal.Close()
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Лента изменений — ответ GET /api/v1/watch в формате JSON lines: каждая
+// строка — storage.Event, пустые строки — heartbeat. Параметры epoch и
+// from продолжают ленту с события с этим номером той же эпохи; если эпоха
+// сменилась (сервер перезапущен) или событие уже не хранится, ответ — 410,
+// и клиенту нужно заново прочитать метрики. slow=drop|disconnect задаёт
+// поведение при медленном клиенте (по умолчанию disconnect: клиент
+// переподключается с номером следующего события и ничего не теряет).
+const watchPath = "/api/v1/watch"
+
+const (
+	watchBuffer    = 1024
+	watchHeartbeat = 5 * time.Second
+)
+
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	var from uint64
+	if value := r.URL.Query().Get("from"); value != "" {
+		var err error
+		if from, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	policy := storage.SlowDisconnect
+	if value := r.URL.Query().Get("slow"); value != "" {
+		var err error
+		if policy, err = storage.ParseSlowPolicy(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	epoch := r.URL.Query().Get("epoch")
+	sub, err := s.feed.Subscribe(r.Context(), epoch, from, watchBuffer, policy)
+	if err != nil {
+		if errors.Is(err, storage.ErrFeedTruncated) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		s.logger.Error("Watch stream requires flushing", zap.Error(err))
+		return
+	}
+	encoder := json.NewEncoder(w)
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			for more := true; more; {
+				if !ok {
+					if sub.Err() != nil {
+						s.logger.Warn("Watcher is too slow, stream closed", zap.String("remote", r.RemoteAddr))
+					}
+					return
+				}
+				if err := encoder.Encode(event); err != nil {
+					return
+				}
+				select {
+				case event, ok = <-sub.C:
+				default:
+					more = false
+				}
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
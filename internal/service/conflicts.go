@@ -0,0 +1,360 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+var ErrTypeConflict = errors.New("metric type conflict")
+
+// TypeConflictError сообщает, что имя уже занято метрикой другого типа.
+// errors.Is(err, ErrTypeConflict) для неё истинно.
+type TypeConflictError struct {
+	Name     string
+	MType    string
+	Existing []string
+}
+
+func (e *TypeConflictError) Error() string {
+	return fmt.Sprintf("cannot update %s %q: name is already used by %s", e.MType, e.Name, strings.Join(e.Existing, ", "))
+}
+
+func (e *TypeConflictError) Is(target error) bool {
+	return target == ErrTypeConflict
+}
+
+// Политики для имени, которое записывается под другим типом.
+const (
+	// ConflictAllow хранит метрики разных типов с одним именем независимо
+	ConflictAllow = "allow"
+	// ConflictReject отклоняет запись с ошибкой *TypeConflictError
+	ConflictReject = "reject"
+	// ConflictMigrate записывает метрику и удаляет метрики того же имени
+	// других типов: имя переходит к новому типу
+	ConflictMigrate = "migrate"
+)
+
+// ParseConflictPolicy проверяет название политики; пустое значение —
+// ConflictAllow.
+func ParseConflictPolicy(value string) (string, error) {
+	switch value {
+	case "":
+		return ConflictAllow, nil
+	case ConflictAllow, ConflictReject, ConflictMigrate:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid type conflict policy %q: expected allow, reject or migrate", value)
+}
+
+// Наибольшее число имён в учёте конфликтов: при переполнении вытесняется
+// имя, конфликт которого случился раньше всех
+const maxRecordedConflicts = 1024
+
+// Число блокировок, между которыми распределяются имена: проверка типа и
+// запись одного имени не должны пересекаться с записью того же имени
+// под другим типом
+const conflictStripes = 64
+
+// TypeConflict — имя, которое хранится под несколькими типами или
+// которое пытались записать под другим типом.
+type TypeConflict struct {
+	Name string `json:"name"`
+	// Типы, под которыми имя хранится сейчас, если их больше одного
+	Types    []string `json:"types,omitempty"`
+	Rejected int64    `json:"rejected,omitempty"`
+	Migrated int64    `json:"migrated,omitempty"`
+}
+
+// ConflictGuard применяет политику конфликтов типов и ведёт учёт
+// конфликтов. Сервисы, пишущие в одно пространство метрик, должны
+// использовать один ConflictGuard: иначе проверка и запись одного имени
+// через разные сервисы не исключают друг друга, а учёт расходится.
+type ConflictGuard struct {
+	policy      string
+	nameLocks   [conflictStripes]sync.Mutex
+	conflictsMu sync.Mutex
+	// Учтённые конфликты по имени и их порядок от последнего к давнему
+	conflicts map[string]*list.Element
+	recent    *list.List
+}
+
+// NewConflictGuard создаёт защиту с политикой policy; пустая политика —
+// ConflictAllow.
+func NewConflictGuard(policy string) *ConflictGuard {
+	if policy == "" {
+		policy = ConflictAllow
+	}
+	return &ConflictGuard{policy: policy}
+}
+
+// SetConflictPolicy задаёт сервису собственную политику конфликтов типов;
+// по умолчанию действует ConflictAllow.
+func (s *MetricsService) SetConflictPolicy(policy string) {
+	s.conflicts = NewConflictGuard(policy)
+}
+
+// SetConflictGuard подключает защиту, общую с другими сервисами того же
+// пространства метрик.
+func (s *MetricsService) SetConflictGuard(g *ConflictGuard) {
+	s.conflicts = g
+}
+
+// SetConflictScope ограничивает проверку конфликтов именами, для которых
+// owns истинно; остальные имена проверяет тот, кто их записывает. Так
+// сервис кластера не держит блокировки имён, пока пересылает их узлам-
+// владельцам, которые захватывают те же блокировки у себя.
+func (s *MetricsService) SetConflictScope(owns func(name string) bool) {
+	s.conflictScope = owns
+}
+
+func (s *MetricsService) guard(ctx context.Context, keys []storage.MetricKey, apply func() error) error {
+	if s.conflictScope != nil {
+		var owned []storage.MetricKey
+		for _, key := range keys {
+			if s.conflictScope(key.Name) {
+				owned = append(owned, key)
+			}
+		}
+		if len(owned) == 0 {
+			return apply()
+		}
+		keys = owned
+	}
+	return s.conflicts.guard(ctx, s.storage, keys, apply)
+}
+
+// guard выполняет apply по правилам политики конфликтов для метрик keys
+// хранилища repo.
+func (g *ConflictGuard) guard(ctx context.Context, repo storage.Repository, keys []storage.MetricKey, apply func() error) error {
+	if g.policy == ConflictAllow {
+		return apply()
+	}
+
+	unlock := g.lockNames(keys)
+	defer unlock()
+
+	types, names, err := g.batchTypes(keys)
+	if err != nil {
+		return err
+	}
+
+	var stale []storage.MetricKey
+	for _, name := range names {
+		existing, err := storedTypes(ctx, repo, name, types[name])
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			continue
+		}
+		if g.policy == ConflictReject {
+			g.recordConflict(name, 1, 0)
+			return &TypeConflictError{Name: name, MType: types[name], Existing: existing}
+		}
+		for _, mType := range existing {
+			stale = append(stale, storage.MetricKey{MType: mType, Name: name})
+		}
+	}
+
+	// Изменение, применённое без сохранения, всё равно заняло имя: старые
+	// типы удаляются и в этом случае
+	err = apply()
+	if err != nil && !errors.Is(err, storage.ErrNotPersisted) {
+		return err
+	}
+	for _, key := range stale {
+		delErr := repo.DeleteMetric(ctx, key.MType, key.Name)
+		if delErr != nil && !errors.Is(delErr, storage.ErrNotFound) && !errors.Is(delErr, storage.ErrNotPersisted) {
+			return errors.Join(err, fmt.Errorf("migrate %s %q: %w", key.MType, key.Name, delErr))
+		}
+		if err == nil && errors.Is(delErr, storage.ErrNotPersisted) {
+			err = delErr
+		}
+		g.recordConflict(key.Name, 0, 1)
+	}
+	return err
+}
+
+// guardReplace выполняет apply, заменяющее всё содержимое хранилища
+// метриками keys: с текущим содержимым они не сравниваются, но одно имя
+// не может быть записано под разными типами. На время замены
+// блокируются все имена.
+func (g *ConflictGuard) guardReplace(keys []storage.MetricKey, apply func() error) error {
+	if g.policy == ConflictAllow {
+		return apply()
+	}
+
+	for i := range g.nameLocks {
+		g.nameLocks[i].Lock()
+	}
+	defer func() {
+		for i := range g.nameLocks {
+			g.nameLocks[i].Unlock()
+		}
+	}()
+
+	if _, _, err := g.batchTypes(keys); err != nil {
+		return err
+	}
+	return apply()
+}
+
+// batchTypes возвращает тип каждого имени keys и имена в порядке первого
+// появления. Пакет, который сам записывает имя под разными типами,
+// — конфликт при любой политике, кроме ConflictAllow.
+func (g *ConflictGuard) batchTypes(keys []storage.MetricKey) (map[string]string, []string, error) {
+	types := make(map[string]string, len(keys))
+	var names []string
+	for _, key := range keys {
+		mType, ok := types[key.Name]
+		if !ok {
+			types[key.Name] = key.MType
+			names = append(names, key.Name)
+			continue
+		}
+		if mType != key.MType {
+			g.recordConflict(key.Name, 1, 0)
+			return nil, nil, &TypeConflictError{Name: key.Name, MType: key.MType, Existing: []string{mType}}
+		}
+	}
+	return types, names, nil
+}
+
+// lockNames захватывает блокировки имён keys в порядке возрастания номеров,
+// чтобы пакеты не блокировали друг друга взаимно.
+func (g *ConflictGuard) lockNames(keys []storage.MetricKey) func() {
+	var stripes []int
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key.Name))
+		stripe := int(h.Sum32() % conflictStripes)
+		if !seen[stripe] {
+			seen[stripe] = true
+			stripes = append(stripes, stripe)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, stripe := range stripes {
+		g.nameLocks[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			g.nameLocks[stripe].Unlock()
+		}
+	}
+}
+
+// storedTypes возвращает типы, отличные от mType, под которыми хранится name.
+func storedTypes(ctx context.Context, repo storage.Repository, name, mType string) ([]string, error) {
+	var existing []string
+	for _, t := range []string{storage.TypeGauge, storage.TypeCounter, storage.TypeHistogram, storage.TypeSet} {
+		if t == mType {
+			continue
+		}
+		var err error
+		switch t {
+		case storage.TypeGauge:
+			_, err = repo.GetGauge(ctx, name)
+		case storage.TypeCounter:
+			_, err = repo.GetCounter(ctx, name)
+		case storage.TypeHistogram:
+			_, err = repo.GetHistogram(ctx, name)
+		case storage.TypeSet:
+			_, err = repo.GetSet(ctx, name)
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing = append(existing, t)
+	}
+	return existing, nil
+}
+
+func (g *ConflictGuard) recordConflict(name string, rejected, migrated int64) {
+	g.conflictsMu.Lock()
+	defer g.conflictsMu.Unlock()
+
+	if g.conflicts == nil {
+		g.conflicts = make(map[string]*list.Element)
+		g.recent = list.New()
+	}
+	e, ok := g.conflicts[name]
+	if ok {
+		g.recent.MoveToFront(e)
+	} else {
+		e = g.recent.PushFront(&TypeConflict{Name: name})
+		g.conflicts[name] = e
+		if g.recent.Len() > maxRecordedConflicts {
+			oldest := g.recent.Back()
+			g.recent.Remove(oldest)
+			delete(g.conflicts, oldest.Value.(*TypeConflict).Name)
+		}
+	}
+	c := e.Value.(*TypeConflict)
+	c.Rejected += rejected
+	c.Migrated += migrated
+}
+
+// TypeConflicts возвращает действующую политику и конфликты по
+// возрастанию имён: имена, хранящиеся под несколькими типами, и имена,
+// запись которых отклонялась или переносилась с начала работы сервера
+// (не более maxRecordedConflicts последних).
+func (s *MetricsService) TypeConflicts(ctx context.Context) (string, []TypeConflict, error) {
+	snap, err := s.storage.Snapshot(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stored := make(map[string][]string)
+	for name := range snap.Gauges {
+		stored[name] = append(stored[name], storage.TypeGauge)
+	}
+	for name := range snap.Counters {
+		stored[name] = append(stored[name], storage.TypeCounter)
+	}
+	for name := range snap.Histograms {
+		stored[name] = append(stored[name], storage.TypeHistogram)
+	}
+	for name := range snap.Sets {
+		stored[name] = append(stored[name], storage.TypeSet)
+	}
+
+	byName := make(map[string]TypeConflict)
+	for name, types := range stored {
+		if len(types) > 1 {
+			byName[name] = TypeConflict{Name: name, Types: types}
+		}
+	}
+	g := s.conflicts
+	g.conflictsMu.Lock()
+	for name, e := range g.conflicts {
+		c := e.Value.(*TypeConflict)
+		conflict := byName[name]
+		conflict.Name = name
+		conflict.Rejected = c.Rejected
+		conflict.Migrated = c.Migrated
+		byName[name] = conflict
+	}
+	g.conflictsMu.Unlock()
+
+	conflicts := make([]TypeConflict, 0, len(byName))
+	for _, c := range byName {
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+
+	return g.policy, conflicts, nil
+}
@@ -1,44 +1,252 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
+	"github.com/yadmabramov/admAlerting/internal/history"
+	"github.com/yadmabramov/admAlerting/internal/models"
 	"github.com/yadmabramov/admAlerting/internal/storage"
 )
 
+var ErrInvalidValue = errors.New("invalid metric value")
+
 type MetricsService struct {
-	storage storage.Repository
+	storage       storage.Repository
+	history       *history.History
+	conflicts     *ConflictGuard
+	conflictScope func(name string) bool
 }
 
 func NewMetricsService(storage storage.Repository) *MetricsService {
-	return &MetricsService{storage: storage}
+	return &MetricsService{storage: storage, conflicts: NewConflictGuard(ConflictAllow)}
+}
+
+// SetHistory подключает историю значений для запросов GetValueAt.
+func (s *MetricsService) SetHistory(h *history.History) {
+	s.history = h
 }
 
-func (s *MetricsService) UpdateGauge(name string, value string) error {
+func (s *MetricsService) UpdateGauge(ctx context.Context, name string, value string) error {
 	floatValue, err := strconv.ParseFloat(value, 64)
 	if err != nil {
-		return fmt.Errorf("invalid gauge value: %w", err)
+		return fmt.Errorf("%w: invalid gauge value: %v", ErrInvalidValue, err)
 	}
-	return s.storage.UpdateGauge(name, floatValue)
+	return s.guard(ctx, []storage.MetricKey{{MType: storage.TypeGauge, Name: name}}, func() error {
+		return s.storage.UpdateGauge(ctx, name, floatValue)
+	})
 }
 
-func (s *MetricsService) UpdateCounter(name string, value string) error {
+func (s *MetricsService) UpdateCounter(ctx context.Context, name string, value string) error {
 	intValue, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		return fmt.Errorf("invalid counter value: %w", err)
+		return fmt.Errorf("%w: invalid counter value: %v", ErrInvalidValue, err)
+	}
+	return s.guard(ctx, []storage.MetricKey{{MType: storage.TypeCounter, Name: name}}, func() error {
+		return s.storage.UpdateCounter(ctx, name, intValue)
+	})
+}
+
+// UpdateHistogram добавляет наблюдения к гистограмме. Некорректная
+// гистограмма или несовпадение границ корзин возвращают ErrInvalidValue.
+func (s *MetricsService) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	err := s.guard(ctx, []storage.MetricKey{{MType: storage.TypeHistogram, Name: name}}, func() error {
+		return s.storage.UpdateHistogram(ctx, name, h)
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidUpdate) {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateSet добавляет значения во множество set-метрики.
+func (s *MetricsService) UpdateSet(ctx context.Context, name string, members []string) error {
+	if len(members) == 0 {
+		return fmt.Errorf("%w: no set members", ErrInvalidValue)
+	}
+	return s.guard(ctx, []storage.MetricKey{{MType: storage.TypeSet, Name: name}}, func() error {
+		return s.storage.UpdateSet(ctx, name, members)
+	})
+}
+
+// UpdateBatch проверяет все метрики и применяет их одним пакетом.
+// При ошибках валидации возвращается *storage.BatchError с ошибкой для
+// каждого некорректного элемента.
+func (s *MetricsService) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	updates := make([]storage.MetricUpdate, 0, len(metrics))
+	var batchErr storage.BatchError
+	for i, m := range metrics {
+		u, err := storage.UpdateFromMetric(m)
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, storage.ItemError{Index: i, Name: m.ID, Err: err})
+			continue
+		}
+		updates = append(updates, u)
+	}
+	if len(batchErr.Items) > 0 {
+		return &batchErr
+	}
+
+	keys := make([]storage.MetricKey, 0, len(updates))
+	for _, u := range updates {
+		keys = append(keys, storage.MetricKey{MType: u.MType, Name: u.Name})
+	}
+	return s.guard(ctx, keys, func() error {
+		return s.storage.UpdateBatch(ctx, updates)
+	})
+}
+
+func (s *MetricsService) DeleteMetric(ctx context.Context, mType, name string) error {
+	switch mType {
+	case storage.TypeGauge, storage.TypeCounter, storage.TypeHistogram, storage.TypeSet:
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidValue, mType)
+	}
+	return s.storage.DeleteMetric(ctx, mType, name)
+}
+
+// ResetCounter обнуляет значение counter, не удаляя саму метрику.
+func (s *MetricsService) ResetCounter(ctx context.Context, mType, name string) error {
+	if mType != storage.TypeCounter {
+		return fmt.Errorf("%w: only counters can be reset", ErrInvalidValue)
+	}
+	return s.storage.ResetCounter(ctx, name)
+}
+
+// Методы чтения возвращают ошибку, для которой errors.Is(err,
+// storage.ErrNotFound) истинно, если метрики нет.
+
+func (s *MetricsService) GetGauge(ctx context.Context, name string) (float64, error) {
+	return s.storage.GetGauge(ctx, name)
+}
+
+func (s *MetricsService) GetCounter(ctx context.Context, name string) (int64, error) {
+	return s.storage.GetCounter(ctx, name)
+}
+
+// GetValueAt возвращает последнее значение gauge или counter, записанное не
+// позже at. Если история не ведётся или не доходит до at, возвращается
+// ошибка history.ErrOutsideRetention.
+func (s *MetricsService) GetValueAt(ctx context.Context, mType, name string, at time.Time) (history.AsOf, error) {
+	if err := ctx.Err(); err != nil {
+		return history.AsOf{}, err
+	}
+	switch mType {
+	case storage.TypeGauge, storage.TypeCounter:
+	case storage.TypeHistogram, storage.TypeSet:
+		return history.AsOf{}, fmt.Errorf("%w: history is not kept for %s metrics", ErrInvalidValue, mType)
+	default:
+		return history.AsOf{}, fmt.Errorf("%w: unknown type %q", ErrInvalidValue, mType)
+	}
+	if s.history == nil {
+		return history.AsOf{}, fmt.Errorf("%w: history is disabled", history.ErrOutsideRetention)
+	}
+
+	v, err := s.history.At(mType, name, at)
+	if errors.Is(err, history.ErrNotFound) {
+		return history.AsOf{}, &storage.NotFoundError{MType: mType, Name: name}
+	}
+	return v, err
+}
+
+func (s *MetricsService) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	return s.storage.GetHistogram(ctx, name)
+}
+
+func (s *MetricsService) GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error) {
+	return s.storage.GetAllHistograms(ctx)
+}
+
+// GetSetCardinality возвращает оценку числа уникальных значений множества.
+func (s *MetricsService) GetSetCardinality(ctx context.Context, name string) (int64, error) {
+	sketch, err := s.storage.GetSet(ctx, name)
+	if err != nil {
+		return 0, err
 	}
-	return s.storage.UpdateCounter(name, intValue)
+	return int64(sketch.Estimate()), nil
 }
 
-func (s *MetricsService) GetGauge(name string) (float64, bool) {
-	return s.storage.GetGauge(name)
+// AllMetrics — все метрики одного снимка хранилища; множества
+// представлены оценкой числа уникальных значений.
+type AllMetrics struct {
+	Gauges     map[string]float64
+	Counters   map[string]int64
+	Histograms map[string]models.Histogram
+	Sets       map[string]int64
 }
 
-func (s *MetricsService) GetCounter(name string) (int64, bool) {
-	return s.storage.GetCounter(name)
+func (s *MetricsService) GetAll(ctx context.Context) (AllMetrics, error) {
+	snap, err := s.storage.Snapshot(ctx)
+	if err != nil {
+		return AllMetrics{}, err
+	}
+
+	sets := make(map[string]int64, len(snap.Sets))
+	for name, sketch := range snap.Sets {
+		sets[name] = int64(sketch.Estimate())
+	}
+	return AllMetrics{
+		Gauges:     snap.Gauges,
+		Counters:   snap.Counters,
+		Histograms: snap.Histograms,
+		Sets:       sets,
+	}, nil
+}
+
+func (s *MetricsService) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	return s.storage.GetAllMetrics(ctx)
+}
+
+// Режимы импорта снимка.
+const (
+	// ImportReplace делает хранилище равным снимку: counter получает
+	// значение из снимка, метрики, которых в снимке нет, удаляются.
+	ImportReplace = "replace"
+	// ImportMerge добавляет снимок к текущим данным: counter суммируются,
+	// gauge перезаписываются, гистограммы и множества объединяются.
+	ImportMerge = "merge"
+)
+
+// ExportSnapshot возвращает согласованный снимок всех метрик.
+func (s *MetricsService) ExportSnapshot(ctx context.Context) (models.Snapshot, error) {
+	return s.storage.Snapshot(ctx)
 }
 
-func (s *MetricsService) GetAllMetrics() (map[string]float64, map[string]int64) {
-	return s.storage.GetAllMetrics()
+// ImportSnapshot применяет снимок в режиме ImportReplace или ImportMerge.
+// Снимок применяется атомарно; несовпадение границ гистограмм в режиме
+// merge возвращает ErrInvalidValue.
+func (s *MetricsService) ImportSnapshot(ctx context.Context, snap models.Snapshot, mode string) error {
+	updates := storage.SnapshotUpdates(snap)
+	keys := make([]storage.MetricKey, 0, len(updates))
+	for _, u := range updates {
+		keys = append(keys, storage.MetricKey{MType: u.MType, Name: u.Name})
+	}
+
+	var err error
+	switch mode {
+	case ImportReplace:
+		err = s.conflicts.guardReplace(keys, func() error {
+			return s.storage.ReplaceAll(ctx, updates)
+		})
+	case ImportMerge:
+		err = s.guard(ctx, keys, func() error {
+			return s.storage.UpdateBatch(ctx, updates)
+		})
+	default:
+		return fmt.Errorf("%w: unknown import mode %q", ErrInvalidValue, mode)
+	}
+
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidUpdate) {
+			return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+		}
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+const (
+	TypeGauge     = "gauge"
+	TypeCounter   = "counter"
+	TypeHistogram = "histogram"
+	TypeSet       = "set"
+)
+
+var ErrInvalidUpdate = errors.New("invalid metric update")
+
+// MetricUpdate — одно изменение в пакете: для gauge используется Value,
+// для counter — Delta, для histogram — Histogram, для set — Members
+// и/или Sketch, который сливается с сохранённым.
+type MetricUpdate struct {
+	MType     string
+	Name      string
+	Value     float64
+	Delta     int64
+	Histogram *models.Histogram
+	Members   []string
+	Sketch    *hll.Sketch
+}
+
+type ItemError struct {
+	Index int
+	Name  string
+	Err   error
+}
+
+// BatchError перечисляет ошибки отдельных элементов пакета. Если она
+// возвращена, ни одно изменение из пакета не применено.
+type BatchError struct {
+	Items []ItemError
+}
+
+func (e *BatchError) Error() string {
+	parts := make([]string, 0, len(e.Items))
+	for _, item := range e.Items {
+		parts = append(parts, fmt.Sprintf("#%d %s: %v", item.Index, item.Name, item.Err))
+	}
+	return "batch rejected: " + strings.Join(parts, "; ")
+}
+
+func (e *BatchError) Unwrap() error {
+	return ErrInvalidUpdate
+}
+
+func ValidateUpdate(u MetricUpdate) error {
+	if u.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidUpdate)
+	}
+	switch u.MType {
+	case TypeGauge, TypeCounter:
+	case TypeHistogram:
+		if u.Histogram == nil {
+			return fmt.Errorf("%w: histogram is required", ErrInvalidUpdate)
+		}
+		if err := u.Histogram.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+		}
+	case TypeSet:
+		if len(u.Members) == 0 && u.Sketch == nil {
+			return fmt.Errorf("%w: members or sketch are required for set", ErrInvalidUpdate)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidUpdate, u.MType)
+	}
+	return nil
+}
+
+// ValidateBatch проверяет все элементы пакета и возвращает *BatchError,
+// если хотя бы один из них некорректен.
+func ValidateBatch(updates []MetricUpdate) error {
+	var batchErr BatchError
+	for i, u := range updates {
+		if err := ValidateUpdate(u); err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Name: u.Name, Err: err})
+		}
+	}
+	if len(batchErr.Items) > 0 {
+		return &batchErr
+	}
+	return nil
+}
+
+// UpdateFromMetric преобразует JSON-модель метрики в изменение хранилища.
+// Метки метрики входят в ключ хранения (см. models.SeriesKey).
+func UpdateFromMetric(m models.Metrics) (MetricUpdate, error) {
+	u := MetricUpdate{MType: m.MType, Name: models.SeriesKey(m.ID, m.Labels)}
+	if m.ID == "" {
+		return u, fmt.Errorf("%w: empty name", ErrInvalidUpdate)
+	}
+	if err := models.ValidateLabels(m.Labels); err != nil {
+		return u, fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+	}
+	switch m.MType {
+	case TypeGauge:
+		if m.Value == nil {
+			return u, fmt.Errorf("%w: value is required for gauge", ErrInvalidUpdate)
+		}
+		u.Value = *m.Value
+	case TypeCounter:
+		if m.Delta == nil {
+			return u, fmt.Errorf("%w: delta is required for counter", ErrInvalidUpdate)
+		}
+		u.Delta = *m.Delta
+	case TypeHistogram:
+		u.Histogram = m.Histogram
+	case TypeSet:
+		u.Members = m.Members
+		u.Sketch = m.Sketch
+	}
+	return u, ValidateUpdate(u)
+}
+
+func MetricFromUpdate(u MetricUpdate) models.Metrics {
+	m := models.Metrics{ID: u.Name, MType: u.MType}
+	switch u.MType {
+	case TypeGauge:
+		value := u.Value
+		m.Value = &value
+	case TypeCounter:
+		delta := u.Delta
+		m.Delta = &delta
+	case TypeHistogram:
+		m.Histogram = u.Histogram
+	case TypeSet:
+		m.Members = u.Members
+		m.Sketch = u.Sketch
+	}
+	return m
+}
@@ -0,0 +1,46 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yadmabramov/admAlerting/internal/storage"
+	"github.com/yadmabramov/admAlerting/internal/storage/storagetest"
+)
+
+func TestMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestSingleShardMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewShardedMemoryStorage(1)
+	})
+}
+
+func TestLimitedStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		s, err := storage.NewLimitedStorage(context.Background(), storage.NewMemoryStorage(),
+			storage.LimitPolicy{Global: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestObservedMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		s := storage.NewMemoryStorage()
+		s.Observe(storage.NewFeed(100).Observe)
+		return s
+	})
+}
+
+func TestMockStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewMockStorage()
+	})
+}
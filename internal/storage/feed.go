@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+var (
+	// ErrSlowConsumer — подписка закрыта, потому что подписчик не успевал
+	// забирать события
+	ErrSlowConsumer = errors.New("subscriber is too slow")
+	// ErrFeedTruncated — события с запрошенного номера уже не хранятся;
+	// подписчику нужно заново прочитать хранилище целиком
+	ErrFeedTruncated = errors.New("change feed position is no longer available")
+)
+
+// Виды событий ленты изменений совпадают с видами изменений хранилища.
+const (
+	EventUpdate = OpUpdate
+	EventDelete = OpDelete
+	EventReset  = OpReset
+	// EventReplace предшествует событиям EventUpdate с новым содержимым
+	// хранилища после ReplaceAll: подписчик должен забыть прежнее состояние
+	EventReplace = OpReplace
+)
+
+// Event — изменение одной метрики. Номера событий возрастают на единицу
+// без пропусков в пределах эпохи — жизни процесса; пропуск номера в
+// подписке означает, что события были отброшены. После перезапуска номера
+// начинаются заново с новой эпохой.
+type Event struct {
+	Epoch string    `json:"epoch"`
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	MType string    `json:"type,omitempty"`
+	Name  string    `json:"name,omitempty"`
+	// Новое значение gauge
+	Value *float64 `json:"value,omitempty"`
+	// Новое значение counter и приращение, которое к нему привело
+	Counter *int64 `json:"counter,omitempty"`
+	Delta   *int64 `json:"delta,omitempty"`
+	// Новое состояние гистограммы
+	Histogram *models.Histogram `json:"histogram,omitempty"`
+	// Оценка числа уникальных значений множества
+	Cardinality *uint64 `json:"cardinality,omitempty"`
+}
+
+// SlowPolicy определяет, что делать с подписчиком, чей буфер заполнен.
+type SlowPolicy int
+
+const (
+	// SlowDrop отбрасывает события, не поместившиеся в буфер
+	SlowDrop SlowPolicy = iota
+	// SlowDisconnect закрывает подписку с ошибкой ErrSlowConsumer
+	SlowDisconnect
+)
+
+// ParseSlowPolicy разбирает "drop" или "disconnect".
+func ParseSlowPolicy(value string) (SlowPolicy, error) {
+	switch value {
+	case "drop":
+		return SlowDrop, nil
+	case "disconnect":
+		return SlowDisconnect, nil
+	}
+	return 0, fmt.Errorf("invalid slow consumer policy %q: expected drop or disconnect", value)
+}
+
+// Feed — лента изменений хранилища в памяти, подключаемая наблюдателем
+// (MemoryStorage.Observe). События нумеруются под блокировкой шарда
+// изменения, поэтому события одной метрики идут в порядке применения.
+// Последние retain событий хранятся, чтобы подписчик мог продолжить с
+// известного ему номера.
+type Feed struct {
+	retain int
+	epoch  string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []Event
+	subs    map[*Subscription]struct{}
+}
+
+// Subscription — подписка на ленту изменений. Канал C закрывается после
+// Close, отмены контекста подписки или отключения медленного подписчика.
+type Subscription struct {
+	C <-chan Event
+
+	feed    *Feed
+	events  chan Event
+	policy  SlowPolicy
+	dropped uint64
+	err     error
+	stop    func() bool
+}
+
+func NewFeed(retain int) *Feed {
+	return &Feed{
+		retain: retain,
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Seq возвращает номер последнего опубликованного события.
+func (s *Feed) Seq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// Epoch возвращает эпоху ленты.
+func (s *Feed) Epoch() string {
+	return s.epoch
+}
+
+// Subscribe подписывается на события эпохи epoch с номером from и
+// следующие; при from == 0 — только на новые события, и эпоха не
+// проверяется. Сохранённые события доставляются сразу и не занимают место
+// в буфере из buffer событий.
+func (s *Feed) Subscribe(ctx context.Context, epoch string, from uint64, buffer int, policy SlowPolicy) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var backlog []Event
+	if from > 0 {
+		if epoch != s.epoch {
+			return nil, fmt.Errorf("%w: epoch %q, current %q", ErrFeedTruncated, epoch, s.epoch)
+		}
+		oldest := s.seq + 1 - uint64(len(s.history))
+		if from < oldest || from > s.seq+1 {
+			return nil, fmt.Errorf("%w: from %d, available %d..%d", ErrFeedTruncated, from, oldest, s.seq+1)
+		}
+		backlog = s.history[from-oldest:]
+	}
+
+	events := make(chan Event, buffer+len(backlog))
+	for _, e := range backlog {
+		events <- e
+	}
+	sub := &Subscription{C: events, feed: s, events: events, policy: policy}
+	s.subs[sub] = struct{}{}
+	sub.stop = context.AfterFunc(ctx, sub.Close)
+	return sub, nil
+}
+
+// Close отменяет подписку; повторный вызов ничего не делает.
+func (sub *Subscription) Close() {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+	sub.feed.unsubscribe(sub, nil)
+}
+
+// Dropped возвращает число событий, отброшенных политикой SlowDrop.
+func (sub *Subscription) Dropped() uint64 {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+	return sub.dropped
+}
+
+// Err возвращает ErrSlowConsumer, если подписка закрыта из-за медленного
+// подписчика.
+func (sub *Subscription) Err() error {
+	sub.feed.mu.Lock()
+	defer sub.feed.mu.Unlock()
+	return sub.err
+}
+
+func (s *Feed) unsubscribe(sub *Subscription, err error) {
+	if _, ok := s.subs[sub]; !ok {
+		return
+	}
+	delete(s.subs, sub)
+	sub.err = err
+	sub.stop()
+	close(sub.events)
+}
+
+// Observe публикует изменения хранилища. События строятся до захвата
+// блокировки ленты: под ней события только нумеруются, сохраняются и
+// без ожидания рассылаются подписчикам.
+func (s *Feed) Observe(changes []Change) {
+	events := make([]Event, len(changes))
+	for i, c := range changes {
+		events[i] = changeEvent(c)
+		events[i].Epoch = s.epoch
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.seq++
+		e.Seq = s.seq
+
+		if s.retain > 0 {
+			s.history = append(s.history, e)
+			if len(s.history) > s.retain {
+				s.history = s.history[len(s.history)-s.retain:]
+			}
+		}
+
+		for sub := range s.subs {
+			select {
+			case sub.events <- e:
+			default:
+				if sub.policy == SlowDisconnect {
+					s.unsubscribe(sub, ErrSlowConsumer)
+				} else {
+					sub.dropped++
+				}
+			}
+		}
+	}
+}
+
+// changeEvent описывает изменение событием со значением метрики после
+// него. Значение counter — сумма после этого изменения; гистограммы и
+// множества в пакете описываются состоянием после всего пакета.
+func changeEvent(c Change) Event {
+	e := Event{Time: c.Time, Op: c.Op, MType: c.Update.MType, Name: c.Update.Name}
+	switch c.Op {
+	case OpReset:
+		var zero int64
+		e.Counter = &zero
+	case OpUpdate:
+		switch c.Update.MType {
+		case TypeGauge:
+			value := c.Update.Value
+			e.Value = &value
+		case TypeCounter:
+			total, delta := c.Counter, c.Update.Delta
+			e.Counter, e.Delta = &total, &delta
+		case TypeHistogram:
+			h := c.Histogram.Normalize()
+			e.Histogram = &h
+		case TypeSet:
+			if c.Set != nil {
+				n := c.Set.Estimate()
+				e.Cardinality = &n
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,410 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+var ErrLimitExceeded = errors.New("metric limit exceeded")
+
+// LimitError сообщает, какое ограничение не позволило создать метрику.
+// errors.Is(err, ErrLimitExceeded) для неё истинно.
+type LimitError struct {
+	MType  string
+	Name   string
+	Prefix string
+	Limit  int
+}
+
+func (e *LimitError) Error() string {
+	if e.Prefix == "" {
+		return fmt.Sprintf("cannot create %s %q: at most %d metrics allowed", e.MType, e.Name, e.Limit)
+	}
+	return fmt.Sprintf("cannot create %s %q: at most %d metrics with prefix %q allowed", e.MType, e.Name, e.Limit, e.Prefix)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// LimitPolicy ограничивает число разных метрик: всего (Global) и среди
+// метрик, имя которых начинается с префикса. Метрика учитывается во всех
+// подходящих префиксах. Нулевое ограничение — без ограничения.
+type LimitPolicy struct {
+	Global   int
+	Prefixes map[string]int
+}
+
+// ParseLimitPolicy разбирает строку вида "*=100000,Tmp=1000,debug.=50",
+// где * задаёт общее ограничение.
+func ParseLimitPolicy(value string) (LimitPolicy, error) {
+	policy := LimitPolicy{Prefixes: make(map[string]int)}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		prefix, limit, ok := strings.Cut(part, "=")
+		if !ok {
+			return LimitPolicy{}, fmt.Errorf("invalid limit %q: expected <prefix>=<count>", part)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return LimitPolicy{}, fmt.Errorf("invalid limit %q for prefix %q", limit, prefix)
+		}
+		if prefix == "*" {
+			policy.Global = n
+		} else {
+			policy.Prefixes[prefix] = n
+		}
+	}
+	return policy, nil
+}
+
+// String возвращает ограничения в формате ParseLimitPolicy.
+func (p LimitPolicy) String() string {
+	var parts []string
+	if p.Global > 0 {
+		parts = append(parts, "*="+strconv.Itoa(p.Global))
+	}
+	prefixes := make([]string, 0, len(p.Prefixes))
+	for prefix := range p.Prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		parts = append(parts, prefix+"="+strconv.Itoa(p.Prefixes[prefix]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// LimitUsage — текущее число метрик и ограничение для них.
+type LimitUsage struct {
+	Prefix string `json:"prefix,omitempty"`
+	Used   int    `json:"used"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// LimitedStorage отклоняет создание метрик сверх LimitPolicy с ошибкой
+// *LimitError; изменения существующих метрик проходят без ограничений.
+// Изменения одной метрики выполняются по очереди под блокировкой её
+// полосы (keyLocks), изменения разных метрик — параллельно. Место новой
+// метрики резервируется до изменения и освобождается, если изменение не
+// применилось; mu защищает только учёт и не удерживается во время
+// изменения.
+type LimitedStorage struct {
+	Repository
+	policy LimitPolicy
+	keys   keyLocks
+
+	mu       sync.RWMutex
+	known    map[MetricKey]struct{}
+	total    int
+	prefixes map[string]int
+}
+
+// Число полос блокировок метрик
+const keyLockStripes = 256
+
+// keyLocks упорядочивает изменения одной метрики, не блокируя изменения
+// остальных.
+type keyLocks [keyLockStripes]sync.Mutex
+
+func (l *keyLocks) stripe(key MetricKey) int {
+	f := fnv.New32a()
+	f.Write([]byte(key.MType))
+	f.Write([]byte{0})
+	f.Write([]byte(key.Name))
+	return int(f.Sum32() % keyLockStripes)
+}
+
+// lock блокирует полосы keys в порядке возрастания и возвращает функцию
+// снятия блокировок.
+func (l *keyLocks) lock(keys []MetricKey) func() {
+	stripes := make([]int, 0, len(keys))
+	seen := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		i := l.stripe(key)
+		if _, ok := seen[i]; !ok {
+			seen[i] = struct{}{}
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	for _, i := range stripes {
+		l[i].Lock()
+	}
+	return func() {
+		for _, i := range stripes {
+			l[i].Unlock()
+		}
+	}
+}
+
+// lockAll блокирует все полосы и возвращает функцию снятия блокировок.
+func (l *keyLocks) lockAll() func() {
+	for i := range l {
+		l[i].Lock()
+	}
+	return func() {
+		for i := range l {
+			l[i].Unlock()
+		}
+	}
+}
+
+// NewLimitedStorage учитывает уже имеющиеся в repo метрики. Они сохраняются,
+// даже если превышают ограничения; новые метрики тогда не создаются, пока
+// их число не опустится ниже ограничения.
+func NewLimitedStorage(ctx context.Context, repo Repository, policy LimitPolicy) (*LimitedStorage, error) {
+	s := &LimitedStorage{Repository: repo, policy: policy}
+	if err := s.recount(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *LimitedStorage) recount(ctx context.Context) error {
+	snap, err := s.Repository.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known = make(map[MetricKey]struct{})
+	s.total = 0
+	s.prefixes = make(map[string]int)
+	for name := range snap.Gauges {
+		s.add(MetricKey{TypeGauge, name})
+	}
+	for name := range snap.Counters {
+		s.add(MetricKey{TypeCounter, name})
+	}
+	for name := range snap.Histograms {
+		s.add(MetricKey{TypeHistogram, name})
+	}
+	for name := range snap.Sets {
+		s.add(MetricKey{TypeSet, name})
+	}
+	return nil
+}
+
+func (s *LimitedStorage) add(key MetricKey) {
+	s.known[key] = struct{}{}
+	s.total++
+	for prefix := range s.policy.Prefixes {
+		if strings.HasPrefix(key.Name, prefix) {
+			s.prefixes[prefix]++
+		}
+	}
+}
+
+func (s *LimitedStorage) remove(key MetricKey) {
+	if _, ok := s.known[key]; !ok {
+		return
+	}
+	delete(s.known, key)
+	s.total--
+	for prefix := range s.policy.Prefixes {
+		if strings.HasPrefix(key.Name, prefix) {
+			s.prefixes[prefix]--
+		}
+	}
+}
+
+// admit проверяет, можно ли создать метрики keys сверх уже учтённых.
+func (s *LimitedStorage) admit(keys []MetricKey) error {
+	total := s.total
+	prefixes := make(map[string]int)
+	for _, key := range keys {
+		total++
+		if s.policy.Global > 0 && total > s.policy.Global {
+			return &LimitError{MType: key.MType, Name: key.Name, Limit: s.policy.Global}
+		}
+		for prefix, limit := range s.policy.Prefixes {
+			if limit == 0 || !strings.HasPrefix(key.Name, prefix) {
+				continue
+			}
+			prefixes[prefix]++
+			if s.prefixes[prefix]+prefixes[prefix] > limit {
+				return &LimitError{MType: key.MType, Name: key.Name, Prefix: prefix, Limit: limit}
+			}
+		}
+	}
+	return nil
+}
+
+// apply выполняет change, если все keys уже существуют или их создание
+// укладывается в ограничения.
+func (s *LimitedStorage) apply(keys []MetricKey, change func() error) error {
+	defer s.keys.lock(keys)()
+
+	s.mu.RLock()
+	missing := s.missing(keys)
+	s.mu.RUnlock()
+	if len(missing) == 0 {
+		return change()
+	}
+
+	if err := s.reserve(missing); err != nil {
+		return err
+	}
+	err := change()
+	if !applied(err) {
+		s.mu.Lock()
+		for _, key := range missing {
+			s.remove(key)
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// reserve учитывает новые метрики keys, если это позволяют ограничения.
+func (s *LimitedStorage) reserve(keys []MetricKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		s.add(key)
+	}
+	return nil
+}
+
+// applied сообщает, применено ли изменение, вернувшее err, к хранилищу:
+// ErrNotPersisted означает, что оно применено, но не сохранено.
+func applied(err error) bool {
+	return err == nil || errors.Is(err, ErrNotPersisted)
+}
+
+// missing возвращает ещё не учтённые ключи без повторов.
+func (s *LimitedStorage) missing(keys []MetricKey) []MetricKey {
+	var missing []MetricKey
+	var seen map[MetricKey]struct{}
+	for _, key := range keys {
+		if _, ok := s.known[key]; ok {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[MetricKey]struct{})
+		}
+		seen[key] = struct{}{}
+		missing = append(missing, key)
+	}
+	return missing
+}
+
+func (s *LimitedStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	return s.apply([]MetricKey{{TypeGauge, name}}, func() error {
+		return s.Repository.UpdateGauge(ctx, name, value)
+	})
+}
+
+func (s *LimitedStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	return s.apply([]MetricKey{{TypeCounter, name}}, func() error {
+		return s.Repository.UpdateCounter(ctx, name, value)
+	})
+}
+
+func (s *LimitedStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	return s.apply([]MetricKey{{TypeHistogram, name}}, func() error {
+		return s.Repository.UpdateHistogram(ctx, name, h)
+	})
+}
+
+func (s *LimitedStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	return s.apply([]MetricKey{{TypeSet, name}}, func() error {
+		return s.Repository.UpdateSet(ctx, name, members)
+	})
+}
+
+func (s *LimitedStorage) UpdateBatch(ctx context.Context, updates []MetricUpdate) error {
+	keys := make([]MetricKey, 0, len(updates))
+	for _, u := range updates {
+		keys = append(keys, MetricKey{u.MType, u.Name})
+	}
+	return s.apply(keys, func() error {
+		return s.Repository.UpdateBatch(ctx, updates)
+	})
+}
+
+// ReplaceAll отклоняет замену, если новое содержимое не укладывается
+// в ограничения.
+func (s *LimitedStorage) ReplaceAll(ctx context.Context, updates []MetricUpdate) error {
+	defer s.keys.lockAll()()
+
+	keys := make([]MetricKey, 0, len(updates))
+	for _, u := range updates {
+		keys = append(keys, MetricKey{u.MType, u.Name})
+	}
+	empty := &LimitedStorage{policy: s.policy, known: map[MetricKey]struct{}{}, prefixes: map[string]int{}}
+	if err := empty.admit(empty.missing(keys)); err != nil {
+		return err
+	}
+
+	err := s.Repository.ReplaceAll(ctx, updates)
+	if !applied(err) {
+		return err
+	}
+	if err := s.recount(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+func (s *LimitedStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	defer s.keys.lock([]MetricKey{{mType, name}})()
+
+	err := s.Repository.DeleteMetric(ctx, mType, name)
+	if applied(err) {
+		s.mu.Lock()
+		s.remove(MetricKey{mType, name})
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *LimitedStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	defer s.keys.lock([]MetricKey{{mType, name}})()
+
+	err := s.Repository.DeleteMetricIfStale(ctx, mType, name, before)
+	if applied(err) {
+		s.mu.Lock()
+		s.remove(MetricKey{mType, name})
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Usage возвращает общее число метрик и число метрик по каждому
+// ограниченному префиксу.
+func (s *LimitedStorage) Usage() (LimitUsage, []LimitUsage) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefixes := make([]LimitUsage, 0, len(s.policy.Prefixes))
+	for prefix, limit := range s.policy.Prefixes {
+		prefixes = append(prefixes, LimitUsage{Prefix: prefix, Used: s.prefixes[prefix], Limit: limit})
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix < prefixes[j].Prefix })
+	return LimitUsage{Used: s.total, Limit: s.policy.Global}, prefixes
+}
+
+var _ Repository = (*LimitedStorage)(nil)
@@ -1,64 +1,659 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
 )
 
+const defaultShardCount = 32
+
+// MemoryStorage разбивает метрики на шарды по хешу имени, чтобы записи
+// в разные метрики не конкурировали за одну блокировку. Пакеты блокируют
+// затронутые шарды в порядке возрастания индекса. Чтение всего хранилища
+// копирует шарды по одному и повторяется, если за это время применялся
+// пакет в несколько шардов (см. readShards), поэтому не видит частично
+// применённый пакет и не останавливает записи на время копирования.
 type MemoryStorage struct {
-	mu       sync.RWMutex
-	gauges   map[string]float64
-	counters map[string]int64
+	shards    []*shard
+	now       func() time.Time
+	observers []Observer
+
+	// Число начатых и завершённых пакетов, затрагивающих несколько шардов
+	batchesStarted  atomic.Uint64
+	batchesFinished atomic.Uint64
+}
+
+type MetricKey struct {
+	MType string
+	Name  string
+}
+
+type shard struct {
+	mu         sync.RWMutex
+	gauges     map[string]float64
+	counters   map[string]int64
+	histograms map[string]models.Histogram
+	sets       map[string]*hll.Sketch
+	// Время последнего изменения каждой метрики
+	updated map[MetricKey]time.Time
 }
 
 func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		gauges:   make(map[string]float64),
-		counters: make(map[string]int64),
+	return NewShardedMemoryStorage(defaultShardCount)
+}
+
+func NewShardedMemoryStorage(shardCount int) *MemoryStorage {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	s := &MemoryStorage{
+		shards: make([]*shard, shardCount),
+		now:    time.Now,
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			gauges:     make(map[string]float64),
+			counters:   make(map[string]int64),
+			histograms: make(map[string]models.Histogram),
+			sets:       make(map[string]*hll.Sketch),
+			updated:    make(map[MetricKey]time.Time),
+		}
+	}
+	return s
+}
+
+// shardIndex выбирает шард по FNV-1a хешу имени.
+func (s *MemoryStorage) shardIndex(name string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(s.shards)))
+}
+
+func (s *MemoryStorage) shardFor(name string) *shard {
+	return s.shards[s.shardIndex(name)]
+}
+
+func (s *MemoryStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.gauges[name] = value
+	now := s.now()
+	sh.updated[MetricKey{TypeGauge, name}] = now
+	if len(s.observers) > 0 {
+		s.notify(Change{Op: OpUpdate, Update: MetricUpdate{MType: TypeGauge, Name: name, Value: value}, Time: now})
 	}
+	return nil
 }
 
-func (s *MemoryStorage) UpdateGauge(name string, value float64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.gauges[name] = value
+func (s *MemoryStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.counters[name] += value
+	now := s.now()
+	sh.updated[MetricKey{TypeCounter, name}] = now
+	if len(s.observers) > 0 {
+		s.notify(sh.changed(OpUpdate, MetricUpdate{MType: TypeCounter, Name: name, Delta: value}, now))
+	}
 	return nil
 }
 
-func (s *MemoryStorage) UpdateCounter(name string, value int64) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.counters[name] += value
+func (s *MemoryStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	current, ok := sh.histograms[name]
+	merged, err := mergeHistogram(current, ok, h)
+	if err != nil {
+		return err
+	}
+	sh.histograms[name] = merged
+	now := s.now()
+	sh.updated[MetricKey{TypeHistogram, name}] = now
+	if len(s.observers) > 0 {
+		s.notify(sh.changed(OpUpdate, MetricUpdate{MType: TypeHistogram, Name: name, Histogram: &h}, now))
+	}
+	return nil
+}
+
+// mergeHistogram добавляет h к текущему значению метрики, если оно есть.
+func mergeHistogram(current models.Histogram, exists bool, h models.Histogram) (models.Histogram, error) {
+	if !exists {
+		return h.Normalize(), nil
+	}
+	merged, err := current.Merge(h)
+	if err != nil {
+		return merged, fmt.Errorf("%w: %w", ErrInvalidUpdate, err)
+	}
+	return merged, nil
+}
+
+func (s *MemoryStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("%w: no members", ErrInvalidUpdate)
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.addToSet(name, members, nil)
+	now := s.now()
+	sh.updated[MetricKey{TypeSet, name}] = now
+	if len(s.observers) > 0 {
+		s.notify(sh.changed(OpUpdate, MetricUpdate{MType: TypeSet, Name: name, Members: members}, now))
+	}
 	return nil
 }
 
-func (s *MemoryStorage) GetAllMetrics() (map[string]float64, map[string]int64) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (sh *shard) addToSet(name string, members []string, sketch *hll.Sketch) {
+	set, ok := sh.sets[name]
+	if !ok {
+		set = hll.New()
+		sh.sets[name] = set
+	}
+	for _, m := range members {
+		set.Add(m)
+	}
+	if sketch != nil {
+		set.Merge(sketch)
+	}
+}
 
-	gaugesCopy := make(map[string]float64)
-	countersCopy := make(map[string]int64)
+func (s *MemoryStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	return s.deleteMetric(ctx, mType, name, time.Time{})
+}
 
-	for k, v := range s.gauges {
-		gaugesCopy[k] = v
+func (s *MemoryStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	return s.deleteMetric(ctx, mType, name, before)
+}
+
+// deleteMetric удаляет метрику; при ненулевом before — только если она не
+// изменялась с этого момента.
+func (s *MemoryStorage) deleteMetric(ctx context.Context, mType, name string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	for k, v := range s.counters {
-		countersCopy[k] = v
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var ok bool
+	switch mType {
+	case TypeGauge:
+		_, ok = sh.gauges[name]
+	case TypeCounter:
+		_, ok = sh.counters[name]
+	case TypeHistogram:
+		_, ok = sh.histograms[name]
+	case TypeSet:
+		_, ok = sh.sets[name]
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidUpdate, mType)
+	}
+	if !ok {
+		return notFound(mType, name)
+	}
+	key := MetricKey{mType, name}
+	if !before.IsZero() && !sh.updated[key].Before(before) {
+		return notStale(mType, name)
 	}
 
-	return gaugesCopy, countersCopy
+	switch mType {
+	case TypeGauge:
+		delete(sh.gauges, name)
+	case TypeCounter:
+		delete(sh.counters, name)
+	case TypeHistogram:
+		delete(sh.histograms, name)
+	case TypeSet:
+		delete(sh.sets, name)
+	}
+	delete(sh.updated, key)
+	if len(s.observers) > 0 {
+		s.notify(Change{Op: OpDelete, Update: MetricUpdate{MType: mType, Name: name}, Time: s.now()})
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ResetCounter(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if _, ok := sh.counters[name]; !ok {
+		return notFound(TypeCounter, name)
+	}
+	sh.counters[name] = 0
+	now := s.now()
+	sh.updated[MetricKey{TypeCounter, name}] = now
+	if len(s.observers) > 0 {
+		s.notify(Change{Op: OpReset, Update: MetricUpdate{MType: TypeCounter, Name: name}, Time: now})
+	}
+	return nil
 }
 
-func (s *MemoryStorage) GetGauge(name string) (float64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	val, ok := s.gauges[name]
-	return val, ok
+func (s *MemoryStorage) UpdateBatch(ctx context.Context, updates []MetricUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidateBatch(updates); err != nil {
+		return err
+	}
+
+	// Блокируем затронутые шарды в порядке возрастания индекса
+	seen := make(map[int]struct{})
+	indexes := make([]int, 0)
+	for _, u := range updates {
+		idx := s.shardIndex(u.Name)
+		if _, ok := seen[idx]; !ok {
+			seen[idx] = struct{}{}
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Ints(indexes)
+	for _, idx := range indexes {
+		s.shards[idx].mu.Lock()
+	}
+	if len(indexes) > 1 {
+		s.batchesStarted.Add(1)
+	}
+	defer func() {
+		if len(indexes) > 1 {
+			s.batchesFinished.Add(1)
+		}
+		for _, idx := range indexes {
+			s.shards[idx].mu.Unlock()
+		}
+	}()
+
+	histograms, err := mergeBatchHistograms(updates, func(name string) (models.Histogram, bool) {
+		h, ok := s.shardFor(name).histograms[name]
+		return h, ok
+	})
+	if err != nil {
+		return err
+	}
+
+	s.applyBatch(nil, updates, histograms, s.now())
+	return nil
 }
 
-func (s *MemoryStorage) GetCounter(name string) (int64, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	val, ok := s.counters[name]
-	return val, ok
+// ReplaceAll атомарно заменяет всё содержимое хранилища содержимым пакета.
+func (s *MemoryStorage) ReplaceAll(ctx context.Context, updates []MetricUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidateBatch(updates); err != nil {
+		return err
+	}
+
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	s.batchesStarted.Add(1)
+	defer func() {
+		s.batchesFinished.Add(1)
+		for _, sh := range s.shards {
+			sh.mu.Unlock()
+		}
+	}()
+
+	histograms, err := mergeBatchHistograms(updates, func(string) (models.Histogram, bool) {
+		return models.Histogram{}, false
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, sh := range s.shards {
+		sh.gauges = make(map[string]float64)
+		sh.counters = make(map[string]int64)
+		sh.histograms = make(map[string]models.Histogram)
+		sh.sets = make(map[string]*hll.Sketch)
+		sh.updated = make(map[MetricKey]time.Time)
+	}
+
+	now := s.now()
+	s.applyBatch([]Change{{Op: OpReplace, Time: now}}, updates, histograms, now)
+	return nil
+}
+
+// applyBatch применяет пакет к заблокированным шардам и передаёт
+// наблюдателям changes вместе с изменениями пакета.
+func (s *MemoryStorage) applyBatch(changes []Change, updates []MetricUpdate, histograms map[string]models.Histogram, now time.Time) {
+	if len(s.observers) == 0 {
+		for _, u := range updates {
+			s.shardFor(u.Name).apply(u, histograms, now)
+		}
+		return
+	}
+
+	for _, u := range updates {
+		sh := s.shardFor(u.Name)
+		sh.apply(u, histograms, now)
+		changes = append(changes, sh.changed(OpUpdate, u, now))
+	}
+	s.notify(changes...)
+}
+
+// mergeBatchHistograms заранее сливает гистограммы пакета с текущими
+// значениями, чтобы несовпадение границ отклонило весь пакет.
+func mergeBatchHistograms(updates []MetricUpdate, current func(name string) (models.Histogram, bool)) (map[string]models.Histogram, error) {
+	histograms := make(map[string]models.Histogram)
+	var batchErr BatchError
+	for i, u := range updates {
+		if u.MType != TypeHistogram {
+			continue
+		}
+		h, ok := histograms[u.Name]
+		if !ok {
+			h, ok = current(u.Name)
+		}
+		merged, err := mergeHistogram(h, ok, *u.Histogram)
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, ItemError{Index: i, Name: u.Name, Err: err})
+			continue
+		}
+		histograms[u.Name] = merged
+	}
+	if len(batchErr.Items) > 0 {
+		return nil, &batchErr
+	}
+	return histograms, nil
+}
+
+// apply применяет изменение пакета; итоговые значения гистограмм
+// рассчитаны заранее в histograms.
+func (sh *shard) apply(u MetricUpdate, histograms map[string]models.Histogram, now time.Time) {
+	switch u.MType {
+	case TypeGauge:
+		sh.gauges[u.Name] = u.Value
+	case TypeCounter:
+		sh.counters[u.Name] += u.Delta
+	case TypeHistogram:
+		sh.histograms[u.Name] = histograms[u.Name]
+	case TypeSet:
+		sh.addToSet(u.Name, u.Members, u.Sketch)
+	}
+	sh.updated[MetricKey{u.MType, u.Name}] = now
+}
+
+// Число попыток прочитать шарды по одному, после которых чтение
+// выполняется под блокировкой всех шардов
+const readShardsAttempts = 3
+
+// readShards вызывает read для каждого шарда под его блокировкой на чтение,
+// не блокируя остальные шарды. Если за время чтения применялся пакет в
+// несколько шардов, прочитанное может не соответствовать ни одному
+// состоянию хранилища: тогда reset сбрасывает его и чтение повторяется.
+// Записи в один шард атомарны и повтора не требуют.
+func (s *MemoryStorage) readShards(reset func(), read func(sh *shard)) {
+	for attempt := 0; attempt < readShardsAttempts; attempt++ {
+		started := s.batchesStarted.Load()
+		if started != s.batchesFinished.Load() {
+			runtime.Gosched()
+			continue
+		}
+		for _, sh := range s.shards {
+			sh.mu.RLock()
+			read(sh)
+			sh.mu.RUnlock()
+		}
+		if s.batchesStarted.Load() == started {
+			return
+		}
+		reset()
+	}
+
+	defer s.rlockAll()()
+	for _, sh := range s.shards {
+		read(sh)
+	}
+}
+
+// rlockAll блокирует все шарды на чтение и возвращает функцию снятия
+// блокировок.
+func (s *MemoryStorage) rlockAll() func() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	return func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}
+}
+
+func (s *MemoryStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var gaugesCopy map[string]float64
+	var countersCopy map[string]int64
+	reset := func() {
+		gaugesCopy = make(map[string]float64)
+		countersCopy = make(map[string]int64)
+	}
+	reset()
+
+	s.readShards(reset, func(sh *shard) {
+		for k, v := range sh.gauges {
+			gaugesCopy[k] = v
+		}
+		for k, v := range sh.counters {
+			countersCopy[k] = v
+		}
+	})
+
+	return gaugesCopy, countersCopy, nil
+}
+
+func (s *MemoryStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	val, ok := sh.gauges[name]
+	if !ok {
+		return 0, notFound(TypeGauge, name)
+	}
+	return val, nil
+}
+
+func (s *MemoryStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	val, ok := sh.counters[name]
+	if !ok {
+		return 0, notFound(TypeCounter, name)
+	}
+	return val, nil
+}
+
+func (s *MemoryStorage) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Histogram{}, err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	val, ok := sh.histograms[name]
+	if !ok {
+		return models.Histogram{}, notFound(TypeHistogram, name)
+	}
+	return val.Normalize(), nil
+}
+
+func (s *MemoryStorage) GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var histograms map[string]models.Histogram
+	reset := func() { histograms = make(map[string]models.Histogram) }
+	reset()
+
+	s.readShards(reset, func(sh *shard) {
+		for k, v := range sh.histograms {
+			histograms[k] = v.Normalize()
+		}
+	})
+	return histograms, nil
+}
+
+func (s *MemoryStorage) GetSet(ctx context.Context, name string) (*hll.Sketch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sh := s.shardFor(name)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	val, ok := sh.sets[name]
+	if !ok {
+		return nil, notFound(TypeSet, name)
+	}
+	return val.Clone(), nil
+}
+
+func (s *MemoryStorage) GetAllSets(ctx context.Context) (map[string]*hll.Sketch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var sets map[string]*hll.Sketch
+	reset := func() { sets = make(map[string]*hll.Sketch) }
+	reset()
+
+	s.readShards(reset, func(sh *shard) {
+		for k, v := range sh.sets {
+			sets[k] = v.Clone()
+		}
+	})
+	return sets, nil
+}
+
+func (s *MemoryStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Snapshot{}, err
+	}
+
+	var snap models.Snapshot
+	reset := func() { snap = newSnapshot() }
+	reset()
+
+	s.readShards(reset, func(sh *shard) { sh.copyTo(&snap) })
+	return snap, nil
+}
+
+// SnapshotWith возвращает снимок и вызывает fn, пока изменения хранилища
+// заблокированы: наблюдатели в этот момент не выполняются, и fn видит их
+// состояние, соответствующее снимку. Это единственное чтение под
+// блокировкой всех шардов: подписке на репликацию нужен срез, точно
+// совпадающий с позицией в журнале изменений, а его нельзя получить,
+// копируя шарды по одному.
+func (s *MemoryStorage) SnapshotWith(ctx context.Context, fn func()) (models.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Snapshot{}, err
+	}
+
+	defer s.rlockAll()()
+	if fn != nil {
+		fn()
+	}
+
+	snap := newSnapshot()
+	for _, sh := range s.shards {
+		sh.copyTo(&snap)
+	}
+	return snap, nil
+}
+
+func newSnapshot() models.Snapshot {
+	return models.Snapshot{
+		Gauges:     make(map[string]float64),
+		Counters:   make(map[string]int64),
+		Histograms: make(map[string]models.Histogram),
+		Sets:       make(map[string]*hll.Sketch),
+	}
+}
+
+// copyTo копирует метрики шарда в снимок.
+func (sh *shard) copyTo(snap *models.Snapshot) {
+	for k, v := range sh.gauges {
+		snap.Gauges[k] = v
+	}
+	for k, v := range sh.counters {
+		snap.Counters[k] = v
+	}
+	for k, v := range sh.histograms {
+		snap.Histograms[k] = v.Normalize()
+	}
+	for k, v := range sh.sets {
+		snap.Sets[k] = v.Clone()
+	}
+}
+
+// UpdatedBefore возвращает метрики, которые не изменялись с момента,
+// вычисленного deadline для каждой из них. Нулевой момент означает, что
+// метрика не устаревает.
+func (s *MemoryStorage) UpdatedBefore(deadline func(key MetricKey) time.Time) []MetricKey {
+	var stale []MetricKey
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for key, updated := range sh.updated {
+			if d := deadline(key); !d.IsZero() && updated.Before(d) {
+				stale = append(stale, key)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return stale
 }
@@ -1,29 +1,614 @@
 package storage
 
 import (
+	"context"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yadmabramov/admAlerting/internal/models"
 )
 
 func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+
 	t.Run("Gauge operations", func(t *testing.T) {
 		s := NewMemoryStorage()
 
-		s.UpdateGauge("test_gauge", 123.45)
-		s.UpdateGauge("test_gauge", 678.90)
+		s.UpdateGauge(ctx, "test_gauge", 123.45)
+		s.UpdateGauge(ctx, "test_gauge", 678.90)
 
-		gauges, _ := s.GetAllMetrics()
+		gauges, _, err := s.GetAllMetrics(ctx)
+		assert.NoError(t, err)
 		assert.Equal(t, 678.90, gauges["test_gauge"])
 	})
 
 	t.Run("Counter operations", func(t *testing.T) {
 		s := NewMemoryStorage()
 
-		s.UpdateCounter("test_counter", 10)
-		s.UpdateCounter("test_counter", 5)
+		s.UpdateCounter(ctx, "test_counter", 10)
+		s.UpdateCounter(ctx, "test_counter", 5)
 
-		_, counters := s.GetAllMetrics()
+		_, counters, err := s.GetAllMetrics(ctx)
+		assert.NoError(t, err)
 		assert.Equal(t, int64(15), counters["test_counter"])
 	})
 }
+
+func TestMemoryStorageBatch(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	err := s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeGauge, Name: "Alloc", Value: 1.5},
+		{MType: TypeCounter, Name: "PollCount", Delta: 2},
+		{MType: TypeCounter, Name: "PollCount", Delta: 3},
+	})
+	assert.NoError(t, err)
+
+	gauges, counters, err := s.GetAllMetrics(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, gauges["Alloc"])
+	assert.Equal(t, int64(5), counters["PollCount"])
+
+	err = s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeGauge, Name: "Alloc", Value: 9},
+		{MType: "histogram", Name: "Latency"},
+		{MType: TypeCounter, Name: ""},
+	})
+	var batchErr *BatchError
+	assert.ErrorAs(t, err, &batchErr)
+	assert.Len(t, batchErr.Items, 2)
+	assert.ErrorIs(t, err, ErrInvalidUpdate)
+
+	value, err := s.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+}
+
+func TestMemoryStorageDeleteAndReset(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	s.UpdateGauge(ctx, "Alloc", 1)
+	s.UpdateCounter(ctx, "PollCount", 5)
+
+	assert.NoError(t, s.DeleteMetric(ctx, TypeGauge, "Alloc"))
+	assert.ErrorIs(t, s.DeleteMetric(ctx, TypeGauge, "Alloc"), ErrNotFound)
+	assert.ErrorIs(t, s.DeleteMetric(ctx, TypeGauge, "PollCount"), ErrNotFound)
+
+	assert.NoError(t, s.ResetCounter(ctx, "PollCount"))
+	value, err := s.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+	assert.ErrorIs(t, s.ResetCounter(ctx, "Missing"), ErrNotFound)
+
+	_, err = s.GetGauge(ctx, "Alloc")
+	var notFound *NotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, &NotFoundError{MType: TypeGauge, Name: "Alloc"}, notFound)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	gauges, _, err := s.GetAllMetrics(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, gauges)
+}
+
+func TestMemoryStorageObserver(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	var calls [][]Change
+	s.Observe(func(changes []Change) {
+		calls = append(calls, changes)
+	})
+
+	require.NoError(t, s.UpdateCounter(ctx, "PollCount", 2))
+	require.NoError(t, s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeCounter, Name: "PollCount", Delta: 3},
+		{MType: TypeGauge, Name: "Alloc", Value: 1.5},
+		{MType: TypeCounter, Name: "PollCount", Delta: 4},
+	}))
+	require.NoError(t, s.ResetCounter(ctx, "PollCount"))
+	require.NoError(t, s.DeleteMetric(ctx, TypeGauge, "Alloc"))
+	require.NoError(t, s.ReplaceAll(ctx, []MetricUpdate{{MType: TypeGauge, Name: "Alloc", Value: 2}}))
+	// Отклонённое изменение наблюдатели не получают
+	assert.Error(t, s.ResetCounter(ctx, "Missing"))
+
+	require.Len(t, calls, 5)
+	assert.Equal(t, OpUpdate, calls[0][0].Op)
+	assert.Equal(t, int64(2), calls[0][0].Counter)
+
+	require.Len(t, calls[1], 3)
+	assert.Equal(t, int64(5), calls[1][0].Counter)
+	assert.Equal(t, 1.5, calls[1][1].Update.Value)
+	assert.Equal(t, int64(9), calls[1][2].Counter)
+
+	assert.Equal(t, OpReset, calls[2][0].Op)
+	assert.Equal(t, Change{Op: OpDelete, Update: MetricUpdate{MType: TypeGauge, Name: "Alloc"}, Time: calls[3][0].Time}, calls[3][0])
+
+	require.Len(t, calls[4], 2)
+	assert.Equal(t, OpReplace, calls[4][0].Op)
+	assert.Equal(t, 2.0, calls[4][1].Update.Value)
+}
+
+func TestMemoryStorageCanceledContext(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, s.UpdateGauge(ctx, "Alloc", 1), context.Canceled)
+	_, _, err := s.GetAllMetrics(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = s.GetGauge(context.Background(), "Alloc")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStorageConcurrent(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.UpdateCounter(ctx, "PollCount", 1)
+				s.UpdateGauge(ctx, "gauge"+strconv.Itoa(j%50), float64(i))
+				s.GetAllMetrics(ctx)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	value, err := s.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8000), value)
+
+	gauges, _, err := s.GetAllMetrics(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, gauges, 50)
+}
+
+func TestMemoryStorageBatchIsAtomicForReaders(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	a, b := "A", "B"
+	require.NotEqual(t, s.shardIndex(a), s.shardIndex(b))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				value := float64(i*1000 + j)
+				assert.NoError(t, s.UpdateBatch(ctx, []MetricUpdate{
+					{MType: TypeGauge, Name: a, Value: value},
+					{MType: TypeGauge, Name: b, Value: value},
+				}))
+			}
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				gauges, _, err := s.GetAllMetrics(ctx)
+				assert.NoError(t, err)
+				assert.Equal(t, gauges[a], gauges[b])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemoryStorageReadAllDoesNotBlockWriters(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	name := "A"
+	require.NotEqual(t, len(s.shards)-1, s.shardIndex(name))
+
+	// Чтение всего хранилища останавливается на последнем шарде
+	last := s.shards[len(s.shards)-1]
+	last.mu.Lock()
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		_, _, err := s.GetAllMetrics(ctx)
+		assert.NoError(t, err)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		assert.NoError(t, s.UpdateGauge(ctx, name, 1))
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write waits for a reader of other shards")
+	}
+
+	last.mu.Unlock()
+	<-read
+}
+
+func benchmarkParallelUpdates(b *testing.B, s *MemoryStorage) {
+	ctx := context.Background()
+	names := make([]string, 1024)
+	for i := range names {
+		names[i] = "metric" + strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			name := names[i%len(names)]
+			if i%2 == 0 {
+				s.UpdateGauge(ctx, name, float64(i))
+			} else {
+				s.UpdateCounter(ctx, name, 1)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemoryStorageUpdates(b *testing.B) {
+	b.Run("single lock", func(b *testing.B) {
+		benchmarkParallelUpdates(b, NewShardedMemoryStorage(1))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkParallelUpdates(b, NewMemoryStorage())
+	})
+}
+
+func BenchmarkMemoryStorageUpdatesWithSnapshots(b *testing.B) {
+	ctx := context.Background()
+	run := func(b *testing.B, s *MemoryStorage) {
+		for i := 0; i < 10000; i++ {
+			s.UpdateGauge(ctx, "metric"+strconv.Itoa(i), float64(i))
+		}
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.GetAllMetrics(ctx)
+				}
+			}
+		}()
+
+		benchmarkParallelUpdates(b, s)
+	}
+
+	b.Run("single lock", func(b *testing.B) {
+		run(b, NewShardedMemoryStorage(1))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		run(b, NewMemoryStorage())
+	})
+}
+
+func TestTTLPolicy(t *testing.T) {
+	policy, err := ParseTTLPolicy("Tmp*=10m, Debug?=1h, *=0")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, policy.TTL("TmpLoad"))
+	assert.Equal(t, time.Hour, policy.TTL("Debug1"))
+	assert.Equal(t, time.Duration(0), policy.TTL("Alloc"))
+
+	// Шаблон сравнивается с именем ряда без меток
+	labelled, err := ParseTTLPolicy("Tmp*=10m, *dev*=1h")
+	require.NoError(t, err)
+	tmp := models.SeriesKey("TmpLoad", map[string]string{"path": "/var/tmp", "host": "a"})
+	assert.Equal(t, 10*time.Minute, labelled.TTL(tmp))
+	assert.Equal(t, time.Duration(0), labelled.TTL(models.SeriesKey("Alloc", map[string]string{"env": "dev"})))
+
+	_, err = ParseTTLPolicy("Tmp*")
+	assert.Error(t, err)
+	_, err = ParseTTLPolicy("[=1m")
+	assert.Error(t, err)
+
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	start := time.Now()
+	s.now = func() time.Time { return start }
+	s.UpdateGauge(ctx, "TmpLoad", 1)
+	s.UpdateGauge(ctx, "Alloc", 1)
+
+	assert.Empty(t, policy.Expired(s, start.Add(time.Minute)))
+	assert.Equal(t, []MetricKey{{TypeGauge, "TmpLoad"}}, policy.Expired(s, start.Add(11*time.Minute)))
+
+	s = NewMemoryStorage()
+	s.now = func() time.Time { return start }
+	s.UpdateGauge(ctx, tmp, 1)
+	assert.Equal(t, []MetricKey{{TypeGauge, tmp}}, labelled.Expired(s, start.Add(11*time.Minute)))
+}
+
+func TestLimitedStorage(t *testing.T) {
+	policy, err := ParseLimitPolicy("*=4, Tmp=2")
+	require.NoError(t, err)
+	assert.Equal(t, LimitPolicy{Global: 4, Prefixes: map[string]int{"Tmp": 2}}, policy)
+	assert.Equal(t, "*=4,Tmp=2", policy.String())
+	_, err = ParseLimitPolicy("Tmp")
+	assert.Error(t, err)
+	_, err = ParseLimitPolicy("Tmp=-1")
+	assert.Error(t, err)
+
+	ctx := context.Background()
+	mem := NewMemoryStorage()
+	require.NoError(t, mem.UpdateGauge(ctx, "Alloc", 1))
+	s, err := NewLimitedStorage(ctx, mem, policy)
+	require.NoError(t, err)
+
+	require.NoError(t, s.UpdateGauge(ctx, "TmpA", 1))
+	require.NoError(t, s.UpdateCounter(ctx, "TmpA", 1))
+	err = s.UpdateGauge(ctx, "TmpB", 1)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Contains(t, err.Error(), `prefix "Tmp"`)
+	_, err = mem.GetGauge(ctx, "TmpB")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Существующие метрики обновляются и при исчерпанном ограничении
+	require.NoError(t, s.UpdateGauge(ctx, "TmpA", 2))
+
+	// Пакет с новыми метриками сверх ограничения отклоняется целиком
+	err = s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeGauge, Name: "Alloc", Value: 2},
+		{MType: TypeGauge, Name: "Heap", Value: 1},
+		{MType: TypeGauge, Name: "Stack", Value: 1},
+	})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	value, err := mem.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+
+	global, prefixes := s.Usage()
+	assert.Equal(t, LimitUsage{Used: 3, Limit: 4}, global)
+	assert.Equal(t, []LimitUsage{{Prefix: "Tmp", Used: 2, Limit: 2}}, prefixes)
+
+	require.NoError(t, s.DeleteMetric(ctx, TypeGauge, "TmpA"))
+	require.NoError(t, s.UpdateGauge(ctx, "TmpB", 1))
+	global, _ = s.Usage()
+	assert.Equal(t, 3, global.Used)
+
+	err = s.ReplaceAll(ctx, []MetricUpdate{
+		{MType: TypeGauge, Name: "A", Value: 1},
+		{MType: TypeGauge, Name: "B", Value: 1},
+		{MType: TypeGauge, Name: "C", Value: 1},
+		{MType: TypeGauge, Name: "D", Value: 1},
+		{MType: TypeGauge, Name: "E", Value: 1},
+	})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	require.NoError(t, s.ReplaceAll(ctx, []MetricUpdate{{MType: TypeGauge, Name: "A", Value: 1}}))
+	global, prefixes = s.Usage()
+	assert.Equal(t, 1, global.Used)
+	assert.Equal(t, 0, prefixes[0].Used)
+
+	// Повторы новой метрики в пакете учитываются один раз
+	batch := make([]MetricUpdate, 1000)
+	for i := range batch {
+		batch[i] = MetricUpdate{MType: TypeCounter, Name: "Hits", Delta: 1}
+	}
+	require.NoError(t, s.UpdateBatch(ctx, batch))
+	global, _ = s.Usage()
+	assert.Equal(t, 2, global.Used)
+}
+
+// unpersistedStorage применяет изменения, но сообщает, что не сохранил их,
+// и ждёт gate перед изменением метрики Slow.
+type unpersistedStorage struct {
+	Repository
+	gate chan struct{}
+}
+
+func (s *unpersistedStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if name == "Slow" {
+		<-s.gate
+	}
+	if err := s.Repository.UpdateGauge(ctx, name, value); err != nil {
+		return err
+	}
+	return ErrNotPersisted
+}
+
+func TestLimitedStorageNotPersisted(t *testing.T) {
+	ctx := context.Background()
+	repo := &unpersistedStorage{Repository: NewMemoryStorage(), gate: make(chan struct{})}
+	s, err := NewLimitedStorage(ctx, repo, LimitPolicy{Global: 3})
+	require.NoError(t, err)
+
+	// Несохранённая метрика создана и учитывается
+	assert.ErrorIs(t, s.UpdateGauge(ctx, "A", 1), ErrNotPersisted)
+	assert.ErrorIs(t, s.UpdateGauge(ctx, "A", 2), ErrNotPersisted)
+	global, _ := s.Usage()
+	assert.Equal(t, 1, global.Used)
+
+	// Медленное создание не задерживает создание других метрик, но занимает
+	// место
+	slow := make(chan error)
+	go func() { slow <- s.UpdateGauge(ctx, "Slow", 1) }()
+	assert.Eventually(t, func() bool {
+		global, _ := s.Usage()
+		return global.Used == 2
+	}, time.Second, time.Millisecond)
+	assert.ErrorIs(t, s.UpdateGauge(ctx, "B", 1), ErrNotPersisted)
+	assert.ErrorIs(t, s.UpdateGauge(ctx, "C", 1), ErrLimitExceeded)
+
+	close(repo.gate)
+	assert.ErrorIs(t, <-slow, ErrNotPersisted)
+	global, _ = s.Usage()
+	assert.Equal(t, 3, global.Used)
+}
+
+func TestFeed(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryStorage()
+	at := time.Unix(1700000000, 0)
+	mem.now = func() time.Time { return at }
+	s := NewFeed(4)
+	mem.Observe(s.Observe)
+
+	sub, err := s.Subscribe(ctx, "", 0, 16, SlowDrop)
+	require.NoError(t, err)
+
+	require.NoError(t, mem.UpdateGauge(ctx, "Alloc", 1.5))
+	require.NoError(t, mem.UpdateCounter(ctx, "Hits", 2))
+	require.NoError(t, mem.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeCounter, Name: "Hits", Delta: 3},
+		{MType: TypeGauge, Name: "Alloc", Value: 2},
+		{MType: TypeCounter, Name: "Hits", Delta: 4},
+	}))
+	require.NoError(t, mem.ResetCounter(ctx, "Hits"))
+	require.NoError(t, mem.DeleteMetric(ctx, TypeGauge, "Alloc"))
+	// Отклонённое изменение не публикуется
+	assert.Error(t, mem.DeleteMetric(ctx, TypeGauge, "Alloc"))
+	assert.Equal(t, uint64(7), s.Seq())
+
+	type change struct {
+		Seq     uint64
+		Op      string
+		Name    string
+		Value   float64
+		Counter int64
+		Delta   int64
+	}
+	var got []change
+	for i := 0; i < 7; i++ {
+		e := <-sub.C
+		assert.Equal(t, at, e.Time)
+		assert.Equal(t, s.Epoch(), e.Epoch)
+		c := change{Seq: e.Seq, Op: e.Op, Name: e.Name}
+		if e.Value != nil {
+			c.Value = *e.Value
+		}
+		if e.Counter != nil {
+			c.Counter = *e.Counter
+		}
+		if e.Delta != nil {
+			c.Delta = *e.Delta
+		}
+		got = append(got, c)
+	}
+	assert.Equal(t, []change{
+		{Seq: 1, Op: EventUpdate, Name: "Alloc", Value: 1.5},
+		{Seq: 2, Op: EventUpdate, Name: "Hits", Counter: 2, Delta: 2},
+		{Seq: 3, Op: EventUpdate, Name: "Hits", Counter: 5, Delta: 3},
+		{Seq: 4, Op: EventUpdate, Name: "Alloc", Value: 2},
+		{Seq: 5, Op: EventUpdate, Name: "Hits", Counter: 9, Delta: 4},
+		{Seq: 6, Op: EventReset, Name: "Hits"},
+		{Seq: 7, Op: EventDelete, Name: "Alloc"},
+	}, got)
+
+	// Продолжение с номера: хранятся только последние 4 события
+	resumed, err := s.Subscribe(ctx, s.Epoch(), 5, 0, SlowDrop)
+	require.NoError(t, err)
+	for seq := uint64(5); seq <= 7; seq++ {
+		assert.Equal(t, seq, (<-resumed.C).Seq)
+	}
+	resumed.Close()
+	_, ok := <-resumed.C
+	assert.False(t, ok)
+	_, err = s.Subscribe(ctx, s.Epoch(), 3, 0, SlowDrop)
+	assert.ErrorIs(t, err, ErrFeedTruncated)
+	_, err = s.Subscribe(ctx, s.Epoch(), 9, 0, SlowDrop)
+	assert.ErrorIs(t, err, ErrFeedTruncated)
+	// Номера другой эпохи — другого процесса — не продолжают ленту
+	_, err = s.Subscribe(ctx, "", 5, 0, SlowDrop)
+	assert.ErrorIs(t, err, ErrFeedTruncated)
+	_, err = s.Subscribe(ctx, "other", 5, 0, SlowDrop)
+	assert.ErrorIs(t, err, ErrFeedTruncated)
+
+	// Медленный подписчик теряет события или отключается
+	slow, err := s.Subscribe(ctx, "", 0, 1, SlowDrop)
+	require.NoError(t, err)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	strict, err := s.Subscribe(cancelCtx, "", 0, 1, SlowDisconnect)
+	require.NoError(t, err)
+	require.NoError(t, mem.UpdateSet(ctx, "Users", []string{"a", "b"}))
+	require.NoError(t, mem.UpdateSet(ctx, "Users", []string{"c"}))
+
+	e := <-slow.C
+	assert.Equal(t, uint64(8), e.Seq)
+	assert.Equal(t, uint64(2), *e.Cardinality)
+	assert.Equal(t, uint64(1), slow.Dropped())
+	assert.Equal(t, uint64(8), (<-strict.C).Seq)
+	_, ok = <-strict.C
+	assert.False(t, ok)
+	assert.ErrorIs(t, strict.Err(), ErrSlowConsumer)
+	cancel()
+
+	// Подписка закрывается при отмене контекста
+	watchCtx, stop := context.WithCancel(ctx)
+	watcher, err := s.Subscribe(watchCtx, "", 0, 1, SlowDrop)
+	require.NoError(t, err)
+	stop()
+	_, ok = <-watcher.C
+	assert.False(t, ok)
+	assert.NoError(t, watcher.Err())
+
+	assert.Equal(t, uint64(8), (<-sub.C).Seq)
+	assert.Equal(t, uint64(9), (<-sub.C).Seq)
+	require.NoError(t, mem.ReplaceAll(ctx, []MetricUpdate{
+		{MType: TypeCounter, Name: "Hits", Delta: 1},
+		{MType: TypeCounter, Name: "Hits", Delta: 2},
+	}))
+	assert.Equal(t, EventReplace, (<-sub.C).Op)
+	assert.Equal(t, int64(1), *(<-sub.C).Counter)
+	e = <-sub.C
+	assert.Equal(t, EventUpdate, e.Op)
+	assert.Equal(t, int64(3), *e.Counter)
+	assert.Equal(t, uint64(12), e.Seq)
+}
+
+func TestMemoryStorageHistogram(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	h := models.Histogram{Bounds: []float64{0.1, 1}, Counts: []uint64{1, 1, 0}, Sum: 0.6}
+
+	require.NoError(t, s.UpdateHistogram(ctx, "Latency", h))
+	require.NoError(t, s.UpdateHistogram(ctx, "Latency", h))
+	got, err := s.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 2, 0}, got.Counts)
+	assert.Equal(t, uint64(4), got.Count)
+
+	mismatch := models.Histogram{Bounds: []float64{0.5}, Counts: []uint64{1, 0}}
+	assert.ErrorIs(t, s.UpdateHistogram(ctx, "Latency", mismatch), ErrInvalidUpdate)
+
+	// Несовпадение границ отклоняет весь пакет
+	err = s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeGauge, Name: "Alloc", Value: 1},
+		{MType: TypeHistogram, Name: "Latency", Histogram: &mismatch},
+	})
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Equal(t, 1, batchErr.Items[0].Index)
+	_, err = s.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, s.UpdateBatch(ctx, []MetricUpdate{
+		{MType: TypeHistogram, Name: "Latency", Histogram: &h},
+		{MType: TypeHistogram, Name: "Latency", Histogram: &h},
+	}))
+	got, _ = s.GetHistogram(ctx, "Latency")
+	assert.Equal(t, uint64(8), got.Count)
+	histograms, err := s.GetAllHistograms(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, histograms, "Latency")
+
+	assert.NoError(t, s.DeleteMetric(ctx, TypeHistogram, "Latency"))
+	_, err = s.GetHistogram(ctx, "Latency")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -1,25 +1,337 @@
 package storage
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+// MockStorage — простая реализация Repository на одной блокировке для
+// тестов. Поля можно заполнять напрямую до начала использования.
 type MockStorage struct {
-	Gauges   map[string]float64
-	Counters map[string]int64
+	mu         sync.Mutex
+	Gauges     map[string]float64
+	Counters   map[string]int64
+	Histograms map[string]models.Histogram
+	Sets       map[string]*hll.Sketch
+	// Время последнего изменения; метрики, заполненные напрямую, его не
+	// имеют и считаются устаревшими
+	updated map[MetricKey]time.Time
 }
 
 func NewMockStorage() *MockStorage {
 	return &MockStorage{
-		Gauges:   make(map[string]float64),
-		Counters: make(map[string]int64),
+		Gauges:     make(map[string]float64),
+		Counters:   make(map[string]int64),
+		Histograms: make(map[string]models.Histogram),
+		Sets:       make(map[string]*hll.Sketch),
 	}
 }
 
-func (m *MockStorage) UpdateGauge(name string, value float64) {
+func (m *MockStorage) UpdateGauge(ctx context.Context, name string, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Gauges[name] = value
+	m.touch(TypeGauge, name)
+	return nil
 }
 
-func (m *MockStorage) UpdateCounter(name string, value int64) {
+func (m *MockStorage) UpdateCounter(ctx context.Context, name string, value int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Counters[name] += value
+	m.touch(TypeCounter, name)
+	return nil
+}
+
+func (m *MockStorage) UpdateHistogram(ctx context.Context, name string, h models.Histogram) error {
+	return m.UpdateBatch(ctx, []MetricUpdate{{MType: TypeHistogram, Name: name, Histogram: &h}})
+}
+
+func (m *MockStorage) UpdateSet(ctx context.Context, name string, members []string) error {
+	if len(members) == 0 {
+		return fmt.Errorf("%w: no members", ErrInvalidUpdate)
+	}
+	return m.UpdateBatch(ctx, []MetricUpdate{{MType: TypeSet, Name: name, Members: members}})
+}
+
+func (m *MockStorage) UpdateBatch(ctx context.Context, updates []MetricUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidateBatch(updates); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apply(updates, false)
+}
+
+func (m *MockStorage) ReplaceAll(ctx context.Context, updates []MetricUpdate) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidateBatch(updates); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apply(updates, true)
+}
+
+func (m *MockStorage) apply(updates []MetricUpdate, replace bool) error {
+	histograms, err := mergeBatchHistograms(updates, func(name string) (models.Histogram, bool) {
+		h, ok := m.Histograms[name]
+		return h, ok && !replace
+	})
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		m.Gauges = make(map[string]float64)
+		m.Counters = make(map[string]int64)
+		m.Histograms = make(map[string]models.Histogram)
+		m.Sets = make(map[string]*hll.Sketch)
+		m.updated = nil
+	}
+
+	for _, u := range updates {
+		switch u.MType {
+		case TypeGauge:
+			m.Gauges[u.Name] = u.Value
+		case TypeCounter:
+			m.Counters[u.Name] += u.Delta
+		case TypeHistogram:
+			m.Histograms[u.Name] = histograms[u.Name]
+		case TypeSet:
+			set, ok := m.Sets[u.Name]
+			if !ok {
+				set = hll.New()
+				m.Sets[u.Name] = set
+			}
+			for _, member := range u.Members {
+				set.Add(member)
+			}
+			if u.Sketch != nil {
+				set.Merge(u.Sketch)
+			}
+		}
+		m.touch(u.MType, u.Name)
+	}
+	return nil
+}
+
+func (m *MockStorage) touch(mType, name string) {
+	if m.updated == nil {
+		m.updated = make(map[MetricKey]time.Time)
+	}
+	m.updated[MetricKey{mType, name}] = time.Now()
+}
+
+func (m *MockStorage) DeleteMetric(ctx context.Context, mType, name string) error {
+	return m.DeleteMetricIfStale(ctx, mType, name, time.Time{})
+}
+
+func (m *MockStorage) DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ok bool
+	switch mType {
+	case TypeGauge:
+		_, ok = m.Gauges[name]
+	case TypeCounter:
+		_, ok = m.Counters[name]
+	case TypeHistogram:
+		_, ok = m.Histograms[name]
+	case TypeSet:
+		_, ok = m.Sets[name]
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidUpdate, mType)
+	}
+	if !ok {
+		return notFound(mType, name)
+	}
+	key := MetricKey{mType, name}
+	if !before.IsZero() && !m.updated[key].Before(before) {
+		return notStale(mType, name)
+	}
+
+	switch mType {
+	case TypeGauge:
+		delete(m.Gauges, name)
+	case TypeCounter:
+		delete(m.Counters, name)
+	case TypeHistogram:
+		delete(m.Histograms, name)
+	case TypeSet:
+		delete(m.Sets, name)
+	}
+	delete(m.updated, key)
+	return nil
+}
+
+func (m *MockStorage) ResetCounter(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.Counters[name]; !ok {
+		return notFound(TypeCounter, name)
+	}
+	m.Counters[name] = 0
+	m.touch(TypeCounter, name)
+	return nil
+}
+
+func (m *MockStorage) GetAllMetrics(ctx context.Context) (map[string]float64, map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gauges := make(map[string]float64, len(m.Gauges))
+	for k, v := range m.Gauges {
+		gauges[k] = v
+	}
+	counters := make(map[string]int64, len(m.Counters))
+	for k, v := range m.Counters {
+		counters[k] = v
+	}
+	return gauges, counters, nil
+}
+
+func (m *MockStorage) GetGauge(ctx context.Context, name string) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.Gauges[name]
+	if !ok {
+		return 0, notFound(TypeGauge, name)
+	}
+	return val, nil
+}
+
+func (m *MockStorage) GetCounter(ctx context.Context, name string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.Counters[name]
+	if !ok {
+		return 0, notFound(TypeCounter, name)
+	}
+	return val, nil
+}
+
+func (m *MockStorage) GetHistogram(ctx context.Context, name string) (models.Histogram, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Histogram{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.Histograms[name]
+	if !ok {
+		return models.Histogram{}, notFound(TypeHistogram, name)
+	}
+	return val.Normalize(), nil
+}
+
+func (m *MockStorage) GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	histograms := make(map[string]models.Histogram, len(m.Histograms))
+	for k, v := range m.Histograms {
+		histograms[k] = v.Normalize()
+	}
+	return histograms, nil
 }
 
-func (m *MockStorage) GetAllMetrics() (map[string]float64, map[string]int64) {
-	return m.Gauges, m.Counters
+func (m *MockStorage) GetSet(ctx context.Context, name string) (*hll.Sketch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	val, ok := m.Sets[name]
+	if !ok {
+		return nil, notFound(TypeSet, name)
+	}
+	return val.Clone(), nil
+}
+
+func (m *MockStorage) GetAllSets(ctx context.Context) (map[string]*hll.Sketch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sets := make(map[string]*hll.Sketch, len(m.Sets))
+	for k, v := range m.Sets {
+		sets[k] = v.Clone()
+	}
+	return sets, nil
+}
+
+func (m *MockStorage) Snapshot(ctx context.Context) (models.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return models.Snapshot{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := models.Snapshot{
+		Gauges:     make(map[string]float64, len(m.Gauges)),
+		Counters:   make(map[string]int64, len(m.Counters)),
+		Histograms: make(map[string]models.Histogram, len(m.Histograms)),
+		Sets:       make(map[string]*hll.Sketch, len(m.Sets)),
+	}
+	for k, v := range m.Gauges {
+		snap.Gauges[k] = v
+	}
+	for k, v := range m.Counters {
+		snap.Counters[k] = v
+	}
+	for k, v := range m.Histograms {
+		snap.Histograms[k] = v.Normalize()
+	}
+	for k, v := range m.Sets {
+		snap.Sets[k] = v.Clone()
+	}
+	return snap, nil
 }
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+// Виды изменений, которые получают наблюдатели.
+const (
+	OpUpdate = "update"
+	OpDelete = "delete"
+	OpReset  = "reset"
+	// OpReplace предшествует изменениям OpUpdate с новым содержимым
+	// хранилища после ReplaceAll
+	OpReplace = "replace"
+)
+
+// Change — изменение одной метрики. Update содержит исходное изменение,
+// остальные поля — значение метрики после него: сумму counter,
+// гистограмму или множество. В пакете гистограмма и множество описываются
+// состоянием после всего пакета; множество можно читать только во время
+// вызова наблюдателя.
+type Change struct {
+	Op        string
+	Update    MetricUpdate
+	Time      time.Time
+	Counter   int64
+	Histogram models.Histogram
+	Set       *hll.Sketch
+}
+
+// Observer получает изменения под блокировками шардов, к которым они
+// относятся, поэтому изменения одной метрики приходят в порядке
+// применения. Пакет и ReplaceAll передаются одним вызовом. Наблюдатель
+// вызывается конкурентно для разных шардов и не должен обращаться к
+// хранилищу.
+type Observer func(changes []Change)
+
+// Observe добавляет наблюдателя. Наблюдатели добавляются до начала записи
+// в хранилище.
+func (s *MemoryStorage) Observe(o Observer) {
+	s.observers = append(s.observers, o)
+}
+
+func (s *MemoryStorage) notify(changes ...Change) {
+	for _, o := range s.observers {
+		o(changes)
+	}
+}
+
+// changed описывает изменение u по уже изменённому шарду.
+func (sh *shard) changed(op string, u MetricUpdate, now time.Time) Change {
+	c := Change{Op: op, Update: u, Time: now}
+	switch u.MType {
+	case TypeCounter:
+		c.Counter = sh.counters[u.Name]
+	case TypeHistogram:
+		c.Histogram = sh.histograms[u.Name]
+	case TypeSet:
+		c.Set = sh.sets[u.Name]
+	}
+	return c
+}
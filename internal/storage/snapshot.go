@@ -0,0 +1,27 @@
+package storage
+
+import "github.com/yadmabramov/admAlerting/internal/models"
+
+// SnapshotUpdates преобразует снимок в пакет изменений. Значение counter
+// передаётся как Delta: UpdateBatch прибавит его к текущему, ReplaceAll —
+// установит.
+func SnapshotUpdates(snap models.Snapshot) []MetricUpdate {
+	updates := make([]MetricUpdate, 0, len(snap.Gauges)+len(snap.Counters)+len(snap.Histograms)+len(snap.Sets))
+	for name, value := range snap.Gauges {
+		updates = append(updates, MetricUpdate{MType: TypeGauge, Name: name, Value: value})
+	}
+	for name, value := range snap.Counters {
+		updates = append(updates, MetricUpdate{MType: TypeCounter, Name: name, Delta: value})
+	}
+	for name, value := range snap.Histograms {
+		h := value
+		updates = append(updates, MetricUpdate{MType: TypeHistogram, Name: name, Histogram: &h})
+	}
+	for name, sketch := range snap.Sets {
+		if sketch == nil {
+			continue
+		}
+		updates = append(updates, MetricUpdate{MType: TypeSet, Name: name, Sketch: sketch})
+	}
+	return updates
+}
@@ -1,9 +1,79 @@
 package storage
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/hll"
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+var ErrNotFound = errors.New("metric not found")
+
+// ErrNotPersisted — изменение применено к хранилищу в памяти, но не
+// сохранено на диск. Повтор запроса применит его ещё раз.
+var ErrNotPersisted = errors.New("change applied but not persisted")
+
+// ErrNotStale — условное удаление не выполнено: метрика изменялась после
+// указанного момента.
+var ErrNotStale = errors.New("metric was updated after the deadline")
+
+func notStale(mType, name string) error {
+	return fmt.Errorf("%w: %s %q", ErrNotStale, mType, name)
+}
+
+// NotFoundError сообщает, какой метрики нет в хранилище.
+// errors.Is(err, ErrNotFound) для неё истинно.
+type NotFoundError struct {
+	MType string
+	Name  string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %q not found", e.MType, e.Name)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func notFound(mType, name string) error {
+	return &NotFoundError{MType: mType, Name: name}
+}
+
+// Repository — хранилище метрик. Все методы учитывают отмену ctx; чтение
+// отсутствующей метрики возвращает *NotFoundError.
 type Repository interface {
-	UpdateGauge(name string, value float64) error
-	UpdateCounter(name string, value int64) error
-	GetAllMetrics() (gauges map[string]float64, counters map[string]int64)
-	GetGauge(name string) (float64, bool)
-	GetCounter(name string) (int64, bool)
+	UpdateGauge(ctx context.Context, name string, value float64) error
+	UpdateCounter(ctx context.Context, name string, value int64) error
+	// UpdateHistogram добавляет наблюдения к гистограмме; границы корзин
+	// должны совпадать с уже сохранёнными
+	UpdateHistogram(ctx context.Context, name string, h models.Histogram) error
+	// UpdateSet добавляет значения в множество, хранимое как HyperLogLog
+	UpdateSet(ctx context.Context, name string, members []string) error
+	// UpdateBatch применяет все изменения атомарно либо не применяет ни одного
+	UpdateBatch(ctx context.Context, updates []MetricUpdate) error
+	// ReplaceAll атомарно заменяет всё содержимое хранилища пакетом:
+	// метрики, которых нет в updates, удаляются, counter получает сумму
+	// своих Delta, а не прибавляет её к прежнему значению
+	ReplaceAll(ctx context.Context, updates []MetricUpdate) error
+	DeleteMetric(ctx context.Context, mType, name string) error
+	// DeleteMetricIfStale удаляет метрику, только если она не изменялась с
+	// момента before, иначе возвращает ErrNotStale; проверка и удаление
+	// атомарны относительно записи в метрику
+	DeleteMetricIfStale(ctx context.Context, mType, name string, before time.Time) error
+	ResetCounter(ctx context.Context, name string) error
+	GetAllMetrics(ctx context.Context) (gauges map[string]float64, counters map[string]int64, err error)
+	GetGauge(ctx context.Context, name string) (float64, error)
+	GetCounter(ctx context.Context, name string) (int64, error)
+	GetHistogram(ctx context.Context, name string) (models.Histogram, error)
+	GetAllHistograms(ctx context.Context) (map[string]models.Histogram, error)
+	// GetSet и GetAllSets возвращают копии скетчей
+	GetSet(ctx context.Context, name string) (*hll.Sketch, error)
+	GetAllSets(ctx context.Context) (map[string]*hll.Sketch, error)
+	// Snapshot возвращает копию метрик всех типов, прочитанную целиком:
+	// пакет изменений виден в ней полностью или не виден совсем
+	Snapshot(ctx context.Context) (models.Snapshot, error)
 }
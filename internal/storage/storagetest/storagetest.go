@@ -0,0 +1,404 @@
+// Package storagetest содержит набор проверок, которые должна проходить
+// любая реализация storage.Repository.
+package storagetest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yadmabramov/admAlerting/internal/models"
+	"github.com/yadmabramov/admAlerting/internal/storage"
+)
+
+// Run проверяет реализацию на соответствие контракту storage.Repository.
+// newRepo вызывается для каждой проверки и должна возвращать пустое
+// хранилище.
+func Run(t *testing.T, newRepo func(t *testing.T) storage.Repository) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, repo storage.Repository)
+	}{
+		{"GaugeOverwrite", testGaugeOverwrite},
+		{"CounterAccumulation", testCounterAccumulation},
+		{"NotFound", testNotFound},
+		{"DeleteAndReset", testDeleteAndReset},
+		{"DeleteIfStale", testDeleteIfStale},
+		{"Batch", testBatch},
+		{"ReplaceAll", testReplaceAll},
+		{"Histogram", testHistogram},
+		{"Set", testSet},
+		{"SnapshotCopies", testSnapshotCopies},
+		{"Snapshot", testSnapshot},
+		{"CanceledContext", testCanceledContext},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo(t))
+		})
+	}
+}
+
+func testGaugeOverwrite(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 1.5))
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", -2.25))
+
+	value, err := repo.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, -2.25, value)
+
+	gauges, _, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": -2.25}, gauges)
+}
+
+func testCounterAccumulation(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 10))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 5))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", -3))
+
+	value, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), value)
+
+	// Gauge и counter с одним именем — разные метрики
+	require.NoError(t, repo.UpdateGauge(ctx, "PollCount", 1))
+	value, err = repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), value)
+}
+
+func testNotFound(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 1))
+
+	var notFound *storage.NotFoundError
+
+	_, err := repo.GetGauge(ctx, "PollCount")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	if assert.ErrorAs(t, err, &notFound) {
+		assert.Equal(t, storage.TypeGauge, notFound.MType)
+		assert.Equal(t, "PollCount", notFound.Name)
+	}
+
+	_, err = repo.GetCounter(ctx, "Missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = repo.GetHistogram(ctx, "Missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = repo.GetSet(ctx, "Missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.ErrorIs(t, repo.DeleteMetric(ctx, storage.TypeGauge, "Missing"), storage.ErrNotFound)
+	assert.ErrorIs(t, repo.ResetCounter(ctx, "Missing"), storage.ErrNotFound)
+}
+
+func testDeleteAndReset(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 5))
+
+	require.NoError(t, repo.DeleteMetric(ctx, storage.TypeGauge, "Alloc"))
+	_, err := repo.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.ErrorIs(t, repo.DeleteMetric(ctx, storage.TypeGauge, "Alloc"), storage.ErrNotFound)
+
+	require.NoError(t, repo.ResetCounter(ctx, "PollCount"))
+	value, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value)
+
+	assert.Error(t, repo.DeleteMetric(ctx, "unknown", "PollCount"))
+}
+
+func testDeleteIfStale(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, repo.UpdateCounter(ctx, "Alloc", 1))
+	updated := time.Now()
+
+	assert.ErrorIs(t, repo.DeleteMetricIfStale(ctx, storage.TypeGauge, "Alloc", updated.Add(-time.Hour)), storage.ErrNotStale)
+	_, err := repo.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+
+	require.NoError(t, repo.DeleteMetricIfStale(ctx, storage.TypeGauge, "Alloc", updated.Add(time.Hour)))
+	_, err = repo.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.ErrorIs(t, repo.DeleteMetricIfStale(ctx, storage.TypeGauge, "Alloc", updated.Add(time.Hour)), storage.ErrNotFound)
+
+	// Метрика другого типа с тем же именем не затронута
+	_, err = repo.GetCounter(ctx, "Alloc")
+	assert.NoError(t, err)
+}
+
+func testBatch(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateBatch(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeGauge, Name: "Alloc", Value: 1.5},
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 2},
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 3},
+	}))
+
+	gauges, counters, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 1.5}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 5}, counters)
+
+	// Пакет с ошибкой не применяется целиком
+	err = repo.UpdateBatch(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeGauge, Name: "Alloc", Value: 9},
+		{MType: storage.TypeCounter, Name: ""},
+	})
+	var batchErr *storage.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.ErrorIs(t, err, storage.ErrInvalidUpdate)
+	assert.Equal(t, 1, batchErr.Items[0].Index)
+
+	value, err := repo.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+}
+
+func testReplaceAll(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	h := models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}}
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, repo.UpdateGauge(ctx, "Stale", 1))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 10))
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", h))
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"alice"}))
+
+	// Counter получает значение из пакета, а не прибавляет его
+	require.NoError(t, repo.ReplaceAll(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeGauge, Name: "Alloc", Value: 2},
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 3},
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &h},
+	}))
+
+	gauges, counters, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": 2}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 3}, counters)
+	got, err := repo.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), got.Count)
+	_, err = repo.GetSet(ctx, "Users")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Несовместимые гистограммы внутри пакета отклоняют его целиком
+	mismatch := models.Histogram{Bounds: []float64{5}, Counts: []uint64{1, 0}}
+	err = repo.ReplaceAll(ctx, []storage.MetricUpdate{
+		{MType: storage.TypeCounter, Name: "PollCount", Delta: 7},
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &h},
+		{MType: storage.TypeHistogram, Name: "Latency", Histogram: &mismatch},
+	})
+	assert.ErrorIs(t, err, storage.ErrInvalidUpdate)
+	counter, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter)
+
+	require.NoError(t, repo.ReplaceAll(ctx, nil))
+	gauges, counters, err = repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, gauges)
+	assert.Empty(t, counters)
+}
+
+func testHistogram(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	h := models.Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 2, 0}, Sum: 3.5}
+
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", h))
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", h))
+
+	got, err := repo.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 4, 0}, got.Counts)
+	assert.Equal(t, uint64(6), got.Count)
+	assert.Equal(t, 7.0, got.Sum)
+
+	mismatch := models.Histogram{Bounds: []float64{5}, Counts: []uint64{1, 0}}
+	assert.ErrorIs(t, repo.UpdateHistogram(ctx, "Latency", mismatch), storage.ErrInvalidUpdate)
+	assert.ErrorIs(t, repo.UpdateHistogram(ctx, "Bad", models.Histogram{}), storage.ErrInvalidUpdate)
+}
+
+func testSet(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"alice", "bob"}))
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"bob", "carol"}))
+
+	sketch, err := repo.GetSet(ctx, "Users")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), sketch.Estimate())
+
+	sets, err := repo.GetAllSets(ctx)
+	require.NoError(t, err)
+	require.Contains(t, sets, "Users")
+	assert.Equal(t, uint64(3), sets["Users"].Estimate())
+}
+
+// testSnapshotCopies проверяет, что результаты чтения не связаны
+// с состоянием хранилища.
+func testSnapshotCopies(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 1))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}}))
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"alice"}))
+
+	gauges, counters, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	histograms, err := repo.GetAllHistograms(ctx)
+	require.NoError(t, err)
+	sets, err := repo.GetAllSets(ctx)
+	require.NoError(t, err)
+
+	// Изменения хранилища не видны в полученных ранее срезах
+	require.NoError(t, repo.UpdateGauge(ctx, "Alloc", 2))
+	require.NoError(t, repo.UpdateGauge(ctx, "HeapAlloc", 3))
+	require.NoError(t, repo.UpdateCounter(ctx, "PollCount", 1))
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}}))
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"bob"}))
+	assert.Equal(t, map[string]float64{"Alloc": 1}, gauges)
+	assert.Equal(t, map[string]int64{"PollCount": 1}, counters)
+	assert.Equal(t, uint64(1), histograms["Latency"].Count)
+	assert.Equal(t, uint64(1), sets["Users"].Estimate())
+
+	// И наоборот: изменение срезов не меняет хранилище
+	gauges["Alloc"] = 100
+	counters["PollCount"] = 100
+	histograms["Latency"].Counts[0] = 100
+	sets["Users"].Add("mallory")
+	h, err := repo.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	h.Counts[0] = 100
+	sketch, err := repo.GetSet(ctx, "Users")
+	require.NoError(t, err)
+	sketch.Add("eve")
+
+	gauge, err := repo.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, gauge)
+	counter, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), counter)
+	h, err = repo.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 0}, h.Counts)
+	sketch, err = repo.GetSet(ctx, "Users")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), sketch.Estimate())
+}
+
+func testSnapshot(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	h := models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}}
+	require.NoError(t, repo.UpdateHistogram(ctx, "Latency", h))
+	require.NoError(t, repo.UpdateSet(ctx, "Users", []string{"alice"}))
+
+	// Снимок видит пакет целиком: значения разных типов из одного пакета
+	// согласованы между собой
+	const n = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= n; i++ {
+			assert.NoError(t, repo.UpdateBatch(ctx, []storage.MetricUpdate{
+				{MType: storage.TypeGauge, Name: "Alloc", Value: float64(i)},
+				{MType: storage.TypeCounter, Name: "PollCount", Delta: 1},
+			}))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		snap, err := repo.Snapshot(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, snap.Gauges["Alloc"], float64(snap.Counters["PollCount"]))
+	}
+	<-done
+
+	snap, err := repo.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"Alloc": n}, snap.Gauges)
+	assert.Equal(t, map[string]int64{"PollCount": n}, snap.Counters)
+	assert.Equal(t, uint64(1), snap.Histograms["Latency"].Count)
+	assert.Equal(t, uint64(1), snap.Sets["Users"].Estimate())
+
+	// Снимок — копия
+	snap.Histograms["Latency"].Counts[0] = 100
+	snap.Sets["Users"].Add("mallory")
+	got, err := repo.GetHistogram(ctx, "Latency")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 0}, got.Counts)
+	sketch, err := repo.GetSet(ctx, "Users")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), sketch.Estimate())
+}
+
+func testCanceledContext(t *testing.T, repo storage.Repository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, repo.UpdateGauge(ctx, "Alloc", 1), context.Canceled)
+	assert.ErrorIs(t, repo.UpdateCounter(ctx, "PollCount", 1), context.Canceled)
+	_, _, err := repo.GetAllMetrics(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = repo.Snapshot(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = repo.GetGauge(context.Background(), "Alloc")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+// testConcurrent имеет смысл запускать с -race.
+func testConcurrent(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	const (
+		workers    = 8
+		iterations = 500
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				name := "gauge" + strconv.Itoa(j%20)
+				assert.NoError(t, repo.UpdateCounter(ctx, "PollCount", 1))
+				assert.NoError(t, repo.UpdateGauge(ctx, name, float64(i)))
+				assert.NoError(t, repo.UpdateBatch(ctx, []storage.MetricUpdate{
+					{MType: storage.TypeCounter, Name: "BatchCount", Delta: 1},
+					{MType: storage.TypeGauge, Name: name, Value: float64(j)},
+				}))
+				assert.NoError(t, repo.UpdateSet(ctx, "Workers", []string{strconv.Itoa(i)}))
+				_, _, err := repo.GetAllMetrics(ctx)
+				assert.NoError(t, err)
+				_, err = repo.GetGauge(ctx, name)
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	value, err := repo.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(workers*iterations), value)
+	value, err = repo.GetCounter(ctx, "BatchCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(workers*iterations), value)
+
+	gauges, _, err := repo.GetAllMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, gauges, 20)
+
+	sketch, err := repo.GetSet(ctx, "Workers")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(workers), sketch.Estimate())
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yadmabramov/admAlerting/internal/models"
+)
+
+// TTLRule задаёт время жизни метрик, имя которых подходит под шаблон
+// (синтаксис path.Match, например "Tmp*"). Шаблон сравнивается с именем
+// без меток, так что правило действует на все ряды метрики. Нулевой TTL —
+// без ограничения.
+type TTLRule struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+// TTLPolicy — упорядоченный список правил: применяется первое подходящее.
+// Метрики, не подошедшие ни под одно правило, не устаревают.
+type TTLPolicy []TTLRule
+
+// ParseTTLPolicy разбирает строку вида "Tmp*=10m,Debug*=1h,*=0".
+func ParseTTLPolicy(value string) (TTLPolicy, error) {
+	var policy TTLPolicy
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		pattern, ttl, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TTL rule %q: expected <pattern>=<duration>", part)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid TTL pattern %q: %w", pattern, err)
+		}
+
+		rule := TTLRule{Pattern: pattern}
+		if ttl != "0" {
+			d, err := time.ParseDuration(ttl)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid TTL %q for pattern %q", ttl, pattern)
+			}
+			rule.TTL = d
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+// TTL возвращает время жизни ряда с ключом key.
+func (p TTLPolicy) TTL(key string) time.Duration {
+	name, _ := models.ParseSeriesKey(key)
+	for _, rule := range p {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.TTL
+		}
+	}
+	return 0
+}
+
+// Expired возвращает метрики хранилища, не обновлявшиеся дольше своего TTL.
+func (p TTLPolicy) Expired(s *MemoryStorage, now time.Time) []MetricKey {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return s.UpdatedBefore(func(key MetricKey) time.Time {
+		ttl := p.TTL(key.Name)
+		if ttl == 0 {
+			return time.Time{}
+		}
+		return now.Add(-ttl)
+	})
+}